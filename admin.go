@@ -0,0 +1,302 @@
+package journal
+
+// admin.go
+// embedded http handler to inspect & operate journal.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+type adminOption struct {
+	replayHandler ReplayHandler
+}
+
+// AdminOptionFunc option of `NewAdminHandler`
+type AdminOptionFunc func(*adminOption) error
+
+// WithAdminReplayHandler set handler for records replayed by `POST /replay/start`,
+// replay is not available if handler is not set.
+func WithAdminReplayHandler(handler ReplayHandler) AdminOptionFunc {
+	return func(o *adminOption) error {
+		if handler == nil {
+			return fmt.Errorf("replay handler cannot be nil")
+		}
+
+		o.replayHandler = handler
+		return nil
+	}
+}
+
+// ReplayStatus status of replay started by admin
+type ReplayStatus struct {
+	IsRunning bool  `json:"is_running"`
+	Records   int64 `json:"records"`
+	// DeadLetters number of records moved into dead letters, see `WithDeadLetter`
+	DeadLetters int64     `json:"dead_letters"`
+	StartAt     time.Time `json:"start_at"`
+	EndAt       time.Time `json:"end_at"`
+	Err         string    `json:"error,omitempty"`
+}
+
+// AdminHandler http handler to inspect & operate journal:
+//
+//	GET  /status        journal status
+//	GET  /metrics       metrics in prometheus text format
+//	POST /rotate        force rotate
+//	POST /flush         flush buffers into files
+//	POST /replay/start  start loading legacy files
+//	POST /replay/abort  abort running replay
+//	POST /clean         remove consumed segments
+//
+// could be mounted with `http.StripPrefix`.
+type AdminHandler struct {
+	*adminOption
+	sync.Mutex
+	j   *Journal
+	mux *http.ServeMux
+
+	replay       ReplayStatus
+	replayCancel context.CancelFunc
+	replayDone   chan struct{}
+}
+
+// NewAdminHandler create new AdminHandler
+func NewAdminHandler(j *Journal, opts ...AdminOptionFunc) (h *AdminHandler, err error) {
+	if j == nil {
+		return nil, fmt.Errorf("journal cannot be nil")
+	}
+
+	h = &AdminHandler{
+		adminOption: &adminOption{},
+		j:           j,
+		mux:         http.NewServeMux(),
+	}
+	for _, optf := range opts {
+		if err = optf(h.adminOption); err != nil {
+			return nil, err
+		}
+	}
+
+	h.mux.HandleFunc("/status", h.handleStatus)
+	h.mux.HandleFunc("/metrics", h.handleMetrics)
+	h.mux.HandleFunc("/rotate", h.post(h.handleRotate))
+	h.mux.HandleFunc("/flush", h.post(h.handleFlush))
+	h.mux.HandleFunc("/replay/start", h.post(h.handleReplayStart))
+	h.mux.HandleFunc("/replay/abort", h.post(h.handleReplayAbort))
+	h.mux.HandleFunc("/clean", h.post(h.handleClean))
+	return h, nil
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// post only allow POST method
+func (h *AdminHandler) post(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			h.writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method `%s` not allowed", r.Method))
+			return
+		}
+
+		h.j.logger.Info("admin action", zap.String("path", r.URL.Path), zap.String("remote", r.RemoteAddr))
+		handler(w, r)
+	}
+}
+
+func (h *AdminHandler) handleStatus(w http.ResponseWriter, r *http.Request) {
+	h.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"journal": h.j.Status(),
+		"replay":  h.ReplayStatus(),
+		"metrics": h.j.GetMetric(),
+	})
+}
+
+func (h *AdminHandler) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.j.metrics.(MetricsExporter); !ok {
+		h.writeJSON(w, http.StatusOK, h.j.GetMetric())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := h.j.WritePrometheus(w); err != nil {
+		h.writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (h *AdminHandler) handleRotate(w http.ResponseWriter, r *http.Request) {
+	if err := h.j.Rotate(r.Context()); err != nil {
+		h.writeError(w, http.StatusInternalServerError, errors.Wrap(err, "rotate"))
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, h.j.Status())
+}
+
+func (h *AdminHandler) handleFlush(w http.ResponseWriter, r *http.Request) {
+	h.j.Lock()
+	err := h.j.Flush()
+	h.j.Unlock()
+	if err != nil {
+		h.writeError(w, http.StatusInternalServerError, errors.Wrap(err, "flush"))
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, h.j.Status())
+}
+
+func (h *AdminHandler) handleReplayStart(w http.ResponseWriter, r *http.Request) {
+	if err := h.StartReplay(); err != nil {
+		code := http.StatusConflict
+		if h.replayHandler == nil {
+			code = http.StatusNotImplemented
+		}
+		h.writeError(w, code, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusAccepted, h.ReplayStatus())
+}
+
+func (h *AdminHandler) handleReplayAbort(w http.ResponseWriter, r *http.Request) {
+	if err := h.AbortReplay(r.Context()); err != nil {
+		h.writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, h.ReplayStatus())
+}
+
+func (h *AdminHandler) handleClean(w http.ResponseWriter, r *http.Request) {
+	if err := h.j.checkWritable(); err != nil {
+		h.writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if h.j.IsLegacyRunning() {
+		h.writeError(w, http.StatusConflict, fmt.Errorf("legacy is running"))
+		return
+	}
+
+	if err := h.j.manifest.RemoveConsumed(h.j.logger); err != nil {
+		h.writeError(w, http.StatusInternalServerError, errors.Wrap(err, "remove consumed segments"))
+		return
+	}
+	h.j.collectSegmentMetrics()
+
+	h.writeJSON(w, http.StatusOK, h.j.Status())
+}
+
+// ReplayStatus return status of replay started by admin
+func (h *AdminHandler) ReplayStatus() ReplayStatus {
+	h.Lock()
+	defer h.Unlock()
+	return h.replay
+}
+
+// StartReplay replay legacy segments into replay handler in background by `Journal.Replay`,
+// records are delivered one by one, in file order within each segment.
+//
+// failed record only stops its own segment, later segments are still replayed.
+// segments with failed records are not cleaned, so failed and following records of them
+// will be replayed next time, or failed records are moved into dead letters if `WithDeadLetter` is set.
+func (h *AdminHandler) StartReplay() error {
+	if h.replayHandler == nil {
+		return fmt.Errorf("replay handler not set")
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if h.replay.IsRunning {
+		return fmt.Errorf("replay is running")
+	}
+	if h.j.IsLegacyRunning() {
+		return ErrLegacyRunning
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.replayCancel = cancel
+	h.replayDone = make(chan struct{})
+	h.replay = ReplayStatus{
+		IsRunning: true,
+		StartAt:   h.j.clock.GetUTCNow(),
+	}
+	go h.runReplay(ctx, h.replayHandler, h.replayDone)
+	return nil
+}
+
+// AbortReplay stop running replay and wait until it exits.
+// records have not been loaded will be replayed next time.
+func (h *AdminHandler) AbortReplay(ctx context.Context) error {
+	h.Lock()
+	if !h.replay.IsRunning {
+		h.Unlock()
+		return fmt.Errorf("replay is not running")
+	}
+	h.replayCancel()
+	done := h.replayDone
+	h.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *AdminHandler) runReplay(ctx context.Context, handler ReplayHandler, done chan struct{}) {
+	var (
+		report *ReplayReport
+		err    error
+	)
+	defer func() {
+		h.Lock()
+		h.replay.IsRunning = false
+		h.replay.EndAt = h.j.clock.GetUTCNow()
+		if report != nil {
+			h.replay.DeadLetters = report.DeadLetters
+		}
+		if err != nil {
+			h.replay.Err = err.Error()
+		}
+		records := h.replay.Records
+		h.Unlock()
+		close(done)
+		h.j.logger.Info("admin replay exit", zap.Int64("records", records), zap.Error(err))
+	}()
+
+	report, err = h.j.Replay(ctx, func(data *Data) error {
+		if err := handler(data); err != nil {
+			return errors.Wrapf(err, "handle record %d", data.ID)
+		}
+
+		h.Lock()
+		h.replay.Records++
+		h.Unlock()
+		return nil
+	},
+		WithReplayWorkers(1),
+		WithReplayOrder(ReplaySegmentOrdered),
+	)
+}
+
+func (h *AdminHandler) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.j.logger.Error("write admin response", zap.Error(err))
+	}
+}
+
+func (h *AdminHandler) writeError(w http.ResponseWriter, code int, err error) {
+	h.writeJSON(w, code, map[string]string{"error": err.Error()})
+}
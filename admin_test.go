@@ -0,0 +1,235 @@
+package journal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func doAdminRequest(t *testing.T, srv *httptest.Server, method, path string, expectCode int) string {
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if resp.StatusCode != expectCode {
+		t.Fatalf("%s %s: expect %d, got %d: %s", method, path, expectCode, resp.StatusCode, body)
+	}
+
+	return string(body)
+}
+
+func TestAdminHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := newTestJournal(t, ctx)
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+
+	if _, err := NewAdminHandler(nil); err == nil {
+		t.Fatal("should not accept nil journal")
+	}
+	var replayed int64
+	h, err := NewAdminHandler(j, WithAdminReplayHandler(func(data *Data) error {
+		atomic.AddInt64(&replayed, 1)
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	srv := httptest.NewServer(http.StripPrefix("/journal", h))
+	defer srv.Close()
+
+	for id := int64(0); id < 10; id++ {
+		if err = j.WriteData(&Data{ID: id}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	doAdminRequest(t, srv, http.MethodGet, "/journal/rotate", http.StatusMethodNotAllowed)
+	doAdminRequest(t, srv, http.MethodPost, "/journal/flush", http.StatusOK)
+	doAdminRequest(t, srv, http.MethodPost, "/journal/rotate", http.StatusOK)
+
+	body := doAdminRequest(t, srv, http.MethodGet, "/journal/status", http.StatusOK)
+	t.Logf("got status: %s", body)
+	status := struct {
+		Journal *JournalStatus `json:"journal"`
+	}{}
+	if err = json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if status.Journal.ActiveDataFile == "" ||
+		status.Journal.IsLegacyRunning ||
+		status.Journal.Segments[SegmentActive] != 1 {
+		t.Fatalf("got wrong status: %+v", status.Journal)
+	}
+
+	body = doAdminRequest(t, srv, http.MethodGet, "/journal/metrics", http.StatusOK)
+	if !strings.Contains(body, metricRecordsWritten+`{journal="journal"} 10`) {
+		t.Fatalf("got wrong metrics: %s", body)
+	}
+
+	doAdminRequest(t, srv, http.MethodPost, "/journal/replay/abort", http.StatusConflict)
+	doAdminRequest(t, srv, http.MethodPost, "/journal/replay/start", http.StatusAccepted)
+	for i := 0; h.ReplayStatus().IsRunning; i++ {
+		if i > 100 {
+			t.Fatal("replay should finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := h.ReplayStatus(); st.Err != "" || st.Records != atomic.LoadInt64(&replayed) {
+		t.Fatalf("got wrong replay status: %+v", st)
+	}
+	if j.IsLegacyRunning() {
+		t.Fatal("legacy lock should be released")
+	}
+	doAdminRequest(t, srv, http.MethodPost, "/journal/clean", http.StatusOK)
+
+	// abort
+	if !j.LockLegacy() {
+		t.Fatal("should acquire legacy lock")
+	}
+	doAdminRequest(t, srv, http.MethodPost, "/journal/replay/start", http.StatusConflict)
+	doAdminRequest(t, srv, http.MethodPost, "/journal/clean", http.StatusConflict)
+	j.UnLockLegacy()
+
+	block := make(chan struct{})
+	h.replayHandler = func(*Data) error {
+		<-block
+		return nil
+	}
+	for id := int64(10); id < 20; id++ {
+		if err = j.WriteData(&Data{ID: id}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	doAdminRequest(t, srv, http.MethodPost, "/journal/rotate", http.StatusOK)
+	doAdminRequest(t, srv, http.MethodPost, "/journal/rotate", http.StatusOK)
+	doAdminRequest(t, srv, http.MethodPost, "/journal/replay/start", http.StatusAccepted)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(block)
+	}()
+	doAdminRequest(t, srv, http.MethodPost, "/journal/replay/abort", http.StatusOK)
+	if st := h.ReplayStatus(); st.IsRunning || st.Err == "" {
+		t.Fatalf("got wrong replay status: %+v", st)
+	}
+	if j.IsLegacyRunning() {
+		t.Fatal("legacy lock should be released")
+	}
+
+	// replay not configured
+	h2, err := NewAdminHandler(j)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	rec := httptest.NewRecorder()
+	h2.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/replay/start", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expect 501, got %d", rec.Code)
+	}
+}
+
+func TestAdminReplayFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-admin")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := NewJournal(WithBufDirPath(dir), WithLogger(newTestLogger(t)))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var (
+		mu       sync.Mutex
+		replayed []int64
+		isBroken = true
+	)
+	h, err := NewAdminHandler(j, WithAdminReplayHandler(func(data *Data) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if isBroken && data.ID == 5 {
+			return fmt.Errorf("broken")
+		}
+		replayed = append(replayed, data.ID)
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// not started
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/clean", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expect 503, got %d", rec.Code)
+	}
+
+	if err = j.Start(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer j.Close(ctx)
+	for id := int64(0); id < 10; id++ {
+		if err = j.WriteData(&Data{ID: id}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	// legacy loader always skip the latest sealed segment
+	for i := 0; i < 2; i++ {
+		if err = j.Rotate(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	replay := func() ReplayStatus {
+		if err = h.StartReplay(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		for i := 0; h.ReplayStatus().IsRunning; i++ {
+			if i > 100 {
+				t.Fatal("replay should finished")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return h.ReplayStatus()
+	}
+
+	if st := replay(); st.Err == "" || st.Records != 5 {
+		t.Fatalf("got wrong replay status: %+v", st)
+	}
+
+	// failed record is not lost
+	mu.Lock()
+	isBroken = false
+	replayed = nil
+	mu.Unlock()
+	if st := replay(); st.Err != "" || st.Records != 10 {
+		t.Fatalf("got wrong replay status: %+v", st)
+	}
+	if len(replayed) != 10 || replayed[5] != 5 {
+		t.Fatalf("got wrong replayed records %v", replayed)
+	}
+}
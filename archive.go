@@ -0,0 +1,359 @@
+package journal
+
+// archive.go
+// archive segment files before they are removed.
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultArchiveTimeout max duration to archive one segment
+	defaultArchiveTimeout = 10 * time.Minute
+	s3TimeLayout          = "20060102T150405Z"
+	s3DateLayout          = "20060102"
+)
+
+// ArchiveSegment segment files to be archived
+type ArchiveSegment struct {
+	Name string
+	// Files absolute path of data, ids & meta files still exist on disk
+	Files []string
+	// Meta statistics of segment, nil if segment not sealed properly
+	Meta *SegmentMeta
+}
+
+// ArchiveSink persist segment files before journal removes them.
+// files will not be removed until `Archive` returns nil,
+// and will be archived again next time if failed.
+type ArchiveSink interface {
+	Archive(ctx context.Context, seg *ArchiveSegment) error
+}
+
+// archiveSegment archive all existing files of segment,
+// return nil if there is nothing to archive.
+func archiveSegment(ctx context.Context, sink ArchiveSink, dir, name string, fpaths []string) (err error) {
+	if sink == nil {
+		return nil
+	}
+
+	seg := &ArchiveSegment{Name: name}
+	for _, fpath := range append(fpaths, filepath.Join(dir, name+segmentMetaFileSuffix)) {
+		if _, err = os.Stat(fpath); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "stat file `%s`", fpath)
+		}
+		seg.Files = append(seg.Files, fpath)
+	}
+	if len(seg.Files) == 0 {
+		return nil
+	}
+	if meta, err := LoadSegmentMeta(filepath.Join(dir, name)); err == nil {
+		seg.Meta = meta
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultArchiveTimeout)
+	defer cancel()
+	if err = sink.Archive(ctx, seg); err != nil {
+		return errors.Wrapf(err, "archive segment `%s`", name)
+	}
+
+	return nil
+}
+
+// DirArchiveSink archive segment files into local directory
+type DirArchiveSink struct {
+	dir string
+}
+
+// NewDirArchiveSink create new DirArchiveSink, files are copied into `dir`
+func NewDirArchiveSink(dir string) (*DirArchiveSink, error) {
+	if err := PrepareDir(dir); err != nil {
+		return nil, errors.Wrapf(err, "prepare archive dir `%s`", dir)
+	}
+
+	return &DirArchiveSink{dir: dir}, nil
+}
+
+// Archive copy segment files into directory
+func (s *DirArchiveSink) Archive(ctx context.Context, seg *ArchiveSegment) (err error) {
+	for _, fpath := range seg.Files {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		dst := filepath.Join(s.dir, filepath.Base(fpath))
+		if err = copyFileAtomic(fpath, dst); err != nil {
+			return errors.Wrapf(err, "copy `%s` to `%s`", fpath, dst)
+		}
+	}
+
+	return nil
+}
+
+// copyFileAtomic copy file to temp file, fsync, then rename
+func copyFileAtomic(src, dst string) (err error) {
+	srcFp, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFp.Close()
+
+	return writeReaderAtomic(dst, srcFp)
+}
+
+// writeReaderAtomic write all content of `r` to temp file, fsync, then rename.
+// `dst` is replaced by new file, so its hard links still keep the old content.
+func writeReaderAtomic(dst string, r io.Reader) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+
+	return fsyncDir(filepath.Dir(dst))
+}
+
+// S3ArchiveConfig configuration of S3ArchiveSink
+type S3ArchiveConfig struct {
+	// Endpoint like `https://s3.us-east-1.amazonaws.com`, or any S3 compatible server
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix prepend to object key
+	Prefix string
+	AccessKey,
+	SecretKey string
+	// HTTPClient default to client with 5min timeout
+	HTTPClient *http.Client
+	// Logger default to `Logger`
+	Logger *utils.LoggerType
+	// Clock time to sign request, default to `utils.Clock`
+	Clock Clock
+}
+
+// S3ArchiveSink upload segment files into S3 compatible storage
+// by path-style url `<endpoint>/<bucket>/<prefix><file>`.
+//
+// upload is confirmed by server verified `Content-MD5`,
+// `ETag` is not checked since it is not md5 of object for SSE-KMS & SSE-C.
+type S3ArchiveSink struct {
+	S3ArchiveConfig
+	endpoint *url.URL
+}
+
+// NewS3ArchiveSink create new S3ArchiveSink
+func NewS3ArchiveSink(cfg S3ArchiveConfig) (s *S3ArchiveSink, err error) {
+	if cfg.Bucket == "" || cfg.Region == "" || cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("bucket, region, access key & secret key should not be empty")
+	}
+
+	s = &S3ArchiveSink{S3ArchiveConfig: cfg}
+	if s.endpoint, err = url.Parse(cfg.Endpoint); err != nil {
+		return nil, errors.Wrapf(err, "parse endpoint `%s`", cfg.Endpoint)
+	} else if s.endpoint.Scheme == "" || s.endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint `%s`", cfg.Endpoint)
+	}
+	if s.HTTPClient == nil {
+		s.HTTPClient = &http.Client{Timeout: 5 * time.Minute}
+	}
+	if s.Logger == nil {
+		s.Logger = Logger
+	}
+	if s.Clock == nil {
+		s.Clock = utils.Clock
+	}
+
+	return s, nil
+}
+
+// Archive upload segment files one by one
+func (s *S3ArchiveSink) Archive(ctx context.Context, seg *ArchiveSegment) (err error) {
+	for _, fpath := range seg.Files {
+		if err = s.upload(ctx, fpath); err != nil {
+			return errors.Wrapf(err, "upload `%s`", fpath)
+		}
+	}
+
+	return nil
+}
+
+func (s *S3ArchiveSink) upload(ctx context.Context, fpath string) (err error) {
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	md5Hasher, sha256Hasher := md5.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(md5Hasher, sha256Hasher), fp)
+	if err != nil {
+		return errors.Wrap(err, "hash file")
+	}
+	if _, err = fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	md5Sum := md5Hasher.Sum(nil)
+
+	u := *s.endpoint
+	u.Path = path.Join("/", s.endpoint.Path, s.Bucket, s.Prefix+filepath.Base(fpath))
+	req, err := http.NewRequest(http.MethodPut, u.String(), fp)
+	if err != nil {
+		return errors.Wrap(err, "new request")
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5Sum))
+	signS3V4(req, hex.EncodeToString(sha256Hasher.Sum(nil)),
+		s.AccessKey, s.SecretKey, s.Region, s.Clock.GetUTCNow())
+
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "put object")
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("put object got [%d]: %s", resp.StatusCode, body)
+	}
+
+	s.Logger.Debug("upload file to s3", zap.String("file", fpath), zap.String("url", u.String()))
+	return nil
+}
+
+// signS3V4 sign request by AWS signature version 4,
+// all headers in request and host are signed.
+func signS3V4(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format(s3TimeLayout)
+	scope := strings.Join([]string{now.UTC().Format(s3DateLayout), region, "s3", "aws4_request"}, "/")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// canonical headers
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// canonical query
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		vs := query[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			pairs = append(pairs, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	} else if p, err := url.PathUnescape(canonicalURI); err == nil {
+		canonicalURI = s3URIEncode(p, false)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		strings.Join(pairs, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	reqHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(reqHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + secretKey)
+	for _, v := range []string{now.UTC().Format(s3DateLayout), region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3URIEncode encode string as AWS required,
+// only unreserved characters are kept, `/` is kept if not `isEncodeSlash`.
+func s3URIEncode(s string, isEncodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !isEncodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
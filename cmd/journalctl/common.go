@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	journal "github.com/Laisky/go-journal"
+)
+
+// segmentInfo statistics of segment on disk
+type segmentInfo struct {
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	DataFile    string `json:"data_file,omitempty"`
+	IdsFile     string `json:"ids_file,omitempty"`
+	DataBytes   int64  `json:"data_bytes"`
+	IdsBytes    int64  `json:"ids_bytes"`
+	Records     int64  `json:"records"`
+	MinID       int64  `json:"min_id"`
+	MaxID       int64  `json:"max_id"`
+	Committed   int64  `json:"committed"`
+	Uncommitted int64  `json:"uncommitted"`
+	Err         string `json:"error,omitempty"`
+}
+
+func baseName(fpath string) string {
+	if fpath == "" {
+		return ""
+	}
+
+	return filepath.Base(fpath)
+}
+
+func isGz(fpath string) bool {
+	return filepath.Ext(fpath) == ".gz"
+}
+
+func fileSize(fpath string) int64 {
+	if fpath == "" {
+		return 0
+	}
+
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return 0
+	}
+
+	return fi.Size()
+}
+
+// segmentStates load segments' state from manifest of segments named with `prefix`
+func segmentStates(dir, prefix string) map[string]string {
+	states := map[string]string{}
+	m, err := journal.LoadManifest(dir, journal.WithComponentSegmentNaming(&journal.SegmentNaming{Prefix: prefix}))
+	if err != nil {
+		return states
+	}
+
+	for _, seg := range m.GetSegments() {
+		states[seg.Name] = string(seg.State)
+	}
+
+	return states
+}
+
+// isPrefixed check whether segment is named with `prefix`
+func isPrefixed(name, prefix string) bool {
+	info, err := journal.ParseSegmentName(name)
+	return err == nil && info.Prefix == prefix
+}
+
+// inspectDir decode all segments in directory,
+// only segments named with `prefix` are inspected if `prefix` is not empty.
+func inspectDir(dir, prefix string) (infos []*segmentInfo, err error) {
+	allSegs, err := journal.ScanSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []*journal.SegmentFiles
+	for _, seg := range allSegs {
+		if prefix == "" || isPrefixed(seg.Name, prefix) {
+			segs = append(segs, seg)
+		}
+	}
+
+	// commits of data may be written into any later ids file
+	committed := map[int64]struct{}{}
+	var idsErrs = map[string]error{}
+	for _, seg := range segs {
+		if seg.IdsFile == "" {
+			continue
+		}
+
+		if err = journal.ForEachIDInFile(seg.IdsFile, func(id int64) error {
+			committed[id] = struct{}{}
+			return nil
+		}); err != nil {
+			idsErrs[seg.Name] = err
+		}
+	}
+
+	states := segmentStates(dir, prefix)
+	for _, seg := range segs {
+		info := &segmentInfo{
+			Name:      seg.Name,
+			State:     "-",
+			DataFile:  baseName(seg.DataFile),
+			IdsFile:   baseName(seg.IdsFile),
+			DataBytes: fileSize(seg.DataFile),
+			IdsBytes:  fileSize(seg.IdsFile),
+		}
+		if state, ok := states[seg.Name]; ok {
+			info.State = state
+		}
+		if err = idsErrs[seg.Name]; err != nil {
+			info.Err = err.Error()
+		}
+
+		if seg.DataFile != "" {
+			if err = journal.ForEachDataInFile(seg.DataFile, func(data *journal.Data) error {
+				if info.Records == 0 || data.ID < info.MinID {
+					info.MinID = data.ID
+				}
+				if info.Records == 0 || data.ID > info.MaxID {
+					info.MaxID = data.ID
+				}
+				info.Records++
+
+				if _, ok := committed[data.ID]; ok {
+					info.Committed++
+				} else {
+					info.Uncommitted++
+				}
+				return nil
+			}); err != nil {
+				info.Err = err.Error()
+			}
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
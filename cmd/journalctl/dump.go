@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	journal "github.com/Laisky/go-journal"
+)
+
+type dumpRecord struct {
+	File      string                 `json:"file"`
+	ID        int64                  `json:"id"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Timestamp *time.Time             `json:"timestamp,omitempty"`
+	Key       string                 `json:"key,omitempty"`
+	Headers   map[string]string      `json:"headers,omitempty"`
+}
+
+// newDataDumpRecord dump record of data file
+func newDataDumpRecord(fpath string, data *journal.Data) *dumpRecord {
+	r := &dumpRecord{
+		File:    fpath,
+		ID:      data.ID,
+		Data:    data.Data,
+		Key:     data.Key,
+		Headers: data.Headers,
+	}
+	if !data.Timestamp.IsZero() {
+		r.Timestamp = &data.Timestamp
+	}
+
+	return r
+}
+
+func runDump(stdout io.Writer, args []string) (err error) {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	if err = fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: journalctl dump FILE...")
+	}
+
+	enc := json.NewEncoder(stdout)
+	for _, fpath := range fs.Args() {
+		switch {
+		case journal.IsDataFile(fpath):
+			err = journal.ForEachDataInFile(fpath, func(data *journal.Data) error {
+				return enc.Encode(newDataDumpRecord(fpath, data))
+			})
+		case journal.IsIdsFile(fpath):
+			err = journal.ForEachIDInFile(fpath, func(id int64) error {
+				return enc.Encode(&dumpRecord{File: fpath, ID: id})
+			})
+		default:
+			err = fmt.Errorf("unknown file type `%s`", fpath)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
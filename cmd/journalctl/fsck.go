@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	journal "github.com/Laisky/go-journal"
+)
+
+func runFsck(stdout io.Writer, args []string) (err error) {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	isRepair := fs.Bool("repair", false, "truncate broken files and move broken parts into quarantine directory")
+	isJSON := fs.Bool("json", false, "output report in json")
+	if err = fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: journalctl fsck [-repair] [-json] DIR")
+	}
+
+	report, err := journal.Verify(fs.Arg(0), journal.WithVerifyRepair(*isRepair))
+	if err != nil {
+		return err
+	}
+
+	if *isJSON {
+		if err = json.NewEncoder(stdout).Encode(report); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "segments: %d, records: %d, ids: %d, issues: %d\n",
+			report.Segments, report.Records, report.Ids, len(report.Issues))
+		if len(report.Issues) != 0 {
+			fmt.Fprintln(w, "TYPE\tFILE\tOFFSET\tREPAIRED\tMESSAGE")
+		}
+		for _, issue := range report.Issues {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%v\t%s\n",
+				issue.Type, issue.File, issue.Offset, issue.Repaired, issue.Message)
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if !report.OK() {
+		return fmt.Errorf("found unrepaired issues in `%s`", fs.Arg(0))
+	}
+	return nil
+}
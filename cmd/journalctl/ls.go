@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+func runLs(stdout io.Writer, args []string) (err error) {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	isJSON := fs.Bool("json", false, "output in json lines")
+	prefix := fs.String("prefix", "", "only list segments named with prefix, and load their manifest")
+	if err = fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: journalctl ls [-json] [-prefix PREFIX] DIR")
+	}
+
+	infos, err := inspectDir(fs.Arg(0), *prefix)
+	if err != nil {
+		return err
+	}
+
+	if *isJSON {
+		enc := json.NewEncoder(stdout)
+		for _, info := range infos {
+			if err = enc.Encode(info); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEGMENT\tSTATE\tDATA_BYTES\tIDS_BYTES\tRECORDS\tMIN_ID\tMAX_ID\tCOMMITTED\tUNCOMMITTED\tERROR")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			info.Name, info.State,
+			info.DataBytes, info.IdsBytes,
+			info.Records, info.MinID, info.MaxID,
+			info.Committed, info.Uncommitted,
+			info.Err)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,69 @@
+// journalctl inspect journal buf directory.
+//
+//	journalctl ls   [-json] [-prefix PREFIX] DIR
+//	journalctl dump FILE...
+//	journalctl stat [-prefix PREFIX] DIR
+//	journalctl tail [-n 10] [-f] [-interval 1s] DIR
+//	journalctl fsck [-repair] [-json] DIR
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	journal "github.com/Laisky/go-journal"
+)
+
+type command struct {
+	name, usage string
+	run         func(stdout io.Writer, args []string) error
+}
+
+var commands = []*command{
+	{name: "ls", usage: "list segments, sizes, ids range and committed/uncommitted records", run: runLs},
+	{name: "dump", usage: "decode data & ids files into json lines", run: runDump},
+	{name: "stat", usage: "summary of buf directory", run: runStat},
+	{name: "tail", usage: "print latest records of active segment", run: runTail},
+	{name: "fsck", usage: "verify every record, optionally repair broken files", run: runFsck},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: journalctl <command> [arguments]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s%s\n", cmd.name, cmd.usage)
+	}
+}
+
+func main() {
+	if err := journal.Logger.ChangeLevel("error"); err != nil {
+		fmt.Fprintf(os.Stderr, "set log level: %+v\n", err)
+	}
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != os.Args[1] {
+			continue
+		}
+
+		if err := cmd.run(os.Stdout, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %+v\n", cmd.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	switch os.Args[1] {
+	case "help", "-h", "--help":
+		usage()
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command `%s`\n\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
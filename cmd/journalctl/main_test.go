@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	journal "github.com/Laisky/go-journal"
+)
+
+// prepareJournalDir create buf directory contains 2 sealed segments and 1 active segment
+func prepareJournalDir(t *testing.T, opts ...journal.OptionFunc) string {
+	if err := journal.Logger.ChangeLevel("error"); err != nil {
+		t.Fatalf("set level: %+v", err)
+	}
+	dir, err := ioutil.TempDir("", "journalctl-test")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := journal.NewJournal(append([]journal.OptionFunc{journal.WithBufDirPath(dir)}, opts...)...)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Start(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer j.Close(ctx)
+
+	for id := int64(1); id <= 10; id++ {
+		if err = j.WriteData(&journal.Data{ID: id, Data: map[string]interface{}{"id": id}}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if id%2 == 0 {
+			if err = j.WriteId(id); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		if id == 5 || id == 8 {
+			if err = j.Rotate(ctx); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+	}
+	if err = j.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	return dir
+}
+
+func TestLs(t *testing.T) {
+	dir := prepareJournalDir(t)
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	if err := runLs(buf, []string{"-json", dir}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("got:\n%s", buf.String())
+
+	var (
+		infos []*segmentInfo
+		dec   = json.NewDecoder(buf)
+	)
+	for dec.More() {
+		info := new(segmentInfo)
+		if err := dec.Decode(info); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		infos = append(infos, info)
+	}
+
+	if len(infos) != 3 {
+		t.Fatalf("expect 3 segments, got %d", len(infos))
+	}
+	if infos[0].Records != 5 || infos[0].MinID != 1 || infos[0].MaxID != 5 ||
+		infos[0].Committed != 2 || infos[0].Uncommitted != 3 {
+		t.Fatalf("got wrong segment info: %+v", infos[0])
+	}
+	if infos[2].State != string(journal.SegmentActive) || infos[2].Records != 2 {
+		t.Fatalf("got wrong active segment info: %+v", infos[2])
+	}
+}
+
+func TestLsWithPrefix(t *testing.T) {
+	dir := prepareJournalDir(t, journal.WithSegmentNaming(journal.SegmentNaming{Prefix: "a"}))
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	if err := runLs(buf, []string{"-json", "-prefix", "a", dir}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("got:\n%s", buf.String())
+
+	var (
+		infos []*segmentInfo
+		dec   = json.NewDecoder(buf)
+	)
+	for dec.More() {
+		info := new(segmentInfo)
+		if err := dec.Decode(info); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		infos = append(infos, info)
+	}
+	if len(infos) != 3 {
+		t.Fatalf("expect 3 segments, got %d", len(infos))
+	}
+	if infos[0].State == "-" || infos[2].State != string(journal.SegmentActive) {
+		t.Fatalf("should load state from manifest of prefix, got %+v & %+v", infos[0], infos[2])
+	}
+
+	buf.Reset()
+	if err := runStat(buf, []string{"-prefix", "b", dir}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got := strings.Join(strings.Fields(buf.String()), " "); !strings.Contains(got, "segments: 0") {
+		t.Fatalf("should only count segments of prefix, got %s", got)
+	}
+	buf.Reset()
+	if err := runStat(buf, []string{"-prefix", "a", dir}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got := strings.Join(strings.Fields(buf.String()), " "); !strings.Contains(got, "state active: 1") {
+		t.Fatalf("should load state from manifest of prefix, got %s", got)
+	}
+}
+
+func TestStat(t *testing.T) {
+	dir := prepareJournalDir(t)
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	if err := runStat(buf, []string{dir}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("got:\n%s", buf.String())
+	got := strings.Join(strings.Fields(buf.String()), " ")
+	for _, expect := range []string{"segments: 3", "records: 10", "committed: 5", "id range: [1, 10]", "state active: 1"} {
+		if !strings.Contains(got, expect) {
+			t.Errorf("should contains `%s`", expect)
+		}
+	}
+}
+
+func TestDumpAndTail(t *testing.T) {
+	dir := prepareJournalDir(t)
+	defer os.RemoveAll(dir)
+
+	segs, err := journal.ScanSegments(dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err = runDump(buf, []string{segs[0].DataFile, segs[0].IdsFile}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("got:\n%s", buf.String())
+	if lines := strings.Count(buf.String(), "\n"); lines != 7 {
+		t.Fatalf("expect 5 records and 2 ids, got %d lines", lines)
+	}
+	if err = runDump(buf, []string{filepath.Join(dir, "MANIFEST")}); err == nil {
+		t.Fatal("should not dump unknown file")
+	}
+
+	buf.Reset()
+	if err = runTail(buf, []string{"-n", "1", dir}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("got:\n%s", buf.String())
+	r := new(dumpRecord)
+	if err = json.Unmarshal(buf.Bytes(), r); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if r.ID != 10 {
+		t.Fatalf("expect latest record 10, got %+v", r)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	dir := prepareJournalDir(t)
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	if err := runFsck(buf, []string{dir}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("got:\n%s", buf.String())
+
+	segs, err := journal.ScanSegments(dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	fp, err := os.OpenFile(segs[0].DataFile, os.O_APPEND|os.O_WRONLY, journal.FileMode)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = fp.Write([]byte{0xc1}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	fp.Close()
+
+	buf.Reset()
+	if err = runFsck(buf, []string{dir}); err == nil {
+		t.Fatal("should found broken record")
+	}
+	buf.Reset()
+	if err = runFsck(buf, []string{"-repair", dir}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("got:\n%s", buf.String())
+}
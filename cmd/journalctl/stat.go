@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+func runStat(stdout io.Writer, args []string) (err error) {
+	fs := flag.NewFlagSet("stat", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only count segments named with prefix, and load their manifest")
+	if err = fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: journalctl stat [-prefix PREFIX] DIR")
+	}
+
+	dir := fs.Arg(0)
+	infos, err := inspectDir(dir, *prefix)
+	if err != nil {
+		return err
+	}
+
+	var (
+		dataBytes, idsBytes, records, committed, uncommitted int64
+		broken                                               int
+		minID, maxID                                         int64
+		states                                               = map[string]int{}
+	)
+	for _, info := range infos {
+		dataBytes += info.DataBytes
+		idsBytes += info.IdsBytes
+		committed += info.Committed
+		uncommitted += info.Uncommitted
+		states[info.State]++
+		if info.Err != "" {
+			broken++
+		}
+		if info.Records != 0 {
+			if records == 0 || info.MinID < minID {
+				minID = info.MinID
+			}
+			if records == 0 || info.MaxID > maxID {
+				maxID = info.MaxID
+			}
+		}
+		records += info.Records
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "directory:\t%s\n", dir)
+	fmt.Fprintf(w, "segments:\t%d\n", len(infos))
+	fmt.Fprintf(w, "broken segments:\t%d\n", broken)
+	fmt.Fprintf(w, "data bytes:\t%d\n", dataBytes)
+	fmt.Fprintf(w, "ids bytes:\t%d\n", idsBytes)
+	fmt.Fprintf(w, "records:\t%d\n", records)
+	fmt.Fprintf(w, "id range:\t[%d, %d]\n", minID, maxID)
+	fmt.Fprintf(w, "committed:\t%d\n", committed)
+	fmt.Fprintf(w, "uncommitted:\t%d\n", uncommitted)
+
+	var names []string
+	for state := range states {
+		names = append(names, state)
+	}
+	sort.Strings(names)
+	for _, state := range names {
+		fmt.Fprintf(w, "state %s:\t%d\n", state, states[state])
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	journal "github.com/Laisky/go-journal"
+	"github.com/pkg/errors"
+)
+
+func runTail(stdout io.Writer, args []string) (err error) {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	n := fs.Int("n", 10, "number of latest records to print")
+	follow := fs.Bool("f", false, "keep printing new records, only support uncompressed segments")
+	interval := fs.Duration("interval", time.Second, "interval to check new records")
+	if err = fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: journalctl tail [-n 10] [-f] [-interval 1s] DIR")
+	}
+
+	dir := fs.Arg(0)
+	fpath, err := latestDataFile(dir)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(stdout)
+	var latest []*journal.Data
+	keepLatest := func(data *journal.Data) error {
+		latest = append(latest, data)
+		if len(latest) > *n {
+			latest = latest[1:]
+		}
+		return nil
+	}
+
+	if isGz(fpath) {
+		if *follow {
+			return fmt.Errorf("cannot follow compressed segment `%s`", fpath)
+		}
+		if err = journal.ForEachDataInFile(fpath, keepLatest); err != nil {
+			return err
+		}
+		return printRecords(enc, fpath, latest)
+	}
+
+	offset, err := readRecordsFrom(fpath, 0, keepLatest)
+	if err != nil {
+		return err
+	}
+	if err = printRecords(enc, fpath, latest); err != nil {
+		return err
+	}
+
+	for *follow {
+		time.Sleep(*interval)
+		printNew := func(data *journal.Data) error {
+			return enc.Encode(newDataDumpRecord(fpath, data))
+		}
+		if offset, err = readRecordsFrom(fpath, offset, printNew); err != nil {
+			return err
+		}
+
+		// switch to new segment after rotated
+		newFpath, err := latestDataFile(dir)
+		if err != nil {
+			return err
+		}
+		if newFpath != fpath {
+			if _, err = readRecordsFrom(fpath, offset, printNew); err != nil {
+				return err
+			}
+			fpath, offset = newFpath, 0
+		}
+	}
+
+	return nil
+}
+
+func printRecords(enc *json.Encoder, fpath string, records []*journal.Data) (err error) {
+	for _, data := range records {
+		if err = enc.Encode(newDataDumpRecord(fpath, data)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// latestDataFile return data file of the latest segment
+func latestDataFile(dir string) (string, error) {
+	segs, err := journal.ScanSegments(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for i := len(segs) - 1; i >= 0; i-- {
+		if segs[i].DataFile != "" {
+			return segs[i].DataFile, nil
+		}
+	}
+
+	return "", fmt.Errorf("no data file in `%s`", dir)
+}
+
+// readRecordsFrom decode complete records in uncompressed data file from offset,
+// return offset after the last complete record.
+func readRecordsFrom(fpath string, offset int64, handler func(*journal.Data) error) (int64, error) {
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return offset, errors.Wrapf(err, "open file `%s`", fpath)
+	}
+	defer fp.Close()
+
+	if _, err = fp.Seek(offset, io.SeekStart); err != nil {
+		return offset, errors.Wrapf(err, "seek file `%s`", fpath)
+	}
+	buf, err := ioutil.ReadAll(fp)
+	if err != nil {
+		return offset, errors.Wrapf(err, "read file `%s`", fpath)
+	}
+
+	var rest []byte
+	for len(buf) != 0 {
+		data := new(journal.Data)
+		if rest, err = data.UnmarshalMsg(buf); err != nil {
+			// incomplete record, wait for more bytes
+			break
+		}
+
+		offset += int64(len(buf) - len(rest))
+		buf = rest
+		if err = handler(data); err != nil {
+			return offset, err
+		}
+	}
+
+	return offset, nil
+}
@@ -1,9 +1,29 @@
 package journal
 
+import "time"
+
 //go:generate msgp
 
-// Data msgp data schema
+// Data msgp data schema.
+//
+// `Timestamp`, `Key` & `Headers` are omitted if empty,
+// records written by older versions are decoded with them empty.
 type Data struct {
 	Data map[string]interface{}
 	ID   int64
+	// Timestamp write time of record, set by journal if zero
+	Timestamp time.Time `msg:",omitempty"`
+	// Key optional key of record, like routing key
+	Key string `msg:",omitempty"`
+	// Headers user metadata, not mixed with payload
+	Headers map[string]string `msg:",omitempty"`
+}
+
+// resetOmitted clear fields omitted if empty,
+// generated decoders keep old values of absent fields,
+// so `Data` reused to decode records should be reset before decoding.
+func (d *Data) resetOmitted() {
+	d.Timestamp = time.Time{}
+	d.Key = ""
+	d.Headers = nil
 }
@@ -3,6 +3,8 @@ package journal
 // Code generated by github.com/tinylib/msgp DO NOT EDIT.
 
 import (
+	"time"
+
 	"github.com/tinylib/msgp/msgp"
 )
 
@@ -60,6 +62,48 @@ func (z *Data) DecodeMsg(dc *msgp.Reader) (err error) {
 				err = msgp.WrapError(err, "ID")
 				return
 			}
+		case "Timestamp":
+			z.Timestamp, err = dc.ReadTime()
+			if err != nil {
+				err = msgp.WrapError(err, "Timestamp")
+				return
+			}
+		case "Key":
+			z.Key, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Key")
+				return
+			}
+		case "Headers":
+			var zb0003 uint32
+			zb0003, err = dc.ReadMapHeader()
+			if err != nil {
+				err = msgp.WrapError(err, "Headers")
+				return
+			}
+			if z.Headers == nil {
+				z.Headers = make(map[string]string, zb0003)
+			} else if len(z.Headers) > 0 {
+				for key := range z.Headers {
+					delete(z.Headers, key)
+				}
+			}
+			for zb0003 > 0 {
+				zb0003--
+				var za0003 string
+				var za0004 string
+				za0003, err = dc.ReadString()
+				if err != nil {
+					err = msgp.WrapError(err, "Headers")
+					return
+				}
+				za0004, err = dc.ReadString()
+				if err != nil {
+					err = msgp.WrapError(err, "Headers", za0003)
+					return
+				}
+				z.Headers[za0003] = za0004
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -73,9 +117,31 @@ func (z *Data) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *Data) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 2
+	// omitempty: check for empty values
+	zb0001Len := uint32(5)
+	var zb0001Mask uint8 /* 5 bits */
+	if z.Timestamp == (time.Time{}) {
+		zb0001Len--
+		zb0001Mask |= 0x4
+	}
+	if z.Key == "" {
+		zb0001Len--
+		zb0001Mask |= 0x8
+	}
+	if z.Headers == nil {
+		zb0001Len--
+		zb0001Mask |= 0x10
+	}
+	// variable map header, size zb0001Len
+	err = en.Append(0x80 | uint8(zb0001Len))
+	if err != nil {
+		return
+	}
+	if zb0001Len == 0 {
+		return
+	}
 	// write "Data"
-	err = en.Append(0x82, 0xa4, 0x44, 0x61, 0x74, 0x61)
+	err = en.Append(0xa4, 0x44, 0x61, 0x74, 0x61)
 	if err != nil {
 		return
 	}
@@ -106,15 +172,82 @@ func (z *Data) EncodeMsg(en *msgp.Writer) (err error) {
 		err = msgp.WrapError(err, "ID")
 		return
 	}
+	if (zb0001Mask & 0x4) == 0 { // if not empty
+		// write "Timestamp"
+		err = en.Append(0xa9, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70)
+		if err != nil {
+			return
+		}
+		err = en.WriteTime(z.Timestamp)
+		if err != nil {
+			err = msgp.WrapError(err, "Timestamp")
+			return
+		}
+	}
+	if (zb0001Mask & 0x8) == 0 { // if not empty
+		// write "Key"
+		err = en.Append(0xa3, 0x4b, 0x65, 0x79)
+		if err != nil {
+			return
+		}
+		err = en.WriteString(z.Key)
+		if err != nil {
+			err = msgp.WrapError(err, "Key")
+			return
+		}
+	}
+	if (zb0001Mask & 0x10) == 0 { // if not empty
+		// write "Headers"
+		err = en.Append(0xa7, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73)
+		if err != nil {
+			return
+		}
+		err = en.WriteMapHeader(uint32(len(z.Headers)))
+		if err != nil {
+			err = msgp.WrapError(err, "Headers")
+			return
+		}
+		for za0003, za0004 := range z.Headers {
+			err = en.WriteString(za0003)
+			if err != nil {
+				err = msgp.WrapError(err, "Headers")
+				return
+			}
+			err = en.WriteString(za0004)
+			if err != nil {
+				err = msgp.WrapError(err, "Headers", za0003)
+				return
+			}
+		}
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z *Data) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 2
+	// omitempty: check for empty values
+	zb0001Len := uint32(5)
+	var zb0001Mask uint8 /* 5 bits */
+	if z.Timestamp == (time.Time{}) {
+		zb0001Len--
+		zb0001Mask |= 0x4
+	}
+	if z.Key == "" {
+		zb0001Len--
+		zb0001Mask |= 0x8
+	}
+	if z.Headers == nil {
+		zb0001Len--
+		zb0001Mask |= 0x10
+	}
+	// variable map header, size zb0001Len
+	o = append(o, 0x80|uint8(zb0001Len))
+	if zb0001Len == 0 {
+		return
+	}
 	// string "Data"
-	o = append(o, 0x82, 0xa4, 0x44, 0x61, 0x74, 0x61)
+	o = append(o, 0xa4, 0x44, 0x61, 0x74, 0x61)
 	o = msgp.AppendMapHeader(o, uint32(len(z.Data)))
 	for za0001, za0002 := range z.Data {
 		o = msgp.AppendString(o, za0001)
@@ -127,6 +260,25 @@ func (z *Data) MarshalMsg(b []byte) (o []byte, err error) {
 	// string "ID"
 	o = append(o, 0xa2, 0x49, 0x44)
 	o = msgp.AppendInt64(o, z.ID)
+	if (zb0001Mask & 0x4) == 0 { // if not empty
+		// string "Timestamp"
+		o = append(o, 0xa9, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70)
+		o = msgp.AppendTime(o, z.Timestamp)
+	}
+	if (zb0001Mask & 0x8) == 0 { // if not empty
+		// string "Key"
+		o = append(o, 0xa3, 0x4b, 0x65, 0x79)
+		o = msgp.AppendString(o, z.Key)
+	}
+	if (zb0001Mask & 0x10) == 0 { // if not empty
+		// string "Headers"
+		o = append(o, 0xa7, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73)
+		o = msgp.AppendMapHeader(o, uint32(len(z.Headers)))
+		for za0003, za0004 := range z.Headers {
+			o = msgp.AppendString(o, za0003)
+			o = msgp.AppendString(o, za0004)
+		}
+	}
 	return
 }
 
@@ -184,6 +336,48 @@ func (z *Data) UnmarshalMsg(bts []byte) (o []byte, err error) {
 				err = msgp.WrapError(err, "ID")
 				return
 			}
+		case "Timestamp":
+			z.Timestamp, bts, err = msgp.ReadTimeBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Timestamp")
+				return
+			}
+		case "Key":
+			z.Key, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Key")
+				return
+			}
+		case "Headers":
+			var zb0003 uint32
+			zb0003, bts, err = msgp.ReadMapHeaderBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Headers")
+				return
+			}
+			if z.Headers == nil {
+				z.Headers = make(map[string]string, zb0003)
+			} else if len(z.Headers) > 0 {
+				for key := range z.Headers {
+					delete(z.Headers, key)
+				}
+			}
+			for zb0003 > 0 {
+				var za0003 string
+				var za0004 string
+				zb0003--
+				za0003, bts, err = msgp.ReadStringBytes(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "Headers")
+					return
+				}
+				za0004, bts, err = msgp.ReadStringBytes(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "Headers", za0003)
+					return
+				}
+				z.Headers[za0003] = za0004
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -205,6 +399,12 @@ func (z *Data) Msgsize() (s int) {
 			s += msgp.StringPrefixSize + len(za0001) + msgp.GuessSize(za0002)
 		}
 	}
-	s += 3 + msgp.Int64Size
+	s += 3 + msgp.Int64Size + 10 + msgp.TimeSize + 4 + msgp.StringPrefixSize + len(z.Key) + 8 + msgp.MapHeaderSize
+	if z.Headers != nil {
+		for za0003, za0004 := range z.Headers {
+			_ = za0004
+			s += msgp.StringPrefixSize + len(za0003) + msgp.StringPrefixSize + len(za0004)
+		}
+	}
 	return
 }
@@ -0,0 +1,114 @@
+package journal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestDataCompatible(t *testing.T) {
+	// record written by older versions
+	old := msgp.AppendMapHeader(nil, 2)
+	old = msgp.AppendString(old, "Data")
+	old = msgp.AppendMapHeader(old, 1)
+	old = msgp.AppendString(old, "tag")
+	old = msgp.AppendString(old, "app")
+	old = msgp.AppendString(old, "ID")
+	old = msgp.AppendInt64(old, 7)
+
+	data := new(Data)
+	if _, err := data.UnmarshalMsg(old); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if data.ID != 7 || data.Data["tag"] != "app" ||
+		!data.Timestamp.IsZero() || data.Key != "" || data.Headers != nil {
+		t.Fatalf("got wrong record %+v", data)
+	}
+
+	// empty fields are omitted
+	cnt, err := data.MarshalMsg(nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(cnt, old) {
+		t.Fatalf("record without envelope should be encoded as before")
+	}
+
+	data.Timestamp = time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	data.Key = "key"
+	data.Headers = map[string]string{"reason": "test"}
+	buf := &bytes.Buffer{}
+	if err = msgp.Encode(buf, data); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	got := new(Data)
+	if err = msgp.Decode(buf, got); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got.ID != 7 || !got.Timestamp.Equal(data.Timestamp) ||
+		got.Key != "key" || got.Headers["reason"] != "test" {
+		t.Fatalf("got wrong record %+v", got)
+	}
+}
+
+func TestDataDecodeReuse(t *testing.T) {
+	records := []*Data{
+		{
+			ID:        1,
+			Timestamp: time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC),
+			Key:       "k1",
+			Headers:   map[string]string{"a": "b"},
+		},
+		// timestamp is set by encoder if zero
+		{ID: 2, Timestamp: time.Date(2020, 1, 3, 10, 0, 0, 0, time.UTC)},
+	}
+	fp, err := ioutil.TempFile("", "journal-test-data")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+	enc, err := NewDataEncoder(fp, false)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, r := range records {
+		if err = enc.Write(r); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err = enc.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for name, newDecoder := range map[string]func() (*DataDecoder, error){
+		"stream": func() (*DataDecoder, error) { return NewDataDecoder(fp, false) },
+		"mmap":   func() (*DataDecoder, error) { return NewMmapDataDecoder(fp) },
+	} {
+		if _, err = fp.Seek(0, io.SeekStart); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		dec, err := newDecoder()
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		// decoders reuse one record, like `LegacyLoader.Load`
+		data := new(Data)
+		for _, expect := range records {
+			if err = dec.Read(data); err != nil {
+				t.Fatalf("%s: %+v", name, err)
+			}
+			if data.ID != expect.ID || !data.Timestamp.Equal(expect.Timestamp) ||
+				data.Key != expect.Key || len(data.Headers) != len(expect.Headers) {
+				t.Fatalf("%s: expect %+v, got %+v", name, expect, data)
+			}
+		}
+		dec.Close()
+	}
+}
@@ -0,0 +1,500 @@
+package journal
+
+// deadletter.go
+// move records that repeatedly fail processing into dead-letter journal.
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	// deadLetterDirName sub directory of buf directory to save dead letters
+	deadLetterDirName      = "deadletter"
+	deadLetterNameSuffix   = "-deadletter"
+	deadLetterHeaderPrefix = "x-dead-letter-"
+	// replayAttemptsFileName file in dead-letter directory to save failed attempts of records
+	replayAttemptsFileName = "replay.attempts"
+)
+
+// headers attached to records in dead-letter journal
+const (
+	// HeaderDeadLetterReason error of the last attempt
+	HeaderDeadLetterReason = deadLetterHeaderPrefix + "reason"
+	// HeaderDeadLetterAttempts number of attempts before moved into dead letters
+	HeaderDeadLetterAttempts = deadLetterHeaderPrefix + "attempts"
+	// HeaderDeadLetterSegment segment the record replayed from
+	HeaderDeadLetterSegment = deadLetterHeaderPrefix + "segment"
+	// HeaderDeadLetterOriginID id of the original record
+	HeaderDeadLetterOriginID = deadLetterHeaderPrefix + "origin-id"
+	// HeaderDeadLetterOriginTimestamp write time of the original record, in RFC3339Nano
+	HeaderDeadLetterOriginTimestamp = deadLetterHeaderPrefix + "origin-timestamp"
+)
+
+// DeadLetter record moved into dead-letter journal after all attempts failed
+type DeadLetter struct {
+	// ID id in dead-letter journal, used by `ReinjectDeadLetters`
+	ID int64 `json:"id"`
+	// Data original record, without dead letter headers
+	Data     *Data  `json:"data"`
+	Reason   string `json:"reason"`
+	Attempts int    `json:"attempts"`
+	Segment  string `json:"segment"`
+	// FailedAt when the record moved into dead letters
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// newDeadLetterData wrap failed record to write into dead-letter journal with id `id`
+func newDeadLetterData(id int64, rec *replayRecord, attempts int, cause error) *Data {
+	headers := make(map[string]string, len(rec.data.Headers)+5)
+	for k, v := range rec.data.Headers {
+		headers[k] = v
+	}
+	headers[HeaderDeadLetterReason] = cause.Error()
+	headers[HeaderDeadLetterAttempts] = strconv.Itoa(attempts)
+	headers[HeaderDeadLetterSegment] = rec.segment
+	headers[HeaderDeadLetterOriginID] = strconv.FormatInt(rec.data.ID, 10)
+	if !rec.data.Timestamp.IsZero() {
+		headers[HeaderDeadLetterOriginTimestamp] = rec.data.Timestamp.Format(time.RFC3339Nano)
+	}
+
+	return &Data{
+		ID:      id,
+		Data:    rec.data.Data,
+		Key:     rec.data.Key,
+		Headers: headers,
+	}
+}
+
+// parseDeadLetter restore dead letter from record in dead-letter journal
+func parseDeadLetter(data *Data) (dl *DeadLetter, err error) {
+	dl = &DeadLetter{
+		ID:       data.ID,
+		Reason:   data.Headers[HeaderDeadLetterReason],
+		Segment:  data.Headers[HeaderDeadLetterSegment],
+		FailedAt: data.Timestamp,
+		Data: &Data{
+			Data: data.Data,
+			Key:  data.Key,
+		},
+	}
+	if dl.Data.ID, err = strconv.ParseInt(data.Headers[HeaderDeadLetterOriginID], 10, 64); err != nil {
+		return nil, errors.Wrapf(err, "parse origin id of dead letter %d", data.ID)
+	}
+	if dl.Attempts, err = strconv.Atoi(data.Headers[HeaderDeadLetterAttempts]); err != nil {
+		return nil, errors.Wrapf(err, "parse attempts of dead letter %d", data.ID)
+	}
+	if ts, ok := data.Headers[HeaderDeadLetterOriginTimestamp]; ok {
+		if dl.Data.Timestamp, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+			return nil, errors.Wrapf(err, "parse origin timestamp of dead letter %d", data.ID)
+		}
+	}
+	for k, v := range data.Headers {
+		if strings.HasPrefix(k, deadLetterHeaderPrefix) {
+			continue
+		}
+		if dl.Data.Headers == nil {
+			dl.Data.Headers = map[string]string{}
+		}
+		dl.Data.Headers[k] = v
+	}
+
+	return dl, nil
+}
+
+// replayAttempt failed attempts of record
+type replayAttempt struct {
+	Attempts int `json:"attempts"`
+	// IsDeadLetter already moved into dead letters
+	IsDeadLetter bool `json:"is_dead_letter,omitempty"`
+}
+
+// replayAttempts failed attempts of records in segments not consumed yet,
+// persisted in dead-letter directory, so attempts are accumulated across replays,
+// and records already moved into dead letters are not moved again.
+//
+// nil replayAttempts is valid, and records nothing.
+type replayAttempts struct {
+	sync.Mutex
+	fpath string
+	// records attempts by `<segment>/<id>`
+	records map[string]*replayAttempt
+}
+
+// loadReplayAttempts load attempts saved in `fpath`, empty if not exists
+func loadReplayAttempts(fpath string) (a *replayAttempts, err error) {
+	a = &replayAttempts{
+		fpath:   fpath,
+		records: map[string]*replayAttempt{},
+	}
+	cnt, err := ioutil.ReadFile(fpath)
+	if os.IsNotExist(err) {
+		return a, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "read file `%s`", fpath)
+	}
+
+	if err = json.Unmarshal(cnt, &a.records); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal replay attempts `%s`", fpath)
+	}
+	return a, nil
+}
+
+func replayAttemptKey(rec *replayRecord) string {
+	return rec.segment + "/" + strconv.FormatInt(rec.data.ID, 10)
+}
+
+// get return attempts of record
+func (a *replayAttempts) get(rec *replayRecord) replayAttempt {
+	if a == nil {
+		return replayAttempt{}
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if att, ok := a.records[replayAttemptKey(rec)]; ok {
+		return *att
+	}
+	return replayAttempt{}
+}
+
+// fail record failed attempts of record, saved by `flush` at the end of replay,
+// so replaying segments full of failures does not rewrite attempts file for each failure.
+func (a *replayAttempts) fail(rec *replayRecord, attempts int) {
+	if a == nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	a.records[replayAttemptKey(rec)] = &replayAttempt{Attempts: attempts}
+}
+
+// deadLetter mark record moved into dead letters,
+// saved by `flush` after dead letters persisted.
+func (a *replayAttempts) deadLetter(rec *replayRecord, attempts int) {
+	if a == nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	a.records[replayAttemptKey(rec)] = &replayAttempt{Attempts: attempts, IsDeadLetter: true}
+}
+
+// done forget record delivered, saved by `flush`
+func (a *replayAttempts) done(rec *replayRecord) {
+	if a == nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	delete(a.records, replayAttemptKey(rec))
+}
+
+// release forget all records in consumed segments
+func (a *replayAttempts) release(segments ...string) error {
+	if a == nil {
+		return nil
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	for _, name := range segments {
+		for key := range a.records {
+			if strings.HasPrefix(key, name+"/") {
+				delete(a.records, key)
+			}
+		}
+	}
+	return a.save()
+}
+
+// flush save all attempts
+func (a *replayAttempts) flush() error {
+	if a == nil {
+		return nil
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	return a.save()
+}
+
+func (a *replayAttempts) save() error {
+	cnt, err := json.Marshal(a.records)
+	if err != nil {
+		return errors.Wrap(err, "marshal replay attempts")
+	}
+
+	return writeFileAtomic(a.fpath, cnt)
+}
+
+// startDeadLetters start dead-letter journal in sub directory of buf directory
+func (j *Journal) startDeadLetters(ctx context.Context) (err error) {
+	if j.deadLetterMaxAttempts == 0 {
+		return nil
+	}
+
+	if j.deadLetters, err = NewJournal(
+		WithBufDirPath(filepath.Join(j.bufDirPath, deadLetterDirName)),
+		WithName(j.name+deadLetterNameSuffix),
+		WithLogger(j.logger),
+		WithClock(j.clock),
+		WithFlushInterval(j.flushInterval),
+	); err != nil {
+		return errors.Wrap(err, "new dead-letter journal")
+	}
+
+	return j.deadLetters.Start(ctx)
+}
+
+// getDeadLetters return dead-letter journal, or error if not enabled
+func (j *Journal) getDeadLetters() (*Journal, error) {
+	if j.deadLetterMaxAttempts == 0 {
+		return nil, ErrDeadLetterDisabled
+	}
+	if err := j.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	return j.deadLetters, nil
+}
+
+// ListDeadLetters list dead letters not re-injected yet, in order of writing.
+// writing dead letters is blocked during listing.
+func (j *Journal) ListDeadLetters() (letters []*DeadLetter, err error) {
+	dlq, err := j.getDeadLetters()
+	if err != nil {
+		return nil, err
+	}
+
+	dlq.Lock()
+	defer dlq.Unlock()
+	if err = dlq.Flush(); err != nil {
+		return nil, errors.Wrap(err, "flush dead-letter journal")
+	}
+
+	segs, err := ScanSegments(dlq.bufDirPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "scan segments in `%s`", dlq.bufDirPath)
+	}
+	resolved := map[int64]struct{}{}
+	for _, seg := range segs {
+		if seg.IdsFile == "" {
+			continue
+		}
+		if err = loadIdsFile(seg.IdsFile, resolved); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, seg := range segs {
+		if seg.DataFile == "" {
+			continue
+		}
+
+		if err = ForEachDataInFile(seg.DataFile, func(data *Data) error {
+			if _, ok := resolved[data.ID]; ok {
+				return nil
+			}
+
+			dl, err := parseDeadLetter(data)
+			if err != nil {
+				return errors.Wrapf(err, "load dead letter in `%s`", seg.DataFile)
+			}
+			letters = append(letters, dl)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return letters, nil
+}
+
+// ReinjectDeadLetters write original records of dead letters back into journal,
+// then mark dead letters as resolved, so they could be replayed again.
+// all dead letters are re-injected if `ids` is empty, otherwise only dead letters with these ids.
+//
+// dead letter may be re-injected twice if crashed between writing and resolving,
+// return the number of re-injected dead letters.
+func (j *Journal) ReinjectDeadLetters(ctx context.Context, ids ...int64) (n int, err error) {
+	letters, err := j.ListDeadLetters()
+	if err != nil {
+		return 0, err
+	}
+
+	var selected map[int64]struct{}
+	if len(ids) != 0 {
+		selected = make(map[int64]struct{}, len(ids))
+		for _, id := range ids {
+			selected[id] = struct{}{}
+		}
+	}
+
+	dlq := j.deadLetters
+	for _, dl := range letters {
+		if selected != nil {
+			if _, ok := selected[dl.ID]; !ok {
+				continue
+			}
+		}
+
+		if err = j.WriteDataCtx(ctx, dl.Data); err != nil {
+			return n, errors.Wrapf(err, "re-inject dead letter %d", dl.ID)
+		}
+		if err = dlq.WriteIdCtx(ctx, dl.ID); err != nil {
+			return n, errors.Wrapf(err, "resolve dead letter %d", dl.ID)
+		}
+		n++
+	}
+
+	j.logger.Info("re-inject dead letters", zap.Int("n", n))
+	if err = cleanResolvedDeadLetters(dlq); err != nil {
+		return n, errors.Wrap(err, "clean resolved dead letters")
+	}
+	return n, nil
+}
+
+// cleanResolvedDeadLetters remove sealed segments of dead-letter journal
+// that all dead letters in them are resolved.
+//
+// ids file of segment is kept if it resolves dead letters in segments not removed,
+// otherwise these dead letters would be listed again.
+func cleanResolvedDeadLetters(dlq *Journal) (err error) {
+	dlq.Lock()
+	defer dlq.Unlock()
+	if err = dlq.Flush(); err != nil {
+		return errors.Wrap(err, "flush dead-letter journal")
+	}
+
+	// active segment is still written
+	removable := map[string]bool{}
+	for _, seg := range dlq.manifest.GetSegments() {
+		if seg.State == SegmentSealed || seg.State == SegmentReplaying {
+			removable[seg.Name] = true
+		}
+	}
+
+	segs, err := ScanSegments(dlq.bufDirPath)
+	if err != nil {
+		return errors.Wrapf(err, "scan segments in `%s`", dlq.bufDirPath)
+	}
+	var (
+		resolved = map[int64]struct{}{}
+		// segmentOf segment of each dead letter
+		segmentOf = map[int64]string{}
+		// resolvedBy ids in ids file of each segment
+		resolvedBy = map[string]map[int64]struct{}{}
+	)
+	for _, seg := range segs {
+		if seg.IdsFile != "" {
+			ids := map[int64]struct{}{}
+			if err = loadIdsFile(seg.IdsFile, ids); err != nil {
+				return err
+			}
+			for id := range ids {
+				resolved[id] = struct{}{}
+			}
+			resolvedBy[seg.Name] = ids
+		}
+		if seg.DataFile != "" {
+			if err = ForEachDataInFile(seg.DataFile, func(data *Data) error {
+				segmentOf[data.ID] = seg.Name
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for id, name := range segmentOf {
+		if _, ok := resolved[id]; !ok {
+			delete(removable, name)
+		}
+	}
+	for isChanged := true; isChanged; {
+		isChanged = false
+		for name := range removable {
+			for id := range resolvedBy[name] {
+				if seg, ok := segmentOf[id]; ok && !removable[seg] {
+					delete(removable, name)
+					isChanged = true
+					break
+				}
+			}
+		}
+	}
+	if len(removable) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(removable))
+	for name := range removable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if err = dlq.manifest.Transit(SegmentConsumed, names...); err != nil {
+		return errors.Wrap(err, "mark resolved segments consumed")
+	}
+	dlq.logger.Info("clean resolved dead letters", zap.Strings("segments", names))
+	dlq.triggerClean()
+	return nil
+}
+
+// deadLetter move record into dead-letter journal after all attempts failed
+func (r *replayer) deadLetter(ctx context.Context, rec *replayRecord, attempts int, cause error) error {
+	id, err := r.deadLetters.NextID()
+	if err != nil {
+		return errors.Wrap(err, "allocate dead letter id")
+	}
+	if err = r.deadLetters.WriteDataCtx(ctx, newDeadLetterData(id, rec, attempts, cause)); err != nil {
+		return errors.Wrapf(err, "move into dead letters after %d attempts: %v", attempts, cause)
+	}
+	r.attempts.deadLetter(rec, attempts)
+
+	r.report.Lock()
+	r.report.DeadLetters++
+	r.report.Unlock()
+	r.legacy.metrics.AddCounter(metricDeadLetters, 1)
+	r.deadLetters.logger.Warn("move record into dead letters",
+		zap.String("segment", rec.segment),
+		zap.Int64("id", rec.data.ID),
+		zap.Int64("dead_letter_id", id),
+		zap.Int("attempts", attempts),
+		zap.Error(cause))
+	return nil
+}
+
+// flushDeadLetters make sure dead letters are persisted before segments cleaned,
+// then save attempts, so records moved into dead letters are not moved again.
+func (r *replayer) flushDeadLetters() error {
+	if r.deadLetters == nil {
+		return nil
+	}
+
+	r.deadLetters.Lock()
+	err := r.deadLetters.Flush()
+	r.deadLetters.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "flush dead-letter journal")
+	}
+
+	if err = r.attempts.flush(); err != nil {
+		return errors.Wrap(err, "save replay attempts")
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package journal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterData(t *testing.T) {
+	rec := &replayRecord{
+		segment: "20200102_00000001",
+		data: &Data{
+			ID:        7,
+			Data:      map[string]interface{}{"tag": "app"},
+			Timestamp: time.Date(2020, 1, 2, 10, 0, 0, 1, time.UTC),
+			Key:       "key",
+			Headers:   map[string]string{"source": "api"},
+		},
+	}
+	data := newDeadLetterData(100, rec, 3, fmt.Errorf("poison"))
+	data.Timestamp = time.Date(2020, 1, 2, 11, 0, 0, 0, time.UTC)
+
+	dl, err := parseDeadLetter(data)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if dl.ID != 100 || dl.Attempts != 3 || dl.Reason != "poison" ||
+		dl.Segment != rec.segment || !dl.FailedAt.Equal(data.Timestamp) {
+		t.Fatalf("got wrong dead letter %+v", dl)
+	}
+	if dl.Data.ID != 7 || dl.Data.Data["tag"] != "app" || dl.Data.Key != "key" ||
+		!dl.Data.Timestamp.Equal(rec.data.Timestamp) ||
+		len(dl.Data.Headers) != 1 || dl.Data.Headers["source"] != "api" {
+		t.Fatalf("got wrong origin record %+v", dl.Data)
+	}
+
+	delete(data.Headers, HeaderDeadLetterOriginID)
+	if _, err = parseDeadLetter(data); err == nil {
+		t.Fatal("should not parse dead letter without origin id")
+	}
+}
+
+func TestJournalDeadLetter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := newTestJournal(t, ctx, WithDeadLetter(3))
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+	var err error
+
+	writeAndSeal := func(ids ...int64) {
+		for _, id := range ids {
+			if err = j.WriteData(&Data{ID: id, Key: "key"}); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		// legacy loader always skip the latest sealed segment
+		for i := 0; i < 2; i++ {
+			if err = j.Rotate(ctx); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+	}
+	writeAndSeal(1, 2, 3, 4, 5)
+
+	var (
+		mu       sync.Mutex
+		attempts = map[int64]int{}
+	)
+	report, err := j.Replay(ctx, func(data *Data) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[data.ID]++
+		switch {
+		case data.ID == 2:
+			return fmt.Errorf("poison")
+		case data.ID == 4 && attempts[data.ID] == 1:
+			return fmt.Errorf("temporary")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if report.Records != 4 || report.DeadLetters != 1 || report.Retried != 3 {
+		t.Fatalf("got wrong report %+v", report)
+	}
+	if attempts[2] != 3 || attempts[4] != 2 {
+		t.Fatalf("got wrong attempts %v", attempts)
+	}
+
+	letters, err := j.ListDeadLetters()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("expect 1 dead letter, got %d", len(letters))
+	}
+	if dl := letters[0]; dl.Data.ID != 2 || dl.Data.Key != "key" ||
+		dl.Attempts != 3 || dl.Reason != "poison" || dl.Segment == "" {
+		t.Fatalf("got wrong dead letter %+v", dl)
+	}
+
+	// unknown ids are ignored
+	if n, err := j.ReinjectDeadLetters(ctx, letters[0].ID+1); err != nil || n != 0 {
+		t.Fatalf("expect nothing re-injected, got %d: %+v", n, err)
+	}
+	if n, err := j.ReinjectDeadLetters(ctx); err != nil || n != 1 {
+		t.Fatalf("expect 1 re-injected, got %d: %+v", n, err)
+	}
+	if letters, err = j.ListDeadLetters(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(letters) != 0 {
+		t.Fatalf("dead letter should be resolved, got %+v", letters)
+	}
+
+	writeAndSeal()
+	var got []*Data
+	if report, err = j.Replay(ctx, func(data *Data) error {
+		got = append(got, data)
+		return nil
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(got) != 1 || got[0].ID != 2 || got[0].Key != "key" || report.DeadLetters != 0 {
+		t.Fatalf("got wrong re-injected records %+v", got)
+	}
+}
+
+func TestJournalDeadLetterDisabled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := prepareReplayJournal(t, ctx, 1)
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+
+	if _, err := j.ListDeadLetters(); err != ErrDeadLetterDisabled {
+		t.Fatalf("expect ErrDeadLetterDisabled, got %+v", err)
+	}
+	report, err := j.Replay(ctx, func(data *Data) error {
+		return fmt.Errorf("poison")
+	}, WithReplayOrder(ReplaySegmentOrdered))
+	if err == nil {
+		t.Fatal("should return error without dead letters")
+	}
+	if report.Retried != 0 || report.DeadLetters != 0 {
+		t.Fatalf("got wrong report %+v", report)
+	}
+
+	if _, err = NewJournal(WithDeadLetter(0)); err == nil {
+		t.Fatal("should not accept zero max attempts")
+	}
+}
+
+func TestJournalDeadLetterAcrossReplays(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := newTestJournal(t, ctx, WithDeadLetter(3))
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+	var err error
+
+	for _, id := range []int64{1, 2, 3, 4} {
+		if err = j.WriteData(&Data{ID: id}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	// legacy loader always skip the latest sealed segment
+	for i := 0; i < 2; i++ {
+		if err = j.Rotate(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	calls := map[int64]int{}
+	replay := func(handler func(ctx context.Context, cancel func(), data *Data) error) (*ReplayReport, error) {
+		rctx, rcancel := context.WithCancel(ctx)
+		defer rcancel()
+		return j.Replay(rctx, func(data *Data) error {
+			calls[data.ID]++
+			return handler(rctx, rcancel, data)
+		},
+			WithReplayWorkers(1),
+			WithReplayOrder(ReplaySegmentOrdered),
+			WithReplayRetryBackoff(0),
+		)
+	}
+
+	// interrupted in the second attempt of record 2
+	if _, err = replay(func(_ context.Context, cancel func(), data *Data) error {
+		if data.ID == 2 {
+			if calls[2] == 2 {
+				// attempts are saved once at the end of replay
+				if _, err := os.Stat(filepath.Join(j.deadLetters.bufDirPath, replayAttemptsFileName)); !os.IsNotExist(err) {
+					t.Errorf("attempts should not be saved for each failure, got %v", err)
+				}
+				cancel()
+			}
+			return fmt.Errorf("poison")
+		}
+		return nil
+	}); err == nil {
+		t.Fatal("should return error if canceled")
+	}
+	if _, err = replay(func(_ context.Context, cancel func(), data *Data) error {
+		switch data.ID {
+		case 2:
+			return fmt.Errorf("poison")
+		case 4:
+			// interrupted after record 2 moved into dead letters
+			cancel()
+			return fmt.Errorf("temporary")
+		}
+		return nil
+	}); err == nil {
+		t.Fatal("should return error if canceled")
+	}
+	// attempt interrupted by canceling is not counted
+	if calls[2] != 4 {
+		t.Fatalf("record should be moved into dead letters after 3 attempts across replays, got %d calls", calls[2])
+	}
+
+	report, err := replay(func(context.Context, func(), *Data) error { return nil })
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if calls[2] != 4 || report.DeadLetters != 0 || report.Records != 3 {
+		t.Fatalf("record should not be moved into dead letters again, got %d calls, report %+v", calls[2], report)
+	}
+
+	// attempts are released after segments consumed
+	attempts, err := loadReplayAttempts(filepath.Join(j.deadLetters.bufDirPath, replayAttemptsFileName))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(attempts.records) != 0 {
+		t.Fatalf("attempts should be released, got %+v", attempts.records)
+	}
+
+	letters, err := j.ListDeadLetters()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(letters) != 1 || letters[0].Data.ID != 2 || letters[0].Attempts != 3 {
+		t.Fatalf("got wrong dead letters %+v", letters)
+	}
+
+	// resolved dead letters are cleaned after their segment sealed
+	dlqSegs, err := ScanSegments(j.deadLetters.bufDirPath)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.deadLetters.Rotate(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if n, err := j.ReinjectDeadLetters(ctx); err != nil || n != 1 {
+		t.Fatalf("expect 1 re-injected, got %d: %+v", n, err)
+	}
+	removeConsumed(t, j.deadLetters)
+	if _, err = os.Stat(dlqSegs[0].DataFile); !os.IsNotExist(err) {
+		t.Fatalf("resolved dead letters should be removed, got %+v", err)
+	}
+	if letters, err = j.ListDeadLetters(); err != nil || len(letters) != 0 {
+		t.Fatalf("dead letters should be resolved, got %+v: %+v", letters, err)
+	}
+}
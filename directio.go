@@ -0,0 +1,166 @@
+package journal
+
+// directio.go
+// write data file bypass page cache by O_DIRECT.
+//
+// O_DIRECT requires buffer address, length and file offset aligned to block,
+// so the last partial block is padded when flushing, and rewritten by next flush.
+// padding ends with trailer records logical length of file,
+// readers only read up to logical length.
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/ncw/directio"
+	"github.com/pkg/errors"
+)
+
+const (
+	// dataPaddingByte padding after the last record in file written by direct io
+	dataPaddingByte = 0x00
+	// dataTrailerSize magic & logical length at the end of padding
+	dataTrailerSize = 16
+)
+
+// dataTrailerMagic mark the end of padding, 0xc1 is never used by msgpack
+var dataTrailerMagic = []byte{0xc1, 'j', 'o', 'u', 'r', 'n', 'a', 'l'}
+
+// openDirectFile open file with O_DIRECT
+func openDirectFile(fpath string) (fp *os.File, err error) {
+	if fp, err = directio.OpenFile(fpath, os.O_RDWR|os.O_CREATE, FileMode); err != nil {
+		return nil, errors.Wrapf(err, "open file `%s` with direct io", fpath)
+	}
+
+	return fp, nil
+}
+
+// alignedWriter write into file opened by `openDirectFile` in aligned blocks.
+// bytes are kept in memory until buffer is full or `Flush`.
+type alignedWriter struct {
+	fp  *os.File
+	buf []byte
+	// n bytes in buf
+	n int
+	// offset file offset of buf[0], always aligned
+	offset int64
+	// flushed logical length of bytes persisted into file,
+	// bytes after it are padding
+	flushed int64
+}
+
+func newAlignedWriter(fp *os.File) *alignedWriter {
+	return &alignedWriter{
+		fp: fp,
+		// one more block to hold trailer
+		buf: directio.AlignedBlock(alignUp(BufSize) + directio.BlockSize),
+	}
+}
+
+// alignUp round n up to multiple of block size
+func alignUp(n int) int {
+	return (n + directio.BlockSize - 1) / directio.BlockSize * directio.BlockSize
+}
+
+func (w *alignedWriter) Write(p []byte) (n int, err error) {
+	limit := len(w.buf) - directio.BlockSize
+	for len(p) != 0 {
+		c := copy(w.buf[w.n:limit], p)
+		w.n += c
+		n += c
+		p = p[c:]
+
+		if w.n == limit {
+			if err = w.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Flush write all buffered bytes, the last partial block is padded,
+// padding ends with trailer records logical length.
+func (w *alignedWriter) Flush() (err error) {
+	if w.n == 0 {
+		return nil
+	}
+
+	padded := alignUp(w.n + dataTrailerSize)
+	fillPadding(w.buf[w.n:padded], w.Len())
+	if _, err = w.fp.WriteAt(w.buf[:padded], w.offset); err != nil {
+		return errors.Wrapf(err, "write file `%s` at %d", w.fp.Name(), w.offset)
+	}
+
+	w.flushed = w.Len()
+
+	// keep the partial block, it will be rewritten by next flush
+	full := w.n / directio.BlockSize * directio.BlockSize
+	copy(w.buf, w.buf[full:w.n])
+	w.n -= full
+	w.offset += int64(full)
+	return nil
+}
+
+// Len return logical length of bytes written
+func (w *alignedWriter) Len() int64 {
+	return w.offset + int64(w.n)
+}
+
+// Flushed return logical length of bytes persisted into file,
+// these bytes will never be rewritten or truncated.
+func (w *alignedWriter) Flushed() int64 {
+	return w.flushed
+}
+
+// Close flush buffer, then truncate padding
+func (w *alignedWriter) Close() (err error) {
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = w.fp.Truncate(w.Len()); err != nil {
+		return errors.Wrapf(err, "truncate padding of file `%s`", w.fp.Name())
+	}
+
+	return nil
+}
+
+// fillPadding fill padding with zeros, then trailer records logical length of file.
+// padding should not be shorter than `dataTrailerSize`.
+func fillPadding(padding []byte, logicalLen int64) {
+	for i := range padding {
+		padding[i] = dataPaddingByte
+	}
+
+	trailer := padding[len(padding)-dataTrailerSize:]
+	copy(trailer, dataTrailerMagic)
+	bitOrder.PutUint64(trailer[len(dataTrailerMagic):], uint64(logicalLen))
+}
+
+// dataLogicalLen return length of records in uncompressed data file, without padding.
+// file written by direct io ends with trailer until closed,
+// otherwise the whole file is records.
+func dataLogicalLen(fp *os.File) (n int64, err error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return 0, errors.Wrapf(err, "stat file `%s`", fp.Name())
+	}
+	size := fi.Size()
+	if size < dataTrailerSize || size%directio.BlockSize != 0 {
+		return size, nil
+	}
+	trailer := make([]byte, dataTrailerSize)
+	if _, err = fp.ReadAt(trailer, size-dataTrailerSize); err != nil && err != io.EOF {
+		return 0, errors.Wrapf(err, "read trailer of file `%s`", fp.Name())
+	}
+	if !bytes.Equal(trailer[:len(dataTrailerMagic)], dataTrailerMagic) {
+		return size, nil
+	}
+	if n = int64(bitOrder.Uint64(trailer[len(dataTrailerMagic):])); n > size-dataTrailerSize {
+		return size, nil
+	}
+
+	return n, nil
+}
@@ -0,0 +1,167 @@
+package journal
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ncw/directio"
+)
+
+// openDirectTestFile skip test if filesystem not support O_DIRECT
+func openDirectTestFile(t *testing.T, dir string) *os.File {
+	fp, err := openDirectFile(filepath.Join(dir, "direct.test"))
+	if err != nil {
+		t.Skipf("direct io not supported: %v", err)
+	}
+
+	return fp
+}
+
+func TestAlignedWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-directio")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	fp := openDirectTestFile(t, dir)
+	defer fp.Close()
+	w := newAlignedWriter(fp)
+
+	expect := &bytes.Buffer{}
+	for i, n := range []int{10, directio.BlockSize, 3*directio.BlockSize + 7, 1} {
+		chunk := bytes.Repeat([]byte{byte('a' + i)}, n)
+		expect.Write(chunk)
+		if _, err = w.Write(chunk); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = w.Flush(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		cnt, err := ioutil.ReadFile(fp.Name())
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if len(cnt)%directio.BlockSize != 0 {
+			t.Fatalf("file should be aligned, got %d bytes", len(cnt))
+		}
+		if !bytes.Equal(cnt[:expect.Len()], expect.Bytes()) {
+			t.Fatalf("got wrong content after write %d bytes", n)
+		}
+		rfp, err := os.Open(fp.Name())
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		n, err := dataLogicalLen(rfp)
+		rfp.Close()
+		if err != nil || n != int64(expect.Len()) {
+			t.Fatalf("trailer should record length %d, got %d: %+v", expect.Len(), n, err)
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	cnt, err := ioutil.ReadFile(fp.Name())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(cnt, expect.Bytes()) {
+		t.Fatalf("padding should be truncated, expect %d bytes, got %d", expect.Len(), len(cnt))
+	}
+}
+
+func TestJournalDirectIO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-directio")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+	openDirectTestFile(t, dir).Close()
+	os.Remove(filepath.Join(dir, "direct.test"))
+
+	if _, err = NewJournal(WithDirectIO(true), WithIsCompress(true)); err == nil {
+		t.Fatal("should not enable direct io with compress")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := NewJournal(
+		WithBufDirPath(dir),
+		WithLogger(newTestLogger(t)),
+		WithDirectIO(true),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Start(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer j.Close(ctx)
+
+	dataFpath := j.dataFp.Name()
+	countRecords := func() (n int) {
+		if err := ForEachDataInFile(dataFpath, func(*Data) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		return n
+	}
+
+	for id := int64(0); id < 20; id++ {
+		if err = j.WriteData(&Data{ID: id, Data: map[string]interface{}{"id": id}}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = j.WriteId(id); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		// flush in the middle, next flush should rewrite the partial block
+		if id == 9 || id == 19 {
+			if err = j.Flush(); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if n := countRecords(); n != int(id+1) {
+				t.Fatalf("expect %d records, got %d", id+1, n)
+			}
+			if fi, err := os.Stat(dataFpath); err != nil {
+				t.Fatalf("%+v", err)
+			} else if fi.Size()%directio.BlockSize != 0 {
+				t.Fatalf("active file should be aligned, got %d bytes", fi.Size())
+			}
+		}
+	}
+
+	if err = j.Rotate(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	meta, err := LoadSegmentMeta(dataFpath)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if fi, err := os.Stat(dataFpath); err != nil {
+		t.Fatalf("%+v", err)
+	} else if fi.Size() != meta.DataBytes {
+		t.Fatalf("sealed file should be truncated to %d bytes, got %d", meta.DataBytes, fi.Size())
+	}
+	if n := countRecords(); n != 20 {
+		t.Fatalf("expect 20 records, got %d", n)
+	}
+
+	report, err := Verify(dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !report.OK() || report.Records != 20 {
+		t.Fatalf("got wrong report: %+v", report)
+	}
+}
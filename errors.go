@@ -5,4 +5,32 @@ import "fmt"
 var (
 	// ErrDuringRotate rotate error
 	ErrDuringRotate = fmt.Errorf("during rotating")
+	// ErrClosed journal is closing or closed
+	ErrClosed = fmt.Errorf("journal closed")
+	// ErrLegacyRunning legacy is loading by others
+	ErrLegacyRunning = fmt.Errorf("legacy is running")
+	// ErrDeadLetterDisabled dead letters are not enabled by `WithDeadLetter`
+	ErrDeadLetterDisabled = fmt.Errorf("dead letter is not enabled")
+	// ErrSubscriberOverflow too many records written during subscriber catching up
+	ErrSubscriberOverflow = fmt.Errorf("subscriber overflowed during catching up")
 )
+
+// IOError failed to read or write journal files
+type IOError struct {
+	Op  string
+	Err error
+}
+
+func (e *IOError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+// Unwrap return underlying error
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
+
+// Cause return underlying error, compatible with `errors.Cause`
+func (e *IOError) Cause() error {
+	return e.Err
+}
@@ -0,0 +1,53 @@
+package journal
+
+// event.go
+// lifecycle events of journal.
+
+import (
+	"time"
+)
+
+// EventType type of journal lifecycle event
+type EventType string
+
+const (
+	// EventRotate new segment files created
+	EventRotate EventType = "rotate"
+	// EventSeal segment files closed, `Event.Meta` is available
+	EventSeal EventType = "seal"
+	// EventFlushError flush trigger got error
+	EventFlushError EventType = "flush_error"
+	// EventRotateError rotate trigger got error
+	EventRotateError EventType = "rotate_error"
+	// EventCorruption got broken data file during replay
+	EventCorruption EventType = "corruption"
+	// EventClean legacy file removed
+	EventClean EventType = "clean"
+)
+
+// Event journal lifecycle event
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Segment segment name, like `20060102_00000001`
+	Segment string
+	// Files file paths related to event
+	Files []string
+	// Size total bytes of files
+	Size int64
+	// Meta statistics of sealed segment
+	Meta *SegmentMeta
+	Err  error
+}
+
+// EventHook receive journal events.
+// hooks are invoked synchronously after journal's write lock released,
+// could call back into journal, but should not block.
+type EventHook func(evt *Event)
+
+// emitEvent invoke all hooks
+func emitEvent(hooks []EventHook, evt *Event) {
+	for _, hook := range hooks {
+		hook(evt)
+	}
+}
@@ -0,0 +1,190 @@
+package journal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testEventRecorder struct {
+	sync.Mutex
+	evts []*Event
+}
+
+func (r *testEventRecorder) hook(evt *Event) {
+	r.Lock()
+	r.evts = append(r.evts, evt)
+	r.Unlock()
+}
+
+func (r *testEventRecorder) get(typ EventType) (evts []*Event) {
+	r.Lock()
+	defer r.Unlock()
+	for _, evt := range r.evts {
+		if evt.Type == typ {
+			evts = append(evts, evt)
+		}
+	}
+
+	return evts
+}
+
+func TestJournalEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-event")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recorder := &testEventRecorder{}
+	j, err := NewJournal(
+		WithBufDirPath(dir),
+		WithEventHook(recorder.hook),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Start(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer j.Close(ctx)
+
+	for i := 0; i < 2; i++ {
+		if err = j.WriteData(&Data{ID: int64(i)}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = j.Rotate(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	if evts := recorder.get(EventRotate); len(evts) != 3 {
+		t.Fatalf("expect 3 rotate events, got %d", len(evts))
+	}
+	seals := recorder.get(EventSeal)
+	if len(seals) != 2 {
+		t.Fatalf("expect 2 seal events, got %d", len(seals))
+	}
+	if seals[0].Meta == nil || seals[0].Meta.Records != 1 || seals[0].Size == 0 {
+		t.Fatalf("got wrong seal event: %+v", seals[0])
+	}
+
+	if !j.LockLegacy() {
+		t.Fatal("can not lock legacy")
+	}
+	data := &Data{}
+	for {
+		if err = j.LoadLegacyBuf(data); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	removeConsumed(t, j)
+
+	cleans := recorder.get(EventClean)
+	if len(cleans) != 2 {
+		t.Fatalf("expect 2 clean events, got %d", len(cleans))
+	}
+	for _, evt := range cleans {
+		if evt.Err != nil || evt.Segment != seals[0].Segment {
+			t.Fatalf("got wrong clean event: %+v", evt)
+		}
+	}
+}
+
+func TestLegacyCorruptionEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-event")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	brokenFp, err := ioutil.TempFile(dir, "*.buf")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = brokenFp.Write([]byte{0xc1, 0xc1, 0xc1}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	brokenFp.Close()
+	lastFp, err := ioutil.TempFile(dir, "*.buf")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	lastFp.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recorder := &testEventRecorder{}
+	legacy := NewLegacyLoader(ctx, Logger, []string{brokenFp.Name(), lastFp.Name()}, nil, false, testIDTTL)
+	legacy.eventHooks = []EventHook{recorder.hook}
+	if err = legacy.Load(&Data{}); err != io.EOF {
+		t.Fatalf("expect EOF, got %+v", err)
+	}
+
+	evts := recorder.get(EventCorruption)
+	if len(evts) != 1 {
+		t.Fatalf("expect 1 corruption event, got %d", len(evts))
+	}
+	if evts[0].Err == nil || evts[0].Files[0] != brokenFp.Name() || evts[0].Size != 3 {
+		t.Fatalf("got wrong corruption event: %+v", evts[0])
+	}
+}
+
+func TestJournalEventHookCallBack(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		j       *Journal
+		mu      sync.Mutex
+		nSealed int
+	)
+	j, dir := newTestJournal(t, ctx, WithEventHook(func(evt *Event) {
+		if evt.Type != EventSeal {
+			return
+		}
+
+		// hooks should be able to call back into journal
+		j.Status()
+		j.GetMetric()
+		if err := j.WriteData(&Data{ID: 100}); err != nil {
+			t.Errorf("write in hook: %+v", err)
+		}
+		mu.Lock()
+		nSealed++
+		mu.Unlock()
+	}))
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+
+	if err := j.WriteData(&Data{ID: 1}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- j.Rotate(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rotate deadlocked by hook")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if nSealed != 1 {
+		t.Fatalf("expect 1 seal event, got %d", nSealed)
+	}
+}
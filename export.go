@@ -0,0 +1,362 @@
+package journal
+
+// export.go
+// export records to NDJSON, and import them back.
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	// exportBinKey wrap `[]byte` in exported json, like `{"$bin": "<base64>"}`
+	exportBinKey = "$bin"
+	// exportTimeKey wrap `time.Time` in exported json, like `{"$time": "<RFC3339Nano>"}`
+	exportTimeKey = "$time"
+	// exportFloat32Key wrap `float32` in exported json, like `{"$f32": 1.5}`
+	exportFloat32Key = "$f32"
+	// exportEscapePrefix escape user's keys start with `$`, like `$bin` -> `$$bin`
+	exportEscapePrefix = "$"
+)
+
+// ExportFilter decide whether to export record
+type ExportFilter func(data *Data, isCommitted bool) bool
+
+var (
+	// ExportAll export all records
+	ExportAll ExportFilter = func(*Data, bool) bool { return true }
+	// ExportUncommitted only export records not committed by ids
+	ExportUncommitted ExportFilter = func(_ *Data, isCommitted bool) bool { return !isCommitted }
+)
+
+// exportRecord one line in exported NDJSON
+type exportRecord struct {
+	ID        int64                  `json:"id"`
+	Data      map[string]interface{} `json:"data"`
+	Timestamp *time.Time             `json:"timestamp,omitempty"`
+	Key       string                 `json:"key,omitempty"`
+	Headers   map[string]string      `json:"headers,omitempty"`
+}
+
+// Export write records in buf directory into `w` as NDJSON of `{"id": .., "data": ..}`,
+// `timestamp`, `key` & `headers` are omitted if empty,
+// return the number of exported records.
+//
+// `[]byte`, `time.Time` & `float32` are wrapped as `{"$bin": ..}`, `{"$time": ..}` & `{"$f32": ..}`,
+// keys start with `$` in records are escaped by doubling `$`, like `$$bin`,
+// floats always contain decimal point, so `Import` can restore them faithfully.
+// all records are exported if `filter` is nil.
+// `opts` set logger, like `WithComponentLogger(logger)`.
+func Export(dir string, w io.Writer, filter ExportFilter, opts ...ComponentOptionFunc) (n int64, err error) {
+	if filter == nil {
+		filter = ExportAll
+	}
+
+	segs, err := ScanSegments(dir)
+	if err != nil {
+		return 0, errors.Wrapf(err, "scan segments in `%s`", dir)
+	}
+
+	// commits of data may be written into any later ids file
+	committed := map[int64]struct{}{}
+	for _, seg := range segs {
+		if seg.IdsFile == "" {
+			continue
+		}
+		if err = loadIdsFile(seg.IdsFile, committed); err != nil {
+			return 0, err
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, seg := range segs {
+		if seg.DataFile == "" {
+			continue
+		}
+
+		if err = ForEachDataInFile(seg.DataFile, func(data *Data) error {
+			_, isCommitted := committed[data.ID]
+			if !filter(data, isCommitted) {
+				return nil
+			}
+
+			r := &exportRecord{
+				ID:      data.ID,
+				Key:     data.Key,
+				Headers: data.Headers,
+			}
+			if !data.Timestamp.IsZero() {
+				r.Timestamp = &data.Timestamp
+			}
+			if r.Data, err = exportMap(data.Data); err != nil {
+				return errors.Wrapf(err, "export record %d in `%s`", data.ID, seg.DataFile)
+			}
+			if err = enc.Encode(r); err != nil {
+				return errors.Wrap(err, "write record")
+			}
+			n++
+			return nil
+		}); err != nil {
+			return n, err
+		}
+	}
+
+	if err = bw.Flush(); err != nil {
+		return n, errors.Wrap(err, "flush writer")
+	}
+
+	newComponentOption(opts...).logger.Info("export records", zap.String("dir", dir), zap.Int64("n", n))
+	return n, nil
+}
+
+// Import read NDJSON generated by `Export`, and write records into journal,
+// return the number of imported records.
+func (j *Journal) Import(r io.Reader) (n int64, err error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	for {
+		raw := struct {
+			ID        *int64                 `json:"id"`
+			Data      map[string]interface{} `json:"data"`
+			Timestamp time.Time              `json:"timestamp"`
+			Key       string                 `json:"key"`
+			Headers   map[string]string      `json:"headers"`
+		}{}
+		if err = dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return n, errors.Wrapf(err, "decode record after %d records", n)
+		}
+		if raw.ID == nil {
+			return n, fmt.Errorf("record after %d records has no id", n)
+		}
+
+		data := &Data{
+			ID:        *raw.ID,
+			Timestamp: raw.Timestamp,
+			Key:       raw.Key,
+			Headers:   raw.Headers,
+		}
+		if data.Data, err = importMap(raw.Data); err != nil {
+			return n, errors.Wrapf(err, "import record %d", data.ID)
+		}
+		if err = j.WriteData(data); err != nil {
+			return n, errors.Wrapf(err, "write record %d", data.ID)
+		}
+		n++
+	}
+
+	j.logger.Info("import records", zap.Int64("n", n))
+	return n, nil
+}
+
+// loadIdsFile add all ids in file into set
+func loadIdsFile(fpath string, ids map[int64]struct{}) error {
+	return ForEachIDInFile(fpath, func(id int64) error {
+		ids[id] = struct{}{}
+		return nil
+	})
+}
+
+// ForEachIDInFile decode all ids in ids file, stop if handler return error
+func ForEachIDInFile(fpath string, handler func(int64) error) (err error) {
+	if fi, err := os.Stat(fpath); err != nil {
+		return errors.Wrapf(err, "stat file `%s`", fpath)
+	} else if fi.Size() == 0 {
+		return nil
+	}
+
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return errors.Wrapf(err, "open file `%s`", fpath)
+	}
+	defer fp.Close()
+
+	dec, err := NewIdsDecoder(fp, isFileGZ(fpath))
+	if err != nil {
+		return errors.Wrapf(err, "create ids decoder for `%s`", fpath)
+	}
+
+	var id int64
+	for {
+		if id, err = dec.Read(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "decode ids file `%s`", fpath)
+		}
+
+		if err = handler(id); err != nil {
+			return err
+		}
+	}
+}
+
+// ForEachDataInFile decode all records in data file, stop if handler return error
+func ForEachDataInFile(fpath string, handler func(*Data) error) (err error) {
+	if fi, err := os.Stat(fpath); err != nil {
+		return errors.Wrapf(err, "stat file `%s`", fpath)
+	} else if fi.Size() == 0 {
+		return nil
+	}
+
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return errors.Wrapf(err, "open file `%s`", fpath)
+	}
+	defer fp.Close()
+
+	dec, err := NewDataDecoder(fp, isFileGZ(fpath))
+	if err != nil {
+		return errors.Wrapf(err, "create data decoder for `%s`", fpath)
+	}
+
+	for {
+		data := new(Data)
+		if err = dec.Read(data); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "decode data file `%s`", fpath)
+		}
+
+		if err = handler(data); err != nil {
+			return err
+		}
+	}
+}
+
+func exportMap(m map[string]interface{}) (map[string]interface{}, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	var err error
+	ret := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		ek := k
+		if strings.HasPrefix(k, exportEscapePrefix) {
+			ek = exportEscapePrefix + k
+		}
+		if ret[ek], err = exportValue(v); err != nil {
+			return nil, errors.Wrapf(err, "export key `%s`", k)
+		}
+	}
+
+	return ret, nil
+}
+
+// exportValue convert msgp decoded value into json compatible value
+func exportValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil, bool, string,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64:
+		return v, nil
+	case float32:
+		f, err := exportFloat(float64(v))
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{exportFloat32Key: f}, nil
+	case float64:
+		return exportFloat(v)
+	case []byte:
+		return map[string]interface{}{exportBinKey: base64.StdEncoding.EncodeToString(v)}, nil
+	case time.Time:
+		return map[string]interface{}{exportTimeKey: v.Format(time.RFC3339Nano)}, nil
+	case map[string]interface{}:
+		return exportMap(v)
+	case []interface{}:
+		var err error
+		ret := make([]interface{}, len(v))
+		for i := range v {
+			if ret[i], err = exportValue(v[i]); err != nil {
+				return nil, errors.Wrapf(err, "export index %d", i)
+			}
+		}
+		return ret, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %T", v)
+	}
+}
+
+// exportFloat make sure float always contains decimal point or exponent
+func exportFloat(f float64) (json.Number, error) {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if strings.ContainsAny(s, "NI") { // NaN & Inf
+		return "", fmt.Errorf("unsupported float %s", s)
+	}
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+
+	return json.Number(s), nil
+}
+
+func importMap(m map[string]interface{}) (map[string]interface{}, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	var err error
+	ret := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if strings.HasPrefix(k, exportEscapePrefix+exportEscapePrefix) {
+			k = k[len(exportEscapePrefix):]
+		}
+		if ret[k], err = importValue(v); err != nil {
+			return nil, errors.Wrapf(err, "import key `%s`", k)
+		}
+	}
+
+	return ret, nil
+}
+
+// importValue convert json decoded value back into msgp decoded value
+func importValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case json.Number:
+		s := v.String()
+		if strings.ContainsAny(s, ".eE") {
+			return v.Float64()
+		}
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return strconv.ParseUint(s, 10, 64)
+	case map[string]interface{}:
+		if len(v) == 1 {
+			if s, ok := v[exportBinKey].(string); ok {
+				return base64.StdEncoding.DecodeString(s)
+			}
+			if s, ok := v[exportTimeKey].(string); ok {
+				return time.Parse(time.RFC3339Nano, s)
+			}
+			if f, ok := v[exportFloat32Key].(json.Number); ok {
+				f32, err := strconv.ParseFloat(f.String(), 32)
+				return float32(f32), err
+			}
+		}
+		return importMap(v)
+	case []interface{}:
+		var err error
+		for i := range v {
+			if v[i], err = importValue(v[i]); err != nil {
+				return nil, errors.Wrapf(err, "import index %d", i)
+			}
+		}
+		return v, nil
+	default:
+		return v, nil
+	}
+}
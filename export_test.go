@@ -0,0 +1,135 @@
+package journal
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportAndImport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	j1, dir1 := newTestJournal(t, ctx, WithIsCompress(true))
+	defer os.RemoveAll(dir1)
+	for id := int64(1); id <= 10; id++ {
+		if err := j1.WriteData(&Data{ID: id, Data: map[string]interface{}{
+			"int":   id,
+			"float": 1.0,
+			"str":   "hello",
+			"bin":   []byte{0x00, 0xff},
+			"ts":    time.Unix(1600000000, 123).UTC(),
+			"arr":   []interface{}{int64(1), "2", []byte("3")},
+			"map":   map[string]interface{}{"nested": map[string]interface{}{"bin": []byte("yo")}},
+			"nil":   nil,
+			"large": uint64(1) << 63,
+			"f32":   float32(1.1),
+			// user's keys look like wrappers
+			"$bin":   "not bin",
+			"$$x":    int64(2),
+			"fakeTs": map[string]interface{}{"$time": "not time"},
+		},
+			Key:     "key",
+			Headers: map[string]string{"source": "test"},
+		}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if id%2 == 0 {
+			if err := j1.WriteId(id); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		if id == 5 {
+			if err := j1.Rotate(ctx); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+	}
+	j1.Close(ctx)
+
+	buf1 := &bytes.Buffer{}
+	n, err := Export(dir1, buf1, ExportUncommitted, WithComponentLogger(newTestLogger(t)))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("exported:\n%s", buf1.String())
+	if n != 5 || strings.Count(buf1.String(), "\n") != 5 {
+		t.Fatalf("expect 5 uncommitted records, got %d", n)
+	}
+
+	allBuf := &bytes.Buffer{}
+	if n, err = Export(dir1, allBuf, nil); err != nil {
+		t.Fatalf("%+v", err)
+	} else if n != 10 {
+		t.Fatalf("expect 10 records, got %d", n)
+	}
+
+	// import into another journal
+	j2, dir2 := newTestJournal(t, ctx, WithIsCompress(true))
+	defer os.RemoveAll(dir2)
+	if n, err = j2.Import(bytes.NewReader(buf1.Bytes())); err != nil {
+		t.Fatalf("%+v", err)
+	} else if n != 5 {
+		t.Fatalf("expect import 5 records, got %d", n)
+	}
+	j2.Close(ctx)
+
+	var datas []*Data
+	segs, err := ScanSegments(dir2)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, seg := range segs {
+		if err = ForEachDataInFile(seg.DataFile, func(data *Data) error {
+			datas = append(datas, data)
+			return nil
+		}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if len(datas) != 5 || datas[0].ID != 1 {
+		t.Fatalf("got wrong records: %+v", datas)
+	}
+	if v, ok := datas[0].Data["bin"].([]byte); !ok || !bytes.Equal(v, []byte{0x00, 0xff}) {
+		t.Fatalf("got wrong bin: %#v", datas[0].Data["bin"])
+	}
+	if v, ok := datas[0].Data["float"].(float64); !ok || v != 1.0 {
+		t.Fatalf("got wrong float: %#v", datas[0].Data["float"])
+	}
+	if v, ok := datas[0].Data["int"].(int64); !ok || v != 1 {
+		t.Fatalf("got wrong int: %#v", datas[0].Data["int"])
+	}
+	if v, ok := datas[0].Data["ts"].(time.Time); !ok || !v.Equal(time.Unix(1600000000, 123)) {
+		t.Fatalf("got wrong time: %#v", datas[0].Data["ts"])
+	}
+	if v, ok := datas[0].Data["f32"].(float32); !ok || v != float32(1.1) {
+		t.Fatalf("got wrong float32: %#v", datas[0].Data["f32"])
+	}
+	if v, ok := datas[0].Data["$bin"].(string); !ok || v != "not bin" {
+		t.Fatalf("got wrong escaped key: %#v", datas[0].Data["$bin"])
+	}
+	if v, ok := datas[0].Data["$$x"].(int64); !ok || v != 2 {
+		t.Fatalf("got wrong escaped key: %#v", datas[0].Data["$$x"])
+	}
+	if v, ok := datas[0].Data["fakeTs"].(map[string]interface{}); !ok || v["$time"] != "not time" {
+		t.Fatalf("got wrong escaped map: %#v", datas[0].Data["fakeTs"])
+	}
+	if datas[0].Timestamp.IsZero() || datas[0].Key != "key" || datas[0].Headers["source"] != "test" {
+		t.Fatalf("got wrong envelope: %+v", datas[0])
+	}
+
+	buf2 := &bytes.Buffer{}
+	if _, err = Export(dir2, buf2, ExportAll); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if buf1.String() != buf2.String() {
+		t.Fatalf("records changed after import:\n%s\n%s", buf1.String(), buf2.String())
+	}
+
+	if _, err = j2.Import(strings.NewReader(`{"data": {}}`)); err == nil {
+		t.Fatal("should not import record without id")
+	}
+}
@@ -0,0 +1,151 @@
+package journal
+
+// filter.go
+// filter records & segments to replay.
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// replayFilter conditions of records to replay, all conditions should be matched
+type replayFilter struct {
+	// fromID, toID range of ids, both inclusive
+	fromID, toID int64
+	// since, until range of record's `Timestamp`, since inclusive, until exclusive.
+	// zero means unlimited.
+	since, until time.Time
+	predicate    func(*Data) bool
+}
+
+func newReplayFilter() *replayFilter {
+	return &replayFilter{
+		fromID: math.MinInt64,
+		toID:   math.MaxInt64,
+	}
+}
+
+// isFiltered whether any condition is set
+func (f *replayFilter) isFiltered() bool {
+	return f.fromID != math.MinInt64 ||
+		f.toID != math.MaxInt64 ||
+		!f.since.IsZero() ||
+		!f.until.IsZero() ||
+		f.predicate != nil
+}
+
+// matchSegment check whether segment may contain matched records without decoding it.
+//
+// sealed segment's meta records range of ids and timestamps.
+// segment without timestamps in meta (no meta, or sealed by older versions)
+// is bounded by date in its name, records are written since the day segment created.
+func (f *replayFilter) matchSegment(fpath string) bool {
+	var minTs, maxTs time.Time
+	if info, err := ParseSegmentName(fpath); err == nil {
+		minTs = info.Date
+	}
+	if meta, err := LoadSegmentMeta(fpath); err == nil {
+		if meta.Records == 0 {
+			return !f.isFiltered()
+		}
+		if meta.MaxID < f.fromID || meta.MinID > f.toID {
+			return false
+		}
+		if !meta.MinTimestamp.IsZero() {
+			minTs, maxTs = meta.MinTimestamp, meta.MaxTimestamp
+		}
+	}
+
+	switch {
+	case !f.since.IsZero() && !maxTs.IsZero() && maxTs.Before(f.since):
+		return false
+	case !f.until.IsZero() && !minTs.IsZero() && !minTs.Before(f.until):
+		return false
+	}
+
+	return true
+}
+
+// matchRecord check whether record should be replayed
+func (f *replayFilter) matchRecord(data *Data) bool {
+	if data.ID < f.fromID || data.ID > f.toID {
+		return false
+	}
+	// records written by older versions have no timestamp,
+	// only filtered by their segments.
+	if !data.Timestamp.IsZero() {
+		if (!f.since.IsZero() && data.Timestamp.Before(f.since)) ||
+			(!f.until.IsZero() && !data.Timestamp.Before(f.until)) {
+			return false
+		}
+	}
+	if f.predicate != nil && !f.predicate(data) {
+		return false
+	}
+
+	return true
+}
+
+// WithReplayFromID only replay records with id not less than `id`
+func WithReplayFromID(id int64) ReplayOptionFunc {
+	return func(o *replayOption) error {
+		o.fromID = id
+		return o.checkIDRange()
+	}
+}
+
+// WithReplayToID only replay records with id not bigger than `id`
+func WithReplayToID(id int64) ReplayOptionFunc {
+	return func(o *replayOption) error {
+		o.toID = id
+		return o.checkIDRange()
+	}
+}
+
+// WithReplaySince only replay records with `Timestamp` since `t`.
+// records without `Timestamp` (written by older versions) are only filtered by their segments.
+func WithReplaySince(t time.Time) ReplayOptionFunc {
+	return func(o *replayOption) error {
+		o.since = t
+		return o.checkTimeRange()
+	}
+}
+
+// WithReplayUntil only replay records with `Timestamp` before `t`.
+// records without `Timestamp` (written by older versions) are only filtered by their segments.
+func WithReplayUntil(t time.Time) ReplayOptionFunc {
+	return func(o *replayOption) error {
+		o.until = t
+		return o.checkTimeRange()
+	}
+}
+
+// WithReplayPredicate only replay records matched by `predicate`,
+// predicate should be concurrency safe.
+func WithReplayPredicate(predicate func(*Data) bool) ReplayOptionFunc {
+	return func(o *replayOption) error {
+		if predicate == nil {
+			return fmt.Errorf("replay predicate cannot be nil")
+		}
+
+		o.predicate = predicate
+		return nil
+	}
+}
+
+func (f *replayFilter) checkIDRange() error {
+	if f.fromID > f.toID {
+		return fmt.Errorf("replay from id `%d` should not bigger than to id `%d`", f.fromID, f.toID)
+	}
+
+	return nil
+}
+
+func (f *replayFilter) checkTimeRange() error {
+	if !f.since.IsZero() && !f.until.IsZero() && !f.since.Before(f.until) {
+		return fmt.Errorf("replay since `%s` should before until `%s`", f.since, f.until)
+	}
+
+	return nil
+}
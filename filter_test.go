@@ -0,0 +1,201 @@
+package journal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplayFilterMatchSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-filter")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	day := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	if err = SaveSegmentMeta(dir, &SegmentMeta{
+		Name:         "20200102_00000001",
+		MinID:        100,
+		MaxID:        200,
+		Records:      50,
+		MinTimestamp: day.Add(time.Hour),
+		MaxTimestamp: day.Add(2 * time.Hour),
+		// imported records written later than their timestamps
+		FirstWriteAt: day.Add(48 * time.Hour),
+		LastWriteAt:  day.Add(49 * time.Hour),
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	// sealed by older versions, no timestamps in meta
+	if err = SaveSegmentMeta(dir, &SegmentMeta{
+		Name:    "20200102_00000002",
+		MinID:   100,
+		MaxID:   200,
+		Records: 50,
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	sealed := filepath.Join(dir, "20200102_00000001.buf")
+	legacy := filepath.Join(dir, "20200102_00000002.buf")
+	active := filepath.Join(dir, "20200102_00000003.buf")
+
+	for name, c := range map[string]struct {
+		opt                    ReplayOptionFunc
+		sealed, legacy, active bool
+	}{
+		"from id":       {WithReplayFromID(201), false, false, true},
+		"to id":         {WithReplayToID(99), false, false, true},
+		"id overlapped": {WithReplayFromID(200), true, true, true},
+		"since":         {WithReplaySince(day.Add(3 * time.Hour)), false, true, true},
+		"until":         {WithReplayUntil(day.Add(time.Hour)), false, true, true},
+		"until by name": {WithReplayUntil(day), false, false, false},
+		"overlapped":    {WithReplaySince(day.Add(90 * time.Minute)), true, true, true},
+	} {
+		opt := newReplayOption()
+		if err = c.opt(opt); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if got := opt.matchSegment(sealed); got != c.sealed {
+			t.Errorf("%s: sealed segment expect %v, got %v", name, c.sealed, got)
+		}
+		if got := opt.matchSegment(legacy); got != c.legacy {
+			t.Errorf("%s: segment without timestamps in meta expect %v, got %v", name, c.legacy, got)
+		}
+		if got := opt.matchSegment(active); got != c.active {
+			t.Errorf("%s: segment without meta expect %v, got %v", name, c.active, got)
+		}
+	}
+
+	// records without timestamp are only filtered by segments
+	opt := newReplayOption()
+	if err = WithReplaySince(day.Add(time.Hour))(opt); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !opt.matchRecord(&Data{ID: 150}) {
+		t.Fatal("should match record without timestamp")
+	}
+	if opt.matchRecord(&Data{ID: 150, Timestamp: day}) {
+		t.Fatal("should filter record by timestamp")
+	}
+
+	opt = newReplayOption()
+	if err = WithReplayFromID(10)(opt); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = WithReplayToID(9)(opt); err == nil {
+		t.Fatal("should not accept to id less than from id")
+	}
+}
+
+func TestJournalReplayFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := prepareReplayJournal(t, ctx, 5)
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+
+	var got []int64
+	report, err := j.Replay(ctx, func(data *Data) error {
+		got = append(got, data.ID)
+		return nil
+	},
+		WithReplayOrder(ReplayIDOrdered),
+		WithReplayFromID(15),
+		WithReplayToID(34),
+		WithReplayPredicate(func(data *Data) bool { return data.ID%2 == 1 }),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expect := []int64{17, 19, 23, 25, 29, 31}
+	if len(got) != len(expect) {
+		t.Fatalf("expect %v, got %v", expect, got)
+	}
+	for i := range got {
+		if got[i] != expect[i] {
+			t.Fatalf("expect %v, got %v", expect, got)
+		}
+	}
+	if report.Segments != 3 || report.SkippedSegments != 2 {
+		t.Fatalf("got wrong report %+v", report)
+	}
+
+	for name, opt := range map[string]ReplayOptionFunc{
+		"until by meta": WithReplayUntil(time.Now().Add(-48 * time.Hour)),
+		"since by meta": WithReplaySince(time.Now().Add(time.Hour)),
+	} {
+		if report, err = j.Replay(ctx, func(*Data) error { return nil }, opt); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if report.Segments != 0 || report.SkippedSegments != 5 {
+			t.Fatalf("%s: got wrong report %+v", name, report)
+		}
+	}
+
+	// segments are not cleaned by filtered replay
+	if report, err = j.Replay(ctx, func(*Data) error { return nil }); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if report.Segments != 5 || report.Records != 33 {
+		t.Fatalf("got wrong report %+v", report)
+	}
+}
+
+func TestJournalReplayFilterByTimestamp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	j, dir := newTestJournal(t, ctx, WithClock(clock))
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+	var err error
+
+	for id := int64(0); id < 3; id++ {
+		if err = j.WriteData(&Data{ID: id, Key: "key"}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		clock.Add(time.Hour)
+	}
+	// timestamp set by caller, like imported records
+	if err = j.WriteData(&Data{ID: 9, Timestamp: start.Add(-24 * time.Hour)}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	// legacy loader always skip the latest sealed segment
+	for i := 0; i < 2; i++ {
+		if err = j.Rotate(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	var got []*Data
+	if _, err = j.Replay(ctx, func(data *Data) error {
+		got = append(got, data)
+		return nil
+	},
+		WithReplaySince(start.Add(time.Hour)),
+		WithReplayUntil(start.Add(2*time.Hour)),
+	); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(got) != 1 || got[0].ID != 1 ||
+		!got[0].Timestamp.Equal(start.Add(time.Hour)) || got[0].Key != "key" {
+		t.Fatalf("got wrong records %+v", got)
+	}
+
+	got = nil
+	if _, err = j.Replay(ctx, func(data *Data) error {
+		got = append(got, data)
+		return nil
+	}, WithReplayUntil(start)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(got) != 1 || got[0].ID != 9 {
+		t.Fatalf("should replay records by timestamp rather than write time, got %+v", got)
+	}
+}
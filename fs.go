@@ -10,12 +10,12 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	utils "github.com/Laisky/go-utils"
 	"github.com/Laisky/zap"
 	"github.com/coreos/etcd/pkg/fileutil"
 	"github.com/pkg/errors"
@@ -23,21 +23,72 @@ import (
 
 var (
 	// dataFileNameReg journal data file name pattern
-	dataFileNameReg = regexp.MustCompile(`^\d{8}_\d{8}\.buf(.gz)?$`)
+	dataFileNameReg = regexp.MustCompile(`^` + segmentNamePattern + `\.buf(\.gz)?$`)
 	// idsFileNameReg journal id file name pattern
-	idsFileNameReg  = regexp.MustCompile(`^\d{8}_\d{8}\.ids(.gz)?$`)
+	idsFileNameReg  = regexp.MustCompile(`^` + segmentNamePattern + `\.ids(\.gz)?$`)
 	fileGzSuffixReg = regexp.MustCompile(`\.gz$`)
 
-	defaultFileNameTimeLayout = "20060102"
-	// defaultFileNameTimeLayoutWithTZ = "20060102-0700"
+	defaultFileNameTimeLayout       = "20060102"
+	defaultFileNameTimeLayoutWithTZ = "20060102-0700"
 )
 
 func isFileGZ(fname string) bool {
 	return fileGzSuffixReg.MatchString(fname)
 }
 
+// IsDataFile check whether file name is journal data file
+func IsDataFile(fpath string) bool {
+	return dataFileNameReg.MatchString(filepath.Base(fpath))
+}
+
+// IsIdsFile check whether file name is journal ids file
+func IsIdsFile(fpath string) bool {
+	return idsFileNameReg.MatchString(filepath.Base(fpath))
+}
+
+// SegmentFiles data & ids file paths of segment
+type SegmentFiles struct {
+	Name, DataFile, IdsFile string
+}
+
+// ScanSegments list journal files in buf directory, grouped by segment and sorted by sequence.
+// data file or ids file may be empty if not exists.
+func ScanSegments(dirPath string) (segs []*SegmentFiles, err error) {
+	fs, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read files in dir `%s`", dirPath)
+	}
+
+	idx := map[string]*SegmentFiles{}
+	for _, f := range fs {
+		fname := f.Name()
+		if !IsDataFile(fname) && !IsIdsFile(fname) {
+			continue
+		}
+
+		name := SegmentName(fname)
+		seg, ok := idx[name]
+		if !ok {
+			seg = &SegmentFiles{Name: name}
+			idx[name] = seg
+			segs = append(segs, seg)
+		}
+
+		if IsDataFile(fname) {
+			seg.DataFile = filepath.Join(dirPath, fname)
+		} else {
+			seg.IdsFile = filepath.Join(dirPath, fname)
+		}
+	}
+
+	sort.Slice(segs, func(i, k int) bool {
+		return segmentNameLess(segs[i].Name, segs[k].Name)
+	})
+	return segs, nil
+}
+
 // PrepareDir `mkdir -p`
-func PrepareDir(path string) error {
+func PrepareDir(path string, opts ...ComponentOptionFunc) error {
 	ou := syscall.Umask(0)
 	defer syscall.Umask(ou)
 
@@ -47,7 +98,7 @@ func PrepareDir(path string) error {
 			return errors.Wrapf(err, "create directory `%s` with mod `%d`", path, DirMode)
 		}
 
-		Logger.Info("create new directory", zap.String("path", path))
+		newComponentOption(opts...).logger.Info("create new directory", zap.String("path", path))
 		return nil
 	} else if err != nil {
 		return errors.Wrapf(err, "get stat of path `%s`", path)
@@ -71,8 +122,13 @@ type bufFileStat struct {
 //   then generate new buf files.
 //
 // * if `isScan=false`, keep old buf files, directly generate new file without scan directory.
-func PrepareNewBufFile(dirPath string, oldFsStat *bufFileStat, isScan, isGz bool, sizeBytes int64) (fsStat *bufFileStat, err error) {
-	logger := Logger.With(
+//
+// files are named by `WithComponentSegmentNaming`, or by `GenerateNewBufFName` if not set.
+// files belong to other prefix will be ignored when scanning.
+func PrepareNewBufFile(dirPath string, oldFsStat *bufFileStat, isScan, isGz bool, sizeBytes int64, opts ...ComponentOptionFunc) (fsStat *bufFileStat, err error) {
+	opt := newComponentOption(opts...)
+	naming := opt.naming
+	logger := opt.logger.With(
 		zap.String("dirpath", dirPath),
 		zap.Bool("is_scan", isScan),
 		zap.Bool("is_gz", isGz),
@@ -94,6 +150,10 @@ func PrepareNewBufFile(dirPath string, oldFsStat *bufFileStat, isScan, isGz bool
 		}
 
 		for _, f := range fs {
+			if f.IsDir() {
+				continue
+			}
+
 			_, fname = filepath.Split(f.Name())
 			absFname = path.Join(dirPath, fname)
 
@@ -103,25 +163,33 @@ func PrepareNewBufFile(dirPath string, oldFsStat *bufFileStat, isScan, isGz bool
 				return nil, nil
 			}
 
-			if dataFileNameReg.MatchString(fname) {
-				logger.Debug("find data file", zap.String("file", fname))
-				fsStat.OldDataFnames = append(fsStat.OldDataFnames, absFname)
-				if fname > latestDataFName {
-					latestDataFName = fname
+			if IsDataFile(fname) || IsIdsFile(fname) {
+				if !naming.isOwned(fname) {
+					logger.Debug("skip file of other journal", zap.String("file", fname))
+					continue
 				}
 
-			} else if idsFileNameReg.MatchString(fname) {
-				logger.Debug("find ids file", zap.String("file", fname))
-				fsStat.OldIDsDataFnames = append(fsStat.OldIDsDataFnames, absFname)
-				if fname > latestIDsFName {
-					latestIDsFName = fname
+				if IsDataFile(fname) {
+					logger.Debug("find data file", zap.String("file", fname))
+					fsStat.OldDataFnames = append(fsStat.OldDataFnames, absFname)
+				} else {
+					logger.Debug("find ids file", zap.String("file", fname))
+					fsStat.OldIDsDataFnames = append(fsStat.OldIDsDataFnames, absFname)
 				}
-
+			} else if idMarkFileNameReg.MatchString(fname) ||
+				metaFileNameReg.MatchString(fname) ||
+				manifestFileNameReg.MatchString(fname) {
+				continue
 			} else {
 				logger.Warn("unknown file in buf directory", zap.String("file", fname))
 			}
 		}
 
+		sortFpathsBySegment(fsStat.OldDataFnames)
+		sortFpathsBySegment(fsStat.OldIDsDataFnames)
+		latestDataFName = latestBufFName(fsStat.OldDataFnames, naming)
+		latestIDsFName = latestBufFName(fsStat.OldIDsDataFnames, naming)
+
 		logger.Debug("scan journal files",
 			zap.String("latest_data_file", latestDataFName),
 			zap.String("latest_ids_file", latestIDsFName),
@@ -135,21 +203,27 @@ func PrepareNewBufFile(dirPath string, oldFsStat *bufFileStat, isScan, isGz bool
 
 	// generate new buf data file name
 	// `latestxxxFName` means new buf file name now
-	now := utils.Clock.GetUTCNow()
-	if latestDataFName == "" {
-		latestDataFName = now.Format(defaultFileNameTimeLayout) + "_00000001.buf"
+	now := opt.clock.GetUTCNow()
+	if naming != nil {
+		name := naming.nextName(now, latestDataFName, latestIDsFName)
+		latestDataFName = name + ".buf"
+		latestIDsFName = name + ".ids"
 	} else {
-		if latestDataFName, err = GenerateNewBufFName(now, latestDataFName); err != nil {
-			return nil, errors.Wrapf(err, "generate new data fname `%s`", latestDataFName)
+		if latestDataFName == "" {
+			latestDataFName = now.Format(defaultFileNameTimeLayout) + "_00000001.buf"
+		} else {
+			if latestDataFName, err = GenerateNewBufFName(now, latestDataFName, opts...); err != nil {
+				return nil, errors.Wrapf(err, "generate new data fname `%s`", latestDataFName)
+			}
 		}
-	}
 
-	// generate new buf ids file name
-	if latestIDsFName == "" {
-		latestIDsFName = now.Format(defaultFileNameTimeLayout) + "_00000001.ids"
-	} else {
-		if latestIDsFName, err = GenerateNewBufFName(now, latestIDsFName); err != nil {
-			return nil, errors.Wrapf(err, "generate new ids fname `%s`", latestIDsFName)
+		// generate new buf ids file name
+		if latestIDsFName == "" {
+			latestIDsFName = now.Format(defaultFileNameTimeLayout) + "_00000001.ids"
+		} else {
+			if latestIDsFName, err = GenerateNewBufFName(now, latestIDsFName, opts...); err != nil {
+				return nil, errors.Wrapf(err, "generate new ids fname `%s`", latestIDsFName)
+			}
 		}
 	}
 
@@ -158,11 +232,11 @@ func PrepareNewBufFile(dirPath string, oldFsStat *bufFileStat, isScan, isGz bool
 		latestIDsFName = appendGzSuffix(latestIDsFName)
 	}
 
-	if fsStat.NewDataFp, err = OpenBufFile(filepath.Join(dirPath, latestDataFName), sizeBytes/2); err != nil {
+	if fsStat.NewDataFp, err = OpenBufFile(filepath.Join(dirPath, latestDataFName), sizeBytes/2, opts...); err != nil {
 		return nil, err
 	}
 
-	if fsStat.NewIDsFp, err = OpenBufFile(filepath.Join(dirPath, latestIDsFName), 0); err != nil {
+	if fsStat.NewIDsFp, err = OpenBufFile(filepath.Join(dirPath, latestIDsFName), 0, opts...); err != nil {
 		return nil, err
 	}
 
@@ -172,6 +246,29 @@ func PrepareNewBufFile(dirPath string, oldFsStat *bufFileStat, isScan, isGz bool
 	return fsStat, nil
 }
 
+// sortFpathsBySegment sort journal files by segment sequence
+func sortFpathsBySegment(fpaths []string) {
+	sort.Slice(fpaths, func(i, k int) bool {
+		return segmentNameLess(SegmentName(fpaths[i]), SegmentName(fpaths[k]))
+	})
+}
+
+// latestBufFName return file name of the latest segment in sorted `fpaths`.
+// legacy `GenerateNewBufFName` (nil naming) only understand daily sequence.
+func latestBufFName(fpaths []string, naming *SegmentNaming) string {
+	for i := len(fpaths) - 1; i >= 0; i-- {
+		fname := filepath.Base(fpaths[i])
+		if naming != nil {
+			return fname
+		}
+		if info, err := ParseSegmentName(fname); err == nil && !info.IsGlobalSeq {
+			return fname
+		}
+	}
+
+	return ""
+}
+
 func appendGzSuffix(fname string) string {
 	if !strings.HasSuffix(strings.ToLower(fname), ".gz") {
 		fname += ".gz"
@@ -181,8 +278,8 @@ func appendGzSuffix(fname string) string {
 }
 
 // OpenBufFile create and open file
-func OpenBufFile(filepath string, preallocateBytes int64) (fp *os.File, err error) {
-	Logger.Debug("create file with preallocate",
+func OpenBufFile(filepath string, preallocateBytes int64, opts ...ComponentOptionFunc) (fp *os.File, err error) {
+	newComponentOption(opts...).logger.Debug("create file with preallocate",
 		zap.Int64("preallocate", preallocateBytes),
 		zap.String("file", filepath))
 	if fp, err = os.OpenFile(filepath, os.O_RDWR|os.O_CREATE, FileMode); err != nil {
@@ -200,8 +297,8 @@ func OpenBufFile(filepath string, preallocateBytes int64) (fp *os.File, err erro
 
 // GenerateNewBufFName return new buf file name depends on current time
 // file name looks like `yyyymmddnnnn.ids`, nnnn begin from 0001 for each day
-func GenerateNewBufFName(now time.Time, oldFName string) (string, error) {
-	Logger.Debug("GenerateNewBufFName", zap.Time("now", now), zap.String("oldFName", oldFName))
+func GenerateNewBufFName(now time.Time, oldFName string, opts ...ComponentOptionFunc) (string, error) {
+	newComponentOption(opts...).logger.Debug("GenerateNewBufFName", zap.Time("now", now), zap.String("oldFName", oldFName))
 	finfo := strings.SplitN(oldFName, ".", 2) // {name, ext}
 	if len(finfo) < 2 {
 		return oldFName, fmt.Errorf("oldFname `%s` not correct", oldFName)
@@ -221,3 +318,45 @@ func GenerateNewBufFName(now time.Time, oldFName string) (string, error) {
 
 	return fmt.Sprintf("%s_%08d.%s", fts, idx+1, fext), nil
 }
+
+// writeFileAtomic replace file content by write temp file, fsync then rename
+func writeFileAtomic(fpath string, content []byte) (err error) {
+	tmpFpath := fpath + ".tmp"
+	fp, err := os.OpenFile(tmpFpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FileMode)
+	if err != nil {
+		return errors.Wrapf(err, "open temp file `%s`", tmpFpath)
+	}
+
+	if _, err = fp.Write(content); err != nil {
+		fp.Close()
+		return errors.Wrapf(err, "write temp file `%s`", tmpFpath)
+	}
+	if err = fileutil.Fsync(fp); err != nil {
+		fp.Close()
+		return errors.Wrapf(err, "fsync temp file `%s`", tmpFpath)
+	}
+	if err = fp.Close(); err != nil {
+		return errors.Wrapf(err, "close temp file `%s`", tmpFpath)
+	}
+
+	if err = os.Rename(tmpFpath, fpath); err != nil {
+		return errors.Wrapf(err, "rename `%s` to `%s`", tmpFpath, fpath)
+	}
+
+	return fsyncDir(filepath.Dir(fpath))
+}
+
+// fsyncDir fsync directory to persist entries changes
+func fsyncDir(dirPath string) (err error) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return errors.Wrapf(err, "open dir `%s`", dirPath)
+	}
+	defer dir.Close()
+
+	if err = fileutil.Fsync(dir); err != nil {
+		return errors.Wrapf(err, "fsync dir `%s`", dirPath)
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package journal
+
+// id.go
+// persistent monotonic id allocator.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	idMarkFileSuffix = ".idmark"
+)
+
+var (
+	// idMarkFileNameReg id allocator's high-water mark file name pattern
+	idMarkFileNameReg = regexp.MustCompile(`\.idmark(\.tmp)?$`)
+)
+
+// idMarkFpath return path of id mark file of journal,
+// journals sharing directory are distinguished by prefix of segment naming.
+func idMarkFpath(dir, name, prefix string) string {
+	if prefix == "" {
+		return filepath.Join(dir, name+idMarkFileSuffix)
+	}
+
+	return filepath.Join(dir, name+"-"+prefix+idMarkFileSuffix)
+}
+
+// idAllocator allocate unique and increasing ids.
+//
+// ids are reserved by block, only the high-water mark of reserved blocks
+// will be persisted, so ids allocated after restart always bigger than
+// any id allocated before, without scanning ids files.
+type idAllocator struct {
+	sync.Mutex
+	logger *utils.LoggerType
+
+	fpath     string
+	blockSize int64
+	// next, ceiling ids in [next, ceiling) are reserved but not allocated
+	next, ceiling int64
+}
+
+// newIDAllocator load high-water mark from `fpath`.
+// if mark file not exists, will invoke `loadMaxID` to recover the starting point.
+func newIDAllocator(logger *utils.LoggerType,
+	fpath string,
+	blockSize int64,
+	loadMaxID func() (int64, error),
+) (a *idAllocator, err error) {
+	a = &idAllocator{
+		logger:    logger,
+		fpath:     fpath,
+		blockSize: blockSize,
+	}
+
+	var mark int64
+	if mark, err = a.loadMark(); os.IsNotExist(errors.Cause(err)) {
+		a.logger.Info("id mark file not exists, load max id from ids files",
+			zap.String("file", fpath))
+		if mark, err = loadMaxID(); err != nil {
+			return nil, errors.Wrap(err, "load max id")
+		}
+		mark++
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "load id mark from `%s`", fpath)
+	}
+
+	a.next, a.ceiling = mark, mark
+	a.logger.Info("new id allocator",
+		zap.String("file", fpath),
+		zap.Int64("next", a.next),
+		zap.Int64("block_size", blockSize))
+	return a, nil
+}
+
+// loadMark read persisted high-water mark
+func (a *idAllocator) loadMark() (mark int64, err error) {
+	cnt, err := ioutil.ReadFile(a.fpath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "read file `%s`", a.fpath)
+	}
+	if len(cnt) != 8 {
+		return 0, fmt.Errorf("id mark file `%s` corrupted, got %d bytes", a.fpath, len(cnt))
+	}
+
+	return int64(bitOrder.Uint64(cnt)), nil
+}
+
+// saveMark persist high-water mark
+func (a *idAllocator) saveMark(mark int64) error {
+	cnt := make([]byte, 8)
+	bitOrder.PutUint64(cnt, uint64(mark))
+	return writeFileAtomic(a.fpath, cnt)
+}
+
+// Next return next id, will reserve new block if current block exhausted
+func (a *idAllocator) Next() (id int64, err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.next >= a.ceiling {
+		ceiling := a.next + a.blockSize
+		if err = a.saveMark(ceiling); err != nil {
+			return 0, errors.Wrapf(err, "reserve ids block until `%d`", ceiling)
+		}
+
+		a.logger.Debug("reserve new ids block",
+			zap.Int64("from", a.next),
+			zap.Int64("to", ceiling))
+		a.ceiling = ceiling
+	}
+
+	id = a.next
+	a.next++
+	return id, nil
+}
@@ -0,0 +1,147 @@
+package journal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIDAllocator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-id")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	fpath := filepath.Join(dir, "test"+idMarkFileSuffix)
+	loadMaxID := func() (int64, error) { return 100, nil }
+	a, err := newIDAllocator(Logger, fpath, 10, loadMaxID)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var id, lastID int64
+	for i := 0; i < 25; i++ {
+		if id, err = a.Next(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if i == 0 && id != 101 {
+			t.Fatalf("expect first id 101, got %v", id)
+		}
+		if i != 0 && id != lastID+1 {
+			t.Fatalf("expect %v, got %v", lastID+1, id)
+		}
+		lastID = id
+	}
+
+	// restart, should not scan ids files
+	loadMaxID = func() (int64, error) {
+		t.Fatal("should not load max id")
+		return 0, nil
+	}
+	if a, err = newIDAllocator(Logger, fpath, 10, loadMaxID); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if id, err = a.Next(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if id <= lastID {
+		t.Fatalf("id after restart should bigger than %v, got %v", lastID, id)
+	}
+}
+
+func TestJournalNextID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-nextid")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	j, err := NewJournal(
+		WithBufDirPath(dir),
+		WithIDBlockSize(3),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = j.NextID(); err == nil {
+		t.Fatal("should not allocate id before start")
+	}
+	if err = j.Start(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var lastID int64
+	for i := 0; i < 10; i++ {
+		id, err := j.NextID()
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if id <= lastID {
+			t.Fatalf("id should increase, got %v after %v", id, lastID)
+		}
+		lastID = id
+	}
+	j.Close(ctx)
+}
+
+func TestJournalNextIDAfterUncommitted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-nextid-uncommitted")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := func() *Journal {
+		j, err := NewJournal(WithBufDirPath(dir))
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = j.Start(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		return j
+	}
+
+	j := start()
+	if err = j.WriteData(&Data{ID: 100}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.WriteId(5); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Rotate(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.WriteData(&Data{ID: 200}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	j.Close(ctx)
+
+	// no id allocated, so there is no id mark,
+	// and only the first segment has meta
+	if _, err = os.Stat(filepath.Join(dir, defaultName+idMarkFileSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("id mark should not exist, got %+v", err)
+	}
+
+	j = start()
+	defer j.Close(ctx)
+	id, err := j.NextID()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if id <= 200 {
+		t.Fatalf("id should bigger than uncommitted ids, got %d", id)
+	}
+}
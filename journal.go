@@ -2,9 +2,12 @@ package journal
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	utils "github.com/Laisky/go-utils"
@@ -22,6 +25,31 @@ func init() {
 	}
 }
 
+// journalState lifecycle state of journal
+type journalState int32
+
+const (
+	journalStateNew journalState = iota
+	journalStateStarted
+	journalStateClosing
+	journalStateClosed
+)
+
+func (s journalState) String() string {
+	switch s {
+	case journalStateNew:
+		return "new"
+	case journalStateStarted:
+		return "started"
+	case journalStateClosing:
+		return "closing"
+	case journalStateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
 // Journal redo log consist by msgs and committed ids
 type Journal struct {
 	// RWMutex journal rwlock.
@@ -30,22 +58,46 @@ type Journal struct {
 	sync.RWMutex
 	*option
 
-	stopChan               chan struct{}
+	// stateLock serialize state transitions of `Start` & `Close`
+	stateLock sync.Mutex
+	state     int32 // journalState
+	// wg background goroutines
+	wg sync.WaitGroup
+	// stopChan closed when start closing
+	stopChan chan struct{}
+	// closedChan closed after journal closed
+	closedChan chan struct{}
+	closeErr   error
+	// cleanChan trigger removing consumed segments in background
+	cleanChan chan struct{}
+
 	rotateLock, legacyLock *utils.Mutex
 	dataFp, idsFp          *os.File // current writting journal file
 	fsStat                 *bufFileStat
+	manifest               *Manifest
 	legacy                 *LegacyLoader
 	dataEnc                *DataEncoder
 	idsEnc                 *IdsEncoder
+	idAlloc                *idAllocator
+	subs                   *subscribers
 	lastRotateAt           time.Time
+	// deadLetters journal of records failed all attempts, nil if not enabled
+	deadLetters *Journal
+
+	// pendingEvents events emitted with write lock held, sent to hooks by `Unlock`
+	pendingEvents     []*Event
+	pendingEventsLock sync.Mutex
 }
 
 // NewJournal create new Journal
 func NewJournal(opts ...OptionFunc) (j *Journal, err error) {
 	j = &Journal{
 		stopChan:   make(chan struct{}),
+		closedChan: make(chan struct{}),
+		cleanChan:  make(chan struct{}, 1),
 		rotateLock: utils.NewMutex(),
 		legacyLock: utils.NewMutex(),
+		subs:       newSubscribers(),
 		option:     newOption(),
 	}
 
@@ -54,37 +106,158 @@ func NewJournal(opts ...OptionFunc) (j *Journal, err error) {
 			return nil, err
 		}
 	}
+	if j.isDirectIO && j.isCompress {
+		return nil, fmt.Errorf("direct io could not be used with compress")
+	}
+	if j.metrics == nil {
+		j.metrics = NewMemoryMetrics(map[string]string{"journal": j.name})
+	}
+	if j.rotatePolicy == nil {
+		j.rotatePolicy = defaultRotatePolicy(j.bufSizeBytes, j.rotateDuration)
+	}
 
 	j.logger.Info("new journal",
 		zap.String("bufDirPath", j.bufDirPath),
 		zap.Int64("bufSizeBytes", j.bufSizeBytes),
 		zap.Bool("isAggresiveGC", j.isAggresiveGC),
 		zap.Bool("isCompress", j.isCompress),
+		zap.Bool("isDirectIO", j.isDirectIO),
+		zap.Bool("isMmapReplay", j.isMmapReplay),
 		zap.Duration("flushInterval", j.flushInterval),
 		zap.Duration("rotateDuration", j.rotateDuration),
 		zap.Duration("rotateCheckInterval", j.rotateCheckInterval),
 		zap.Duration("committedIDTTL", j.committedIDTTL),
+		zap.Int64("idBlockSize", j.idBlockSize),
+		zap.Int("deadLetterMaxAttempts", j.deadLetterMaxAttempts),
 	)
 	return j, nil
 }
 
+// Start open buf files and run background goroutines,
+// could only be called once.
 func (j *Journal) Start(ctx context.Context) (err error) {
+	j.stateLock.Lock()
+	defer j.stateLock.Unlock()
+	switch state := j.getState(); state {
+	case journalStateNew:
+	case journalStateClosing, journalStateClosed:
+		return ErrClosed
+	default:
+		return fmt.Errorf("journal is %s", state)
+	}
+
 	if err = j.initBufDir(ctx); err != nil {
 		return errors.Wrap(err, "init buf directory")
 	}
 
-	go j.startFlushTrigger(ctx)
-	go j.startRotateTrigger(ctx)
+	if j.idAlloc, err = newIDAllocator(
+		j.logger,
+		idMarkFpath(j.bufDirPath, j.name, j.naming.prefixOf()),
+		j.idBlockSize,
+		j.loadMaxAllocatedID,
+	); err != nil {
+		return errors.Wrap(err, "create id allocator")
+	}
+	if err = j.startDeadLetters(ctx); err != nil {
+		return errors.Wrap(err, "start dead letters")
+	}
+
+	j.setState(journalStateStarted)
+	j.goBackground(func() { j.startFlushTrigger(ctx) })
+	j.goBackground(func() { j.startRotateTrigger(ctx) })
+	j.goBackground(func() { j.startCleanTrigger(ctx) })
+	// segments consumed in last run are removed in background,
+	// archiving may take long time
+	j.triggerClean()
 	return
 }
 
-func (j *Journal) Close() {
-	j.logger.Info("close Journal")
+func (j *Journal) getState() journalState {
+	return journalState(atomic.LoadInt32(&j.state))
+}
+
+func (j *Journal) setState(state journalState) {
+	atomic.StoreInt32(&j.state, int32(state))
+}
+
+// goBackground run f in goroutine, `Close` will wait it exit
+func (j *Journal) goBackground(f func()) {
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		f()
+	}()
+}
+
+// checkWritable return error if journal is not writable, should hold read lock
+func (j *Journal) checkWritable() error {
+	switch j.getState() {
+	case journalStateStarted:
+		return nil
+	case journalStateNew:
+		return fmt.Errorf("journal not started")
+	default:
+		return ErrClosed
+	}
+}
+
+// Close stop all background goroutines, then flush and close files.
+// writing after close will get `ErrClosed`.
+//
+// it is safe to call Close multiple times, all of them wait until journal closed,
+// return error if ctx done before that, shutdown will continue in background.
+func (j *Journal) Close(ctx context.Context) error {
+	j.stateLock.Lock()
+	switch j.getState() {
+	case journalStateNew:
+		j.setState(journalStateClosed)
+		close(j.stopChan)
+		close(j.closedChan)
+	case journalStateStarted:
+		j.logger.Info("close Journal")
+		j.setState(journalStateClosing)
+		close(j.stopChan)
+		go j.shutdown()
+	}
+	j.stateLock.Unlock()
+
+	select {
+	case <-j.closedChan:
+		return j.closeErr
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "wait journal closed")
+	}
+}
+
+// shutdown wait background goroutines exit, then close files
+func (j *Journal) shutdown() {
+	j.wg.Wait()
 
 	j.Lock()
-	j.Flush()
-	j.stopChan <- struct{}{}
+	if err := j.flushAndClose(); err != nil {
+		j.closeErr = errors.Wrap(err, "flush and close journal")
+	}
+	j.dataEnc, j.idsEnc = nil, nil
+	if j.dataFp != nil {
+		j.dataFp.Close()
+	}
+	if j.idsFp != nil {
+		j.idsFp.Close()
+	}
+	if j.legacy != nil {
+		j.legacy.Close()
+	}
+	j.setState(journalStateClosed)
 	j.Unlock()
+
+	if j.deadLetters != nil {
+		if err := j.deadLetters.Close(context.Background()); err != nil && j.closeErr == nil {
+			j.closeErr = errors.Wrap(err, "close dead-letter journal")
+		}
+	}
+
+	j.logger.Info("journal closed", zap.Error(j.closeErr))
+	close(j.closedChan)
 }
 
 // initBufDir initialize buf directory and create buf files
@@ -93,6 +266,14 @@ func (j *Journal) initBufDir(ctx context.Context) (err error) {
 		return errors.Wrapf(err, "cannot write to `%s`", j.bufDirPath)
 	}
 
+	if j.manifest, err = openManifest(j.logger, j.clock, j.bufDirPath, j.naming.prefixOf(), j.archive); err != nil {
+		return errors.Wrapf(err, "open manifest in `%s`", j.bufDirPath)
+	}
+	j.manifest.onClean = j.emit
+	if j.naming != nil {
+		j.naming.last = j.manifest.GetLastSegment()
+	}
+
 	if err = j.Rotate(ctx); err != nil { // manually first run
 		return errors.Wrapf(err, "init rotate in `%s`", j.bufDirPath)
 	}
@@ -102,6 +283,7 @@ func (j *Journal) initBufDir(ctx context.Context) (err error) {
 
 // Flush flush journal files buffer to file
 func (j *Journal) Flush() (err error) {
+	defer observeLatency(j.metrics, metricFlushLatency, time.Now())
 	if j.idsEnc != nil {
 		// j.logger.Debug("flush ids")
 		if err = j.idsEnc.Flush(); err != nil {
@@ -141,7 +323,11 @@ func (j *Journal) startFlushTrigger(ctx context.Context) {
 	j.logger.Info("start flush trigger", zap.Duration("interval", j.flushInterval))
 	defer j.logger.Info("journal flush exit")
 
-	defer j.Flush()
+	defer func() {
+		j.Lock()
+		j.Flush()
+		j.Unlock()
+	}()
 	var err error
 	ticker := time.NewTicker(j.flushInterval)
 	defer ticker.Stop()
@@ -155,8 +341,10 @@ func (j *Journal) startFlushTrigger(ctx context.Context) {
 			j.Lock()
 			if err = j.Flush(); err != nil {
 				j.logger.Error("flush journal", zap.Error(err))
+				j.emitLocked(&Event{Type: EventFlushError, Err: err})
 			}
 			j.Unlock()
+			j.collectMetrics()
 		}
 	}
 }
@@ -178,41 +366,145 @@ func (j *Journal) startRotateTrigger(ctx context.Context) {
 			if j.isReadyToRotate() {
 				if err = j.Rotate(ctx); err != nil {
 					j.logger.Error("trigger rotate", zap.Error(err))
+					j.emit(&Event{Type: EventRotateError, Err: err})
 				}
 			}
 		}
 	}
 }
 
+// loadMaxAllocatedID load max id ever written into data or ids files,
+// records may not be committed when crashed, so ids files alone are not enough
+func (j *Journal) loadMaxAllocatedID() (int64, error) {
+	maxID, err := j.legacy.LoadMaxId()
+	if err != nil {
+		return 0, err
+	}
+	maxDataID, err := j.legacy.LoadMaxDataId()
+	if err != nil {
+		return 0, err
+	}
+	if maxDataID > maxID {
+		maxID = maxDataID
+	}
+
+	return maxID, nil
+}
+
 // LoadMaxId load max id from journal ids files
 func (j *Journal) LoadMaxId() (int64, error) {
 	return j.legacy.LoadMaxId()
 }
 
-// WriteData write data to journal
+// NextID allocate new id for `Data.ID`.
+// ids are unique and increasing, even across restarts.
+func (j *Journal) NextID() (int64, error) {
+	if j.idAlloc == nil {
+		return 0, fmt.Errorf("journal not started")
+	}
+
+	return j.idAlloc.Next()
+}
+
+// WriteData write data to journal,
+// record is written with write time if `data.Timestamp` is zero, `data` is not modified.
 func (j *Journal) WriteData(data *Data) (err error) {
-	j.RLock() // will blocked by flush & rotate
+	return j.WriteDataCtx(context.Background(), data)
+}
+
+// WriteDataCtx write data to journal, stop waiting flush & rotate if ctx done.
+//
+// return error satisfied `errors.Is(err, ErrDuringRotate)` if ctx done during rotating,
+// or `*IOError` if failed to write file.
+func (j *Journal) WriteDataCtx(ctx context.Context, data *Data) (err error) {
+	start := time.Now()
+	if err = j.rlockCtx(ctx); err != nil { // will blocked by flush & rotate
+		return err
+	}
 	defer j.RUnlock()
+	if err = j.checkWritable(); err != nil {
+		return err
+	}
 
 	if j.legacy.CheckAndRemove(data.ID) {
 		return
 	}
 
 	// j.logger.Debug("write data", zap.Int64("id", GetId(*data)))
-	return j.dataEnc.Write(data)
+	var (
+		n  int64
+		ts time.Time
+	)
+	if n, ts, err = j.dataEnc.writeN(data); err != nil {
+		return &IOError{Op: "write data", Err: err}
+	}
+
+	j.metrics.AddCounter(metricRecordsWritten, 1)
+	j.metrics.AddCounter(metricBytesWritten, float64(n))
+	observeLatency(j.metrics, metricWriteLatency, start)
+	j.publish(data, ts)
+	return nil
 }
 
 // WriteId write id to journal
-func (j *Journal) WriteId(id int64) error {
-	j.RLock() // will blocked by flush & rotate
+func (j *Journal) WriteId(id int64) (err error) {
+	return j.WriteIdCtx(context.Background(), id)
+}
+
+// WriteIdCtx write id to journal, stop waiting flush & rotate if ctx done.
+// errors are the same as `WriteDataCtx`.
+func (j *Journal) WriteIdCtx(ctx context.Context, id int64) (err error) {
+	if err = j.rlockCtx(ctx); err != nil { // will blocked by flush & rotate
+		return err
+	}
 	defer j.RUnlock()
+	if err = j.checkWritable(); err != nil {
+		return err
+	}
 
 	j.legacy.AddID(id)
-	return j.idsEnc.Write(id)
+	if err = j.idsEnc.Write(id); err != nil {
+		return &IOError{Op: "write id", Err: err}
+	}
+
+	j.metrics.AddCounter(metricIdsWritten, 1)
+	return nil
 }
 
-// isReadyToRotate check whether is ready to start rotate.
-// file size bigger `bufSizeBytes` or existing time logger than `rotateDuration`
+// rlockCtx acquire read lock, give up if ctx done before acquired
+func (j *Journal) rlockCtx(ctx context.Context) error {
+	if ctx.Done() == nil { // never canceled
+		j.RLock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		j.RLock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		// release lock once acquired
+		go func() {
+			<-acquired
+			j.RUnlock()
+		}()
+
+		if j.rotateLock.IsLocked() {
+			return errors.Wrap(ErrDuringRotate, ctx.Err().Error())
+		}
+		return errors.Wrap(ctx.Err(), "wait journal lock")
+	}
+}
+
+// isReadyToRotate check whether is ready to start rotate by `rotatePolicy`
 func (j *Journal) isReadyToRotate() (ok bool) {
 	j.RLock()
 	defer j.RUnlock()
@@ -221,19 +513,32 @@ func (j *Journal) isReadyToRotate() (ok bool) {
 		return true
 	}
 
-	if fi, err := j.dataFp.Stat(); err != nil {
+	stat := &RotateStat{
+		Records:   j.dataEnc.count(),
+		CreatedAt: j.lastRotateAt,
+		Now:       j.clock.GetUTCNow(),
+	}
+	fi, err := j.dataFp.Stat()
+	if err != nil {
+		j.logger.Error("try to get file stat got error", zap.Error(err))
+		return false
+	}
+	stat.DataBytes = fi.Size()
+	if fi, err = j.idsFp.Stat(); err != nil {
 		j.logger.Error("try to get file stat got error", zap.Error(err))
-		ok = false
-	} else if fi.Size() > j.bufSizeBytes ||
-		utils.Clock.GetUTCNow().Sub(j.lastRotateAt) > j.rotateDuration {
-		ok = true
+		return false
 	}
+	stat.IdsBytes = fi.Size()
 
+	ok = j.rotatePolicy.ShouldRotate(stat)
 	j.logger.Debug("check isReadyToRotate",
 		zap.Bool("ready", ok),
 		zap.String("old_file", j.dataFp.Name()),
+		zap.Int64("data_bytes", stat.DataBytes),
+		zap.Int64("ids_bytes", stat.IdsBytes),
+		zap.Int64("records", stat.Records),
 	)
-	return
+	return ok
 }
 
 // Rotate create new data and ids buf file.
@@ -250,7 +555,12 @@ func (j *Journal) Rotate(ctx context.Context) (err error) {
 	j.Lock()
 	defer j.Unlock()
 	j.logger.Debug("starting to rotate")
+	return j.rotate(ctx)
+}
 
+// rotate seal current files and create new files,
+// should hold `rotateLock` and write lock.
+func (j *Journal) rotate(ctx context.Context) (err error) {
 	select {
 	case <-j.stopChan:
 		return
@@ -259,30 +569,47 @@ func (j *Journal) Rotate(ctx context.Context) (err error) {
 	default:
 	}
 
+	start := time.Now()
+	defer func() {
+		if err == nil {
+			j.metrics.AddCounter(metricRotations, 1)
+			observeLatency(j.metrics, metricRotateLatency, start)
+			j.collectSegmentMetrics()
+		}
+	}()
+
 	if err = j.flushAndClose(); err != nil {
 		return errors.Wrap(err, "flush and close journal")
 	}
+	if j.dataFp != nil {
+		j.sealSegment()
+	}
 
-	j.lastRotateAt = utils.Clock.GetUTCNow()
+	j.lastRotateAt = j.clock.GetUTCNow()
 	// scan and create files
+	// acquired legacy lock means that there is no one reading legacy
+	// no need to scan old buf files, segments are tracked by manifest
+	if j.fsStat, err = PrepareNewBufFile(j.bufDirPath, j.fsStat, false, j.isCompress, j.bufSizeBytes,
+		append(j.componentOpts(), WithComponentSegmentNaming(j.naming))...); err != nil {
+		return errors.Wrap(err, "prepare new buf file")
+	}
+	if err = j.manifest.AddActive(j.fsStat.NewDataFp.Name(), j.fsStat.NewIDsFp.Name()); err != nil {
+		return errors.Wrap(err, "add active segment into manifest")
+	}
+	j.emitLocked(&Event{
+		Type:    EventRotate,
+		Segment: SegmentName(j.fsStat.NewDataFp.Name()),
+		Files:   []string{j.fsStat.NewDataFp.Name(), j.fsStat.NewIDsFp.Name()},
+	})
+
 	// acquired legacy lock means that there is no one reading legacy
 	if j.LockLegacy() {
-		j.logger.Debug("acquired legacy lock, create new file and refresh legacy loader",
+		j.logger.Debug("acquired legacy lock, refresh legacy loader",
 			zap.String("dir", j.bufDirPath))
-		// need to refresh legacy, so need scan=true
-		if j.fsStat, err = PrepareNewBufFile(j.bufDirPath, j.fsStat, true, j.isCompress, j.bufSizeBytes); err != nil {
-			j.UnLockLegacy()
-			return errors.Wrap(err, "prepare new buf file")
-		}
-
-		j.refreshLegacyLoader(ctx)
+		err = j.refreshLegacyLoader(ctx)
 		j.UnLockLegacy()
-	} else {
-		j.logger.Debug("not acquired legacy lock, so only create new file",
-			zap.String("dir", j.bufDirPath))
-		// no need to scan old buf files
-		if j.fsStat, err = PrepareNewBufFile(j.bufDirPath, j.fsStat, false, j.isCompress, j.bufSizeBytes); err != nil {
-			return errors.Wrap(err, "prepare new buf file")
+		if err != nil {
+			return errors.Wrap(err, "refresh legacy loader")
 		}
 	}
 
@@ -291,7 +618,17 @@ func (j *Journal) Rotate(ctx context.Context) (err error) {
 		j.dataFp.Close()
 	}
 	j.dataFp = j.fsStat.NewDataFp
-	if j.dataEnc, err = NewDataEncoder(j.dataFp, j.isCompress); err != nil {
+	if j.isDirectIO {
+		if j.dataFp, err = openDirectFile(j.fsStat.NewDataFp.Name()); err != nil {
+			return err
+		}
+		j.fsStat.NewDataFp.Close()
+		j.fsStat.NewDataFp = j.dataFp
+		j.dataEnc, err = NewDirectIODataEncoder(j.dataFp, j.componentOpts()...)
+	} else {
+		j.dataEnc, err = NewDataEncoder(j.dataFp, j.isCompress, j.componentOpts()...)
+	}
+	if err != nil {
 		return errors.Wrapf(err, "create new data encoder `%s`", j.dataFp.Name())
 	}
 
@@ -300,35 +637,139 @@ func (j *Journal) Rotate(ctx context.Context) (err error) {
 		j.idsFp.Close()
 	}
 	j.idsFp = j.fsStat.NewIDsFp
-	if j.idsEnc, err = NewIdsEncoder(j.idsFp, j.isCompress); err != nil {
+	if j.idsEnc, err = NewIdsEncoder(j.idsFp, j.isCompress, j.componentOpts()...); err != nil {
 		return errors.Wrapf(err, "create new ids encoder `%s`", j.idsFp.Name())
 	}
 
 	return nil
 }
 
-// refreshLegacyLoader create or reset legacy loader
-func (j *Journal) refreshLegacyLoader(ctx context.Context) {
+// sealSegment save statistics of current data & ids files into sidecar meta file
+func (j *Journal) sealSegment() {
+	meta := newSegmentMeta(j.dataFp.Name(), j.idsFp.Name(), j.dataEnc, j.idsEnc, j.clock.GetUTCNow())
+	if err := SaveSegmentMeta(j.bufDirPath, meta); err != nil {
+		// meta only used to speed up, could fallback to decode whole file
+		j.logger.Error("save segment meta", zap.Error(err), zap.String("segment", meta.Name))
+	}
+	if err := j.manifest.Seal(meta.Name, meta); err != nil {
+		j.logger.Error("seal segment in manifest", zap.Error(err), zap.String("segment", meta.Name))
+		return
+	}
+	j.emitLocked(&Event{
+		Type:    EventSeal,
+		Segment: meta.Name,
+		Files:   []string{j.dataFp.Name(), j.idsFp.Name()},
+		Size:    meta.DataBytes + meta.IdsBytes,
+		Meta:    meta,
+	})
+
+	j.logger.Debug("seal segment",
+		zap.String("segment", meta.Name),
+		zap.Int64("records", meta.Records),
+		zap.Int64("min_id", meta.MinID),
+		zap.Int64("max_id", meta.MaxID))
+}
+
+// FindSegmentsByID return sealed segments that may contain data id
+func (j *Journal) FindSegmentsByID(id int64) (metas []*SegmentMeta, err error) {
+	allMetas, err := LoadSegmentMetas(j.bufDirPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "load segment metas")
+	}
+
+	for _, m := range allMetas {
+		if m.ContainsID(id) {
+			metas = append(metas, m)
+		}
+	}
+
+	return metas, nil
+}
+
+// refreshLegacyLoader create or reset legacy loader by sealed segments in manifest
+func (j *Journal) refreshLegacyLoader(ctx context.Context) (err error) {
 	j.logger.Debug("call refreshLegacyLoader")
+	dataFnames, idsFnames := j.manifest.Files(SegmentSealed, SegmentReplaying)
+	if err = j.manifest.Transit(SegmentReplaying, segmentNames(dataFnames)...); err != nil {
+		return errors.Wrap(err, "mark segments replaying")
+	}
+
 	if j.legacy == nil {
 		j.logger.Debug("create new LegacyLoader",
-			zap.Strings("data_files", j.fsStat.OldDataFnames),
-			zap.Strings("ids_files", j.fsStat.OldIDsDataFnames),
+			zap.Strings("data_files", dataFnames),
+			zap.Strings("ids_files", idsFnames),
 		)
 		j.legacy = NewLegacyLoader(
 			ctx,
 			j.logger,
-			j.fsStat.OldDataFnames,
-			j.fsStat.OldIDsDataFnames,
+			dataFnames,
+			idsFnames,
 			j.isCompress,
 			j.committedIDTTL,
+			j.componentOpts()...,
 		)
+		j.legacy.metrics = j.metrics
+		j.legacy.isMmap = j.isMmapReplay
+		j.legacy.eventHooks = j.eventHooks
+		j.legacy.archive = j.archive
 	} else {
-		j.legacy.Reset(j.fsStat.OldDataFnames, j.fsStat.OldIDsDataFnames)
+		j.legacy.Reset(dataFnames, idsFnames)
 		if j.isAggresiveGC {
 			utils.TriggerGC()
 		}
 	}
+
+	return nil
+}
+
+// cleanLegacy mark replayed segments as consumed,
+// then archive & remove their files in background, so writing is not blocked by archiving.
+// consumed segments will be removed next time if crashed before that.
+func (j *Journal) cleanLegacy() (err error) {
+	dataFnames, idsFnames := j.legacy.cleanableFiles()
+	names := segmentNames(append(dataFnames, idsFnames...))
+	if err = j.manifest.Transit(SegmentConsumed, names...); err != nil {
+		return errors.Wrap(err, "mark segments consumed")
+	}
+	j.legacy.release()
+	j.triggerClean()
+	return nil
+}
+
+// triggerClean remove consumed segments in background
+func (j *Journal) triggerClean() {
+	select {
+	case j.cleanChan <- struct{}{}:
+	default: // already triggered
+	}
+}
+
+// startCleanTrigger remove consumed segments when triggered by `cleanLegacy`,
+// archiving is canceled when journal closing.
+func (j *Journal) startCleanTrigger(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-j.stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-j.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		case <-j.cleanChan:
+			if err := j.manifest.removeConsumedCtx(ctx, j.logger); err != nil {
+				j.logger.Error("remove consumed segments", zap.Error(err))
+			}
+			j.collectSegmentMetrics()
+		}
+	}
 }
 
 // LockLegacy lock legacy to prevent rotate, clean
@@ -351,9 +792,185 @@ func (j *Journal) UnLockLegacy() bool {
 
 // GetMetric monitor inteface
 func (j *Journal) GetMetric() map[string]interface{} {
-	return map[string]interface{}{
-		"idsSetLen": j.legacy.GetIdsLen(),
+	j.collectMetrics()
+	m := map[string]interface{}{
+		"idsSetLen": 0,
+	}
+	if legacy := j.getLegacy(); legacy != nil {
+		m["idsSetLen"] = legacy.GetIdsLen()
+	}
+	if getter, ok := j.metrics.(interface{ GetValues() map[string]float64 }); ok {
+		for name, v := range getter.GetValues() {
+			m[name] = v
+		}
+	}
+
+	return m
+}
+
+// JournalStatus runtime status of journal
+type JournalStatus struct {
+	Name            string               `json:"name"`
+	State           string               `json:"state"`
+	BufDirPath      string               `json:"buf_dir_path"`
+	ActiveDataFile  string               `json:"active_data_file"`
+	ActiveIdsFile   string               `json:"active_ids_file"`
+	Position        Position             `json:"position"`
+	LastRotateAt    time.Time            `json:"last_rotate_at"`
+	IsLegacyRunning bool                 `json:"is_legacy_running"`
+	IdsSetLen       int                  `json:"ids_set_len"`
+	Segments        map[SegmentState]int `json:"segments"`
+	Subscribers     int                  `json:"subscribers"`
+}
+
+// Status return runtime status of journal
+func (j *Journal) Status() *JournalStatus {
+	j.RLock()
+	st := &JournalStatus{
+		Name:            j.name,
+		State:           j.getState().String(),
+		BufDirPath:      j.bufDirPath,
+		Position:        j.currentPosition(),
+		LastRotateAt:    j.lastRotateAt,
+		IsLegacyRunning: j.legacyLock.IsLocked(),
+		Segments:        map[SegmentState]int{},
+	}
+	if j.dataFp != nil {
+		st.ActiveDataFile = j.dataFp.Name()
+	}
+	if j.idsFp != nil {
+		st.ActiveIdsFile = j.idsFp.Name()
+	}
+	if j.legacy != nil {
+		st.IdsSetLen = j.legacy.GetIdsLen()
+	}
+	if j.manifest != nil {
+		for _, seg := range j.manifest.GetSegments() {
+			st.Segments[seg.State]++
+		}
+	}
+	j.RUnlock()
+
+	j.subs.RLock()
+	st.Subscribers = len(j.subs.subs)
+	j.subs.RUnlock()
+	return st
+}
+
+// directFlushedLen return logical length of records flushed into active data file `fname`
+// written by direct io, return false if `fname` is not active or not written by direct io.
+func (j *Journal) directFlushedLen(fname string) (n int64, ok bool) {
+	j.RLock()
+	defer j.RUnlock()
+	if j.dataEnc == nil || j.dataFp == nil || filepath.Base(j.dataFp.Name()) != fname {
+		return 0, false
 	}
+
+	return j.dataEnc.flushedLen()
+}
+
+// Metrics return metrics collector of journal
+func (j *Journal) Metrics() MetricsCollector {
+	return j.metrics
+}
+
+// WritePrometheus write journal metrics in prometheus text format,
+// only works if metrics collector implemented `MetricsExporter`.
+func (j *Journal) WritePrometheus(w io.Writer) error {
+	exporter, ok := j.metrics.(MetricsExporter)
+	if !ok {
+		return fmt.Errorf("metrics collector `%T` is not exporter", j.metrics)
+	}
+
+	j.collectMetrics()
+	return exporter.WritePrometheus(w)
+}
+
+// emit send event to all hooks, should not hold write lock
+func (j *Journal) emit(evt *Event) {
+	if len(j.eventHooks) == 0 {
+		return
+	}
+
+	evt.Time = j.clock.GetUTCNow()
+	emitEvent(j.eventHooks, evt)
+}
+
+// emitLocked queue event emitted with write lock held,
+// it will be sent after write lock released,
+// so hooks could call back into journal without deadlock.
+func (j *Journal) emitLocked(evt *Event) {
+	if len(j.eventHooks) == 0 {
+		return
+	}
+
+	evt.Time = j.clock.GetUTCNow()
+	j.pendingEventsLock.Lock()
+	j.pendingEvents = append(j.pendingEvents, evt)
+	j.pendingEventsLock.Unlock()
+}
+
+// Unlock release write lock, then send events queued while locked
+func (j *Journal) Unlock() {
+	j.RWMutex.Unlock()
+
+	j.pendingEventsLock.Lock()
+	evts := j.pendingEvents
+	j.pendingEvents = nil
+	j.pendingEventsLock.Unlock()
+	for _, evt := range evts {
+		emitEvent(j.eventHooks, evt)
+	}
+}
+
+// getLegacy return legacy loader, return nil if journal not started
+func (j *Journal) getLegacy() *LegacyLoader {
+	j.RLock()
+	defer j.RUnlock()
+	return j.legacy
+}
+
+// collectMetrics update gauges that need to be calculated
+func (j *Journal) collectMetrics() {
+	if legacy := j.getLegacy(); legacy != nil {
+		j.metrics.SetGauge(metricIdsSetSize, float64(legacy.GetIdsLen()))
+	}
+}
+
+// collectSegmentMetrics update gauges of segments on disk
+func (j *Journal) collectSegmentMetrics() {
+	if j.manifest == nil { // not started
+		return
+	}
+
+	var (
+		segs, legacySegs       int
+		diskBytes, legacyBytes int64
+	)
+	for _, seg := range j.manifest.GetSegments() {
+		var size int64
+		for _, fname := range []string{seg.DataFile, seg.IdsFile} {
+			if fname == "" {
+				continue
+			}
+			if fi, err := os.Stat(filepath.Join(j.bufDirPath, fname)); err == nil {
+				size += fi.Size()
+			}
+		}
+
+		segs++
+		diskBytes += size
+		switch seg.State {
+		case SegmentSealed, SegmentReplaying:
+			legacySegs++
+			legacyBytes += size
+		}
+	}
+
+	j.metrics.SetGauge(metricSegments, float64(segs))
+	j.metrics.SetGauge(metricDiskBytes, float64(diskBytes))
+	j.metrics.SetGauge(metricLegacySegments, float64(legacySegs))
+	j.metrics.SetGauge(metricLegacyBytes, float64(legacyBytes))
 }
 
 // LoadLegacyBuf load legacy data one by one
@@ -373,7 +990,7 @@ func (j *Journal) LoadLegacyBuf(data *Data) (err error) {
 
 	if err = j.legacy.Load(data); err == io.EOF {
 		j.logger.Debug("load all legacy data")
-		if err = j.legacy.Clean(); err != nil {
+		if err = j.cleanLegacy(); err != nil {
 			j.logger.Error("clean legacy", zap.Error(err))
 		}
 
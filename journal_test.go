@@ -2,6 +2,7 @@ package journal
 
 import (
 	"context"
+	"errors"
 	"io"
 	"io/ioutil"
 	"log"
@@ -75,7 +76,7 @@ func TestJournal(t *testing.T) {
 	threshold := int64(50)
 
 	defer func() {
-		j.Close()
+		j.Close(ctx)
 		os.RemoveAll(dir)
 	}()
 
@@ -182,3 +183,224 @@ func BenchmarkJournal(b *testing.B) {
 	})
 
 }
+
+func TestJournalClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-close")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// close before start
+	j, err := NewJournal(WithBufDirPath(dir), WithLogger(newTestLogger(t)))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Close(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Start(ctx); err != ErrClosed {
+		t.Fatalf("expect ErrClosed, got %+v", err)
+	}
+
+	j, err = NewJournal(WithBufDirPath(dir), WithLogger(newTestLogger(t)), WithFlushInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.WriteData(&Data{ID: 1}); err == nil {
+		t.Fatal("should not write before start")
+	}
+	if err = j.Start(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Start(ctx); err == nil {
+		t.Fatal("should not start twice")
+	}
+	if _, err = j.Subscribe(ctx, 10); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.WriteData(&Data{ID: 1}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := j.Close(ctx); err != nil {
+				t.Errorf("%+v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// all background goroutines exited
+	j.wg.Wait()
+	if st := j.Status(); st.State != "closed" || st.Subscribers != 0 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+	if err = j.WriteData(&Data{ID: 2}); err != ErrClosed {
+		t.Fatalf("expect ErrClosed, got %+v", err)
+	}
+	if err = j.WriteId(1); err != ErrClosed {
+		t.Fatalf("expect ErrClosed, got %+v", err)
+	}
+	if err = j.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Close(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+func TestJournalWriteCtx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := newTestJournal(t, ctx)
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+
+	// simulate slow rotating
+	if !j.rotateLock.TryLock() {
+		t.Fatal("should acquire rotate lock")
+	}
+	j.Lock()
+	wctx, wcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	err := j.WriteDataCtx(wctx, &Data{ID: 1})
+	wcancel()
+	if !errors.Is(err, ErrDuringRotate) {
+		t.Fatalf("expect ErrDuringRotate, got %+v", err)
+	}
+	j.rotateLock.ForceRelease()
+
+	// simulate flushing
+	wctx, wcancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	err = j.WriteIdCtx(wctx, 1)
+	wcancel()
+	if !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrDuringRotate) {
+		t.Fatalf("expect deadline exceeded, got %+v", err)
+	}
+	j.Unlock()
+
+	if err = j.WriteDataCtx(ctx, &Data{ID: 1}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.WriteIdCtx(ctx, 1); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	// read locks of canceled writes are released
+	if err = j.Rotate(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	ioErr := &IOError{Op: "write data", Err: io.ErrShortWrite}
+	if !errors.Is(ioErr, io.ErrShortWrite) {
+		t.Fatalf("IOError should unwrap to underlying error")
+	}
+}
+
+// fakeClock manually advanced clock
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) GetUTCNow() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	c.Unlock()
+}
+
+func TestJournalWithClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := &fakeClock{now: time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)}
+	j, dir := newTestJournal(t, ctx,
+		WithClock(clock),
+		WithRotateCheckInterval(10*time.Millisecond),
+		WithRotatePolicy(&AgeRotatePolicy{MaxAge: time.Hour}),
+	)
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+
+	if err := j.WriteData(&Data{ID: 1}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(j.manifest.GetSegments()); n != 1 {
+		t.Fatalf("should not rotate, got %d segments", n)
+	}
+	if segs, err := ScanSegments(dir); err != nil {
+		t.Fatalf("%+v", err)
+	} else if name := segs[0].Name; name != "20200102_00000001" {
+		t.Fatalf("segment should be named by clock, got %s", name)
+	}
+
+	clock.Add(2 * time.Hour)
+	for i := 0; ; i++ {
+		if i > 100 {
+			t.Fatal("should rotate by clock")
+		}
+		if len(j.manifest.GetSegments()) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if at := j.Status().LastRotateAt; !at.Equal(clock.GetUTCNow()) {
+		t.Fatalf("expect last rotate at %v, got %v", clock.GetUTCNow(), at)
+	}
+}
+
+// removeConsumed remove consumed segments synchronously,
+// instead of waiting the background removing triggered by replay.
+func removeConsumed(t *testing.T, j *Journal) {
+	if err := j.manifest.RemoveConsumed(j.logger); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+// newTestLogger only print errors, without changing level of global `Logger`
+func newTestLogger(t *testing.T) *utils.LoggerType {
+	logger, err := utils.NewConsoleLoggerWithName("go-journal-test", "error")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	return logger
+}
+
+// newTestJournal create journal in new temp directory and start it,
+// `opts` are applied after buf directory & logger of tests.
+// caller should close journal and remove directory.
+func newTestJournal(t *testing.T, ctx context.Context, opts ...OptionFunc) (j *Journal, dir string) {
+	dir, err := ioutil.TempDir("", "journal-test")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+
+	if j, err = NewJournal(append([]OptionFunc{
+		WithBufDirPath(dir),
+		WithLogger(newTestLogger(t)),
+	}, opts...)...); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Start(ctx); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("%+v", err)
+	}
+
+	return j, dir
+}
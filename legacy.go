@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -18,11 +19,17 @@ type LegacyLoader struct {
 	// acquire write lock during reset.
 	// acquire read lock during read/write data/ids files.
 	sync.RWMutex
-	logger *utils.LoggerType
+	logger     *utils.LoggerType
+	clock      Clock
+	metrics    MetricsCollector
+	eventHooks []EventHook
+	archive    ArchiveSink
 
 	dataFNames, idsFNames []string
 	isNeedReload,         // prepare datafp for `Load`
 	isCompress,
+	// isMmap decode uncompressed data files by mmap
+	isMmap,
 	isReadyReload bool // alreddy update `dataFNames`
 	ids                       Int64SetItf
 	dataFileIdx, dataFilesLen int
@@ -30,21 +37,26 @@ type LegacyLoader struct {
 	decoder                   *DataDecoder
 }
 
-// NewLegacyLoader create new LegacyLoader
+// NewLegacyLoader create new LegacyLoader,
+// `opts` set clock of loader, `logger` always be used.
 func NewLegacyLoader(ctx context.Context,
 	logger *utils.LoggerType,
 	dataFNames, idsFNames []string,
 	isCompress bool,
 	committedIDTTL time.Duration,
+	opts ...ComponentOptionFunc,
 ) *LegacyLoader {
+	opt := newComponentOption(append(opts, WithComponentLogger(logger))...)
 	l := &LegacyLoader{
-		logger:        logger,
+		logger:        opt.logger,
+		clock:         opt.clock,
+		metrics:       noopMetrics{},
 		dataFNames:    dataFNames,
 		idsFNames:     idsFNames,
 		isNeedReload:  true,
 		isReadyReload: len(dataFNames) != 0,
 		isCompress:    isCompress,
-		ids:           NewInt64SetWithTTL(ctx, committedIDTTL),
+		ids:           NewInt64SetWithTTL(ctx, committedIDTTL, WithComponentLogger(opt.logger), WithComponentClock(opt.clock)),
 	}
 	l.logger.Debug("new legacy loader",
 		zap.Strings("dataFiles", dataFNames),
@@ -52,6 +64,14 @@ func NewLegacyLoader(ctx context.Context,
 	return l
 }
 
+// componentOpts return options to pass logger & clock to decoders
+func (l *LegacyLoader) componentOpts() []ComponentOptionFunc {
+	return []ComponentOptionFunc{
+		WithComponentLogger(l.logger),
+		WithComponentClock(l.clock),
+	}
+}
+
 // AddID add id in ids
 func (l *LegacyLoader) AddID(id int64) {
 	l.ids.AddInt64(id)
@@ -74,22 +94,137 @@ func (l *LegacyLoader) Reset(dataFNames, idsFNames []string) {
 	l.isReadyReload = len(dataFNames) != 0
 }
 
+// Close close opening data file, and stop rotator of committed ids set
+func (l *LegacyLoader) Close() {
+	l.Lock()
+	defer l.Unlock()
+
+	l.closeDataFile()
+	if closer, ok := l.ids.(interface{ Close() }); ok {
+		closer.Close()
+	}
+}
+
+// closeDataFile close reading data file and its decoder
+func (l *LegacyLoader) closeDataFile() {
+	if l.decoder != nil {
+		if err := l.decoder.Close(); err != nil {
+			l.logger.Error("close data decoder", zap.Error(err))
+		}
+		l.decoder = nil
+	}
+	if l.dataFp != nil {
+		if err := l.dataFp.Close(); err != nil {
+			l.logger.Error("close file", zap.String("file", l.dataFp.Name()), zap.Error(err))
+		}
+		l.dataFp = nil
+	}
+}
+
+// newDataDecoder create decoder of data file,
+// use mmap for uncompressed file if enabled.
+func (l *LegacyLoader) newDataDecoder(fp *os.File) (*DataDecoder, error) {
+	if isFileGZ(fp.Name()) {
+		return NewDataDecoder(fp, true, l.componentOpts()...)
+	}
+	if l.isMmap {
+		return NewMmapDataDecoder(fp, l.componentOpts()...)
+	}
+
+	return NewDataDecoder(fp, false, l.componentOpts()...)
+}
+
 // GetIdsLen return length of ids
 func (l *LegacyLoader) GetIdsLen() int {
 	return l.ids.GetLen()
 }
 
+// emit send event to all hooks
+func (l *LegacyLoader) emit(evt *Event) {
+	if len(l.eventHooks) == 0 {
+		return
+	}
+
+	evt.Time = l.clock.GetUTCNow()
+	emitEvent(l.eventHooks, evt)
+}
+
+// emitCorruption send corruption event of broken data file
+func (l *LegacyLoader) emitCorruption(fpath string, err error) {
+	var size int64
+	if fi, statErr := os.Stat(fpath); statErr == nil {
+		size = fi.Size()
+	}
+
+	l.emit(&Event{
+		Type:    EventCorruption,
+		Segment: SegmentName(fpath),
+		Files:   []string{fpath},
+		Size:    size,
+		Err:     err,
+	})
+}
+
 // removeFile delete file, should run sync to avoid dirty files
 func (l *LegacyLoader) removeFiles(fs []string) {
+	// archive files of the same segment together
+	var (
+		names      []string
+		segFpaths  = map[string][]string{}
+		isArchived = map[string]bool{}
+	)
+	for _, fpath := range fs {
+		name := SegmentName(fpath)
+		if _, ok := segFpaths[name]; !ok {
+			names = append(names, name)
+		}
+		segFpaths[name] = append(segFpaths[name], fpath)
+	}
+	for _, name := range names {
+		fpaths := segFpaths[name]
+		if err := archiveSegment(context.Background(), l.archive, filepath.Dir(fpaths[0]), name, fpaths); err != nil {
+			l.logger.Error("archive segment, skip removing", zap.Error(err), zap.String("segment", name))
+			l.emit(&Event{
+				Type:    EventClean,
+				Segment: name,
+				Files:   fpaths,
+				Err:     err,
+			})
+			continue
+		}
+		isArchived[name] = true
+	}
+
 	for _, fpath := range fs {
+		if !isArchived[SegmentName(fpath)] {
+			continue
+		}
+
+		var size int64
+		if fi, err := os.Stat(fpath); err == nil {
+			size = fi.Size()
+		}
+
+		evt := &Event{
+			Type:    EventClean,
+			Segment: SegmentName(fpath),
+			Files:   []string{fpath},
+			Size:    size,
+		}
 		if err := os.Remove(fpath); err != nil {
 			l.logger.Error("delete file",
 				zap.String("file", fpath),
 				zap.Error(err))
+			evt.Err = err
+			l.emit(evt)
 			continue
 		}
 
 		l.logger.Info("remove file", zap.String("file", fpath))
+		l.emit(evt)
+		if err := removeSegmentMeta(fpath); err != nil {
+			l.logger.Error("delete segment meta", zap.Error(err))
+		}
 	}
 }
 
@@ -119,11 +254,14 @@ READ_NEW_FILE:
 		l.dataFileIdx++
 		// all data files finished
 		if l.dataFileIdx == l.dataFilesLen {
+			l.metrics.SetGauge(metricReplayFilesDone, float64(l.dataFilesLen))
 			l.logger.Debug("all data files finished")
 			l.isNeedReload = true
 			return io.EOF
 		}
 
+		l.metrics.SetGauge(metricReplayFilesDone, float64(l.dataFileIdx))
+		l.metrics.SetGauge(metricReplayFilesTotal, float64(l.dataFilesLen))
 		l.logger.Debug("read new data file",
 			zap.Strings("data_files", l.dataFNames),
 			zap.String("fname", l.dataFNames[l.dataFileIdx]))
@@ -134,8 +272,11 @@ READ_NEW_FILE:
 			goto READ_NEW_FILE
 		}
 
-		if l.decoder, err = NewDataDecoder(l.dataFp, isFileGZ(l.dataFp.Name())); err != nil {
+		if l.decoder, err = l.newDataDecoder(l.dataFp); err != nil {
 			l.logger.Error("decode data file", zap.Error(err))
+			l.metrics.AddCounter(metricCorruptedRecords, 1)
+			l.emitCorruption(l.dataFp.Name(), err)
+			l.dataFp.Close()
 			l.dataFp = nil
 			goto READ_NEW_FILE
 		}
@@ -146,15 +287,13 @@ READ_NEW_LINE:
 		if err != io.EOF {
 			// current file is broken
 			l.logger.Error("load data file", zap.Error(err))
+			l.metrics.AddCounter(metricCorruptedRecords, 1)
+			l.emitCorruption(l.dataFp.Name(), err)
 		}
 
 		// read new file
-		if err = l.dataFp.Close(); err != nil {
-			l.logger.Error("close file", zap.String("file", l.dataFp.Name()), zap.Error(err))
-		}
-
 		l.logger.Debug("finish read data file", zap.String("fname", l.dataFp.Name()))
-		l.dataFp = nil
+		l.closeDataFile()
 		goto READ_NEW_FILE
 	}
 
@@ -164,9 +303,26 @@ READ_NEW_LINE:
 	}
 
 	// l.logger.Debug("load unconsumed data", zap.Int64("id", id))
+	l.metrics.AddCounter(metricReplayRecords, 1)
 	return nil
 }
 
+// replayFiles load committed ids, then return data files to replay.
+// the latest data file is skipped as `Load`.
+func (l *LegacyLoader) replayFiles() (dataFNames []string, err error) {
+	l.Lock()
+	defer l.Unlock()
+
+	// reset `Load`
+	l.closeDataFile()
+	l.isNeedReload = true
+	if len(l.dataFNames) > 1 {
+		dataFNames = append(dataFNames, l.dataFNames[:len(l.dataFNames)-1]...)
+	}
+
+	return dataFNames, l.LoadAllids(l.ids)
+}
+
 // LoadMaxId load max id from all ids files
 func (l *LegacyLoader) LoadMaxId() (maxId int64, err error) {
 	l.logger.Debug("LoadMaxId...")
@@ -175,26 +331,36 @@ func (l *LegacyLoader) LoadMaxId() (maxId int64, err error) {
 		id         int64
 		idsDecoder *IdsDecoder
 	)
-	startTs := utils.Clock.GetUTCNow()
+	startTs := l.clock.GetUTCNow()
 	for _, fname := range l.idsFNames {
+		// sealed segment already recorded max id in meta
+		if meta, err := LoadSegmentMeta(fname); err == nil {
+			if meta.CommittedIDs != 0 && meta.MaxCommittedID > maxId {
+				maxId = meta.MaxCommittedID
+			}
+			continue
+		}
+
 		// l.logger.Debug("load ids from file", zap.String("fname", fname))
 		if fp, err = os.Open(fname); err != nil {
 			return 0, errors.Wrapf(err, "open file `%s` to load maxid", fname)
 		}
-		defer fp.Close()
 
-		if idsDecoder, err = NewIdsDecoder(fp, isFileGZ(fp.Name())); err != nil {
+		if idsDecoder, err = NewIdsDecoder(fp, isFileGZ(fp.Name()), l.componentOpts()...); err != nil {
 			l.logger.Error("new ids decoder from file",
 				zap.Error(err),
 				zap.String("fname", fp.Name()),
 			)
+			fp.Close()
 			continue
 		}
 
-		if id, err = idsDecoder.LoadMaxId(); err != nil {
+		id, err = idsDecoder.LoadMaxId()
+		fp.Close()
+		if err != nil {
 			l.logger.Error("read ids decoder",
 				zap.Error(err),
-				zap.String("fname", fp.Name()),
+				zap.String("fname", fname),
 			)
 			continue
 		}
@@ -206,8 +372,37 @@ func (l *LegacyLoader) LoadMaxId() (maxId int64, err error) {
 
 	l.logger.Debug("load max id done",
 		zap.Int64("max_id", maxId),
-		zap.Float64("sec", utils.Clock.GetUTCNow().Sub(startTs).Seconds()))
-	return id, nil
+		zap.Float64("sec", l.clock.GetUTCNow().Sub(startTs).Seconds()))
+	return maxId, nil
+}
+
+// LoadMaxDataId load max id of records in all data files,
+// including records not committed yet.
+// records after broken position of data file are ignored.
+func (l *LegacyLoader) LoadMaxDataId() (maxId int64, err error) {
+	for _, fname := range l.dataFNames {
+		// sealed segment already recorded max id in meta
+		if meta, err := LoadSegmentMeta(fname); err == nil {
+			if meta.Records != 0 && meta.MaxID > maxId {
+				maxId = meta.MaxID
+			}
+			continue
+		}
+
+		if err = ForEachDataInFile(fname, func(data *Data) error {
+			if data.ID > maxId {
+				maxId = data.ID
+			}
+			return nil
+		}); err != nil {
+			l.logger.Error("load max id from data file",
+				zap.Error(err),
+				zap.String("fname", fname),
+			)
+		}
+	}
+
+	return maxId, nil
 }
 
 // LoadAllids read all ids from ids file into ids set
@@ -219,7 +414,7 @@ func (l *LegacyLoader) LoadAllids(ids Int64SetItf) (err error) {
 		idsDecoder *IdsDecoder
 	)
 
-	startTs := utils.Clock.GetUTCNow()
+	startTs := l.clock.GetUTCNow()
 	for _, fname := range l.idsFNames {
 		// l.logger.Debug("load ids from file", zap.String("fname", fname))
 		if fp != nil {
@@ -234,7 +429,7 @@ func (l *LegacyLoader) LoadAllids(ids Int64SetItf) (err error) {
 			continue
 		}
 
-		if idsDecoder, err = NewIdsDecoder(fp, isFileGZ(fp.Name())); err != nil {
+		if idsDecoder, err = NewIdsDecoder(fp, isFileGZ(fp.Name()), l.componentOpts()...); err != nil {
 			errMsg += errors.Wrapf(err, "create ids decoder `%s`", fname).Error() + ";"
 			continue
 		}
@@ -252,7 +447,7 @@ func (l *LegacyLoader) LoadAllids(ids Int64SetItf) (err error) {
 	}
 
 	l.logger.Debug("load all ids done",
-		zap.Float64("sec", utils.Clock.GetUTCNow().Sub(startTs).Seconds()))
+		zap.Float64("sec", l.clock.GetUTCNow().Sub(startTs).Seconds()))
 	if errMsg != "" {
 		return fmt.Errorf("load all ids: " + errMsg)
 	}
@@ -260,23 +455,64 @@ func (l *LegacyLoader) LoadAllids(ids Int64SetItf) (err error) {
 	return nil
 }
 
+// cleanableFiles return legacy files will be removed by `Clean`.
+// data files replayed by `Load` (all except the latest one) are cleanable,
+// ids files are cleanable only if older than the latest data file,
+// since ids are always written after their data.
+func (l *LegacyLoader) cleanableFiles() (dataFNames, idsFNames []string) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if len(l.dataFNames) <= 1 {
+		return nil, nil
+	}
+
+	dataFNames = l.dataFNames[:len(l.dataFNames)-1]
+	latest := SegmentName(l.dataFNames[len(l.dataFNames)-1])
+	for _, fname := range l.idsFNames {
+		if segmentNameLess(SegmentName(fname), latest) {
+			idsFNames = append(idsFNames, fname)
+		}
+	}
+
+	return
+}
+
 // Clean remove old legacy files
 func (l *LegacyLoader) Clean() error {
+	dataFNames, idsFNames := l.release()
+
 	l.Lock()
 	defer l.Unlock()
 
-	if len(l.dataFNames) > 1 {
-		l.removeFiles(l.dataFNames[:len(l.dataFNames)-1])
+	l.removeFiles(append(dataFNames, idsFNames...))
+	l.logger.Debug("clean all legacy files")
+	return nil
+}
+
+// release stop tracking cleanable files without removing them,
+// return released files.
+func (l *LegacyLoader) release() (dataFNames, idsFNames []string) {
+	dataFNames, idsFNames = l.cleanableFiles()
+
+	l.Lock()
+	defer l.Unlock()
+
+	if len(dataFNames) != 0 {
 		l.dataFNames = []string{l.dataFNames[len(l.dataFNames)-1]}
 	}
-
-	if len(l.idsFNames) > 1 {
-		l.removeFiles(l.idsFNames[:len(l.idsFNames)-1])
-		l.idsFNames = []string{l.idsFNames[len(l.idsFNames)-1]}
+	released := map[string]bool{}
+	for _, fname := range idsFNames {
+		released[fname] = true
+	}
+	var kept []string
+	for _, fname := range l.idsFNames {
+		if !released[fname] {
+			kept = append(kept, fname)
+		}
 	}
+	l.idsFNames = kept
 
-	l.dataFp.Close()
-	l.dataFp = nil // `Load` need this
-	l.logger.Debug("clean all legacy files")
-	return nil
+	l.closeDataFile() // `Load` need this
+	return append([]string{}, dataFNames...), append([]string{}, idsFNames...)
 }
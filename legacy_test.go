@@ -205,3 +205,70 @@ func TestEmptyLegacy(t *testing.T) {
 		}
 	}
 }
+
+func TestLegacyLoadMaxId(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-maxid")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	var idsFnames []string
+	for _, ids := range [][]int64{{1, 500}, {20, 30}} {
+		fp, err := ioutil.TempFile(dir, "*.ids")
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		enc, err := NewIdsEncoder(fp, false)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		for _, id := range ids {
+			if err = enc.Write(id); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		if err = enc.Flush(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		fp.Close()
+		idsFnames = append(idsFnames, fp.Name())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	legacy := NewLegacyLoader(ctx, Logger, nil, idsFnames, false, testIDTTL)
+	maxID, err := legacy.LoadMaxId()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if maxID != 500 {
+		t.Fatalf("expect 500, got %v", maxID)
+	}
+}
+
+func TestLegacyCleanableFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// segment 4 only has ids file
+	legacy := NewLegacyLoader(ctx, Logger,
+		[]string{"/buf/20060102_00000001.buf", "/buf/20060102_00000002.buf", "/buf/20060102_00000003.buf"},
+		[]string{"/buf/20060102_00000001.ids", "/buf/20060102_00000002.ids", "/buf/20060102_00000003.ids", "/buf/20060102_00000004.ids"},
+		false, testIDTTL)
+	dataFNames, idsFNames := legacy.release()
+	if len(dataFNames) != 2 || dataFNames[1] != "/buf/20060102_00000002.buf" {
+		t.Fatalf("only replayed data files should be cleanable, got %v", dataFNames)
+	}
+	if len(idsFNames) != 2 || idsFNames[1] != "/buf/20060102_00000002.ids" {
+		t.Fatalf("only ids files older than the latest data file should be cleanable, got %v", idsFNames)
+	}
+
+	if dataFNames, idsFNames = legacy.cleanableFiles(); len(dataFNames) != 0 || len(idsFNames) != 0 {
+		t.Fatalf("released files should not be cleanable again, got %v, %v", dataFNames, idsFNames)
+	}
+	if len(legacy.idsFNames) != 2 || legacy.idsFNames[0] != "/buf/20060102_00000003.ids" {
+		t.Fatalf("got wrong kept ids files %v", legacy.idsFNames)
+	}
+}
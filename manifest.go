@@ -0,0 +1,456 @@
+package journal
+
+// manifest.go
+// MANIFEST record all segments and their lifecycle state in buf directory.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	manifestFileName = "MANIFEST"
+	manifestVersion  = 1
+)
+
+var (
+	// manifestFileNameReg manifest file name pattern
+	manifestFileNameReg = regexp.MustCompile(`^MANIFEST(-[A-Za-z0-9-]+)?(\.tmp)?$`)
+)
+
+// SegmentState lifecycle state of segment
+type SegmentState string
+
+const (
+	// SegmentActive segment is writing
+	SegmentActive SegmentState = "active"
+	// SegmentSealed segment is closed, waiting for replay
+	SegmentSealed SegmentState = "sealed"
+	// SegmentReplaying segment is handed to legacy loader
+	SegmentReplaying SegmentState = "replaying"
+	// SegmentConsumed segment is replayed, files could be removed
+	SegmentConsumed SegmentState = "consumed"
+	// SegmentQuarantined segment is broken, will not be replayed or removed
+	SegmentQuarantined SegmentState = "quarantined"
+)
+
+// ManifestSegment data & ids files pair recorded in manifest
+type ManifestSegment struct {
+	Name      string       `json:"name"`
+	DataFile  string       `json:"data_file"`
+	IdsFile   string       `json:"ids_file"`
+	State     SegmentState `json:"state"`
+	Meta      *SegmentMeta `json:"meta,omitempty"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+// Manifest segments list of buf directory.
+// every change will be persisted atomically.
+type Manifest struct {
+	sync.RWMutex
+	// removeLock serialize removing consumed segments
+	removeLock sync.Mutex
+	dir        string
+	clock      Clock
+	archive    ArchiveSink
+	// onClean receive clean events of removed files, could be nil
+	onClean func(*Event)
+	// prefix only segments named with prefix are recorded
+	prefix string
+
+	Version  int                `json:"version"`
+	Segments []*ManifestSegment `json:"segments"`
+	// LastSegment name of the latest active segment,
+	// keep segment sequence monotonic after segments removed.
+	LastSegment string `json:"last_segment,omitempty"`
+}
+
+// ManifestFpath return manifest file path in buf directory
+func ManifestFpath(dir string) string {
+	return manifestFpathWithPrefix(dir, "")
+}
+
+// manifestFpathWithPrefix return manifest file path of segments named with `prefix`
+func manifestFpathWithPrefix(dir, prefix string) string {
+	if prefix == "" {
+		return filepath.Join(dir, manifestFileName)
+	}
+
+	return filepath.Join(dir, manifestFileName+"-"+prefix)
+}
+
+// LoadManifest load manifest in buf directory,
+// `opts` set clock to update segments, and naming to load manifest of segments named with its prefix.
+// return error satisfied `os.IsNotExist` if manifest not exists.
+func LoadManifest(dir string, opts ...ComponentOptionFunc) (m *Manifest, err error) {
+	o := newComponentOption(opts...)
+	return loadManifest(o.clock, dir, o.naming.prefixOf())
+}
+
+func loadManifest(clock Clock, dir, prefix string) (m *Manifest, err error) {
+	cnt, err := ioutil.ReadFile(manifestFpathWithPrefix(dir, prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	m = &Manifest{dir: dir, prefix: prefix, clock: clock}
+	if err = json.Unmarshal(cnt, m); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal manifest in `%s`", dir)
+	}
+
+	return m, nil
+}
+
+// OpenManifest load manifest in buf directory, and reconcile it with files on disk.
+//
+//   - segments active or replaying in last run will be reset to sealed.
+//   - segments lost files will be dropped.
+//   - segment files not recorded in manifest will be adopted as sealed.
+//
+// create new manifest by scanning directory if not exists.
+// segments consumed in last run are kept until `RemoveConsumed`,
+// they will be archived into `archive` before removal if it is not nil.
+// `opts` set clock to update segments.
+func OpenManifest(logger *utils.LoggerType, dir string, archive ArchiveSink, opts ...ComponentOptionFunc) (m *Manifest, err error) {
+	return openManifest(logger, newComponentOption(opts...).clock, dir, "", archive)
+}
+
+// openManifest open manifest only records segments named with `prefix`,
+// so journals with different prefix could share same directory.
+func openManifest(logger *utils.LoggerType, clock Clock, dir, prefix string, archive ArchiveSink) (m *Manifest, err error) {
+	if m, err = loadManifest(clock, dir, prefix); os.IsNotExist(err) {
+		logger.Info("manifest not exists, create by scanning directory",
+			zap.String("dir", dir),
+			zap.String("prefix", prefix))
+		m = &Manifest{
+			dir:     dir,
+			prefix:  prefix,
+			Version: manifestVersion,
+		}
+	} else if err != nil {
+		return nil, errors.Wrap(err, "load manifest")
+	}
+
+	m.archive = archive
+	m.clock = clock
+	m.Lock()
+	defer m.Unlock()
+	now := m.clock.GetUTCNow()
+	for _, seg := range m.Segments {
+		switch seg.State {
+		case SegmentActive, SegmentReplaying:
+			logger.Info("reset segment to sealed",
+				zap.String("segment", seg.Name),
+				zap.String("state", string(seg.State)))
+			seg.State = SegmentSealed
+			seg.UpdatedAt = now
+		}
+	}
+	// drop segments lost files
+	var segs []*ManifestSegment
+	for _, seg := range m.Segments {
+		if _, err = os.Stat(filepath.Join(dir, seg.DataFile)); os.IsNotExist(err) {
+			logger.Warn("segment data file not exists, drop it from manifest",
+				zap.String("segment", seg.Name))
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	m.Segments = segs
+
+	// adopt files not recorded in manifest
+	files, err := ScanSegments(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "scan segments in dir `%s`", dir)
+	}
+	for _, f := range files {
+		if info, err := ParseSegmentName(f.Name); err != nil || info.Prefix != prefix {
+			continue
+		}
+
+		seg := m.get(f.Name)
+		if seg == nil {
+			logger.Warn("adopt segment not recorded in manifest", zap.String("segment", f.Name))
+			seg = &ManifestSegment{
+				Name:      f.Name,
+				State:     SegmentSealed,
+				UpdatedAt: now,
+			}
+			if meta, err := LoadSegmentMeta(filepath.Join(dir, f.Name)); err == nil {
+				seg.Meta = meta
+			}
+			m.Segments = append(m.Segments, seg)
+		}
+
+		if f.DataFile != "" {
+			seg.DataFile = filepath.Base(f.DataFile)
+		}
+		if f.IdsFile != "" {
+			seg.IdsFile = filepath.Base(f.IdsFile)
+		}
+	}
+
+	if err = m.save(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// save persist manifest, should hold lock
+func (m *Manifest) save() (err error) {
+	sort.Slice(m.Segments, func(i, k int) bool {
+		return segmentNameLess(m.Segments[i].Name, m.Segments[k].Name)
+	})
+
+	m.Version = manifestVersion
+	cnt, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal manifest")
+	}
+
+	if err = writeFileAtomic(manifestFpathWithPrefix(m.dir, m.prefix), cnt); err != nil {
+		return errors.Wrap(err, "save manifest")
+	}
+
+	return nil
+}
+
+// get return segment by name, should hold lock
+func (m *Manifest) get(name string) *ManifestSegment {
+	for _, seg := range m.Segments {
+		if seg.Name == name {
+			return seg
+		}
+	}
+
+	return nil
+}
+
+// removeSegmentFiles archive then delete files of segment, not need to hold lock
+func (m *Manifest) removeSegmentFiles(ctx context.Context, logger *utils.LoggerType, seg *ManifestSegment) (err error) {
+	var fpaths []string
+	for _, fname := range []string{seg.DataFile, seg.IdsFile} {
+		if fname != "" {
+			fpaths = append(fpaths, filepath.Join(m.dir, fname))
+		}
+	}
+
+	if err = archiveSegment(ctx, m.archive, m.dir, seg.Name, fpaths); err != nil {
+		m.emitClean(&Event{Segment: seg.Name, Files: fpaths, Err: err})
+		return errors.Wrap(err, "archive segment")
+	}
+
+	for _, fpath := range fpaths {
+		var size int64
+		if fi, err := os.Stat(fpath); err == nil {
+			size = fi.Size()
+		} else if os.IsNotExist(err) {
+			continue
+		}
+
+		evt := &Event{Segment: seg.Name, Files: []string{fpath}, Size: size}
+		if evt.Err = os.Remove(fpath); evt.Err != nil && !os.IsNotExist(evt.Err) {
+			m.emitClean(evt)
+			return errors.Wrapf(evt.Err, "remove consumed segment file `%s`", fpath)
+		}
+		m.emitClean(evt)
+	}
+	if err = os.Remove(filepath.Join(m.dir, seg.Name+segmentMetaFileSuffix)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "remove meta of consumed segment `%s`", seg.Name)
+	}
+
+	logger.Info("remove consumed segment", zap.String("segment", seg.Name))
+	return nil
+}
+
+func (m *Manifest) emitClean(evt *Event) {
+	if m.onClean != nil {
+		evt.Type = EventClean
+		m.onClean(evt)
+	}
+}
+
+// RemoveConsumed archive & delete all consumed segments' files and drop them from manifest.
+// manifest is not locked during archiving, so segments could be added or sealed meanwhile.
+func (m *Manifest) RemoveConsumed(logger *utils.LoggerType) (err error) {
+	return m.removeConsumedCtx(context.Background(), logger)
+}
+
+// removeConsumedCtx stop archiving if ctx done, unfinished segments will be removed next time
+func (m *Manifest) removeConsumedCtx(ctx context.Context, logger *utils.LoggerType) (err error) {
+	m.removeLock.Lock()
+	defer m.removeLock.Unlock()
+
+	// consumed segments will never transit to other states
+	var consumed []*ManifestSegment
+	m.RLock()
+	for _, seg := range m.Segments {
+		if seg.State == SegmentConsumed {
+			seg := *seg
+			consumed = append(consumed, &seg)
+		}
+	}
+	m.RUnlock()
+
+	removed := map[string]bool{}
+	for _, seg := range consumed {
+		if err = m.removeSegmentFiles(ctx, logger, seg); err != nil {
+			// keep segment, retry next time
+			logger.Error("remove consumed segment", zap.Error(err), zap.String("segment", seg.Name))
+			continue
+		}
+		removed[seg.Name] = true
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	var segs []*ManifestSegment
+	for _, seg := range m.Segments {
+		if !removed[seg.Name] {
+			segs = append(segs, seg)
+		}
+	}
+	m.Segments = segs
+	return m.save()
+}
+
+// AddActive record new writing segment
+func (m *Manifest) AddActive(dataFpath, idsFpath string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	name := SegmentName(dataFpath)
+	seg := m.get(name)
+	if seg == nil {
+		seg = &ManifestSegment{Name: name}
+		m.Segments = append(m.Segments, seg)
+	}
+
+	seg.DataFile = filepath.Base(dataFpath)
+	seg.IdsFile = filepath.Base(idsFpath)
+	seg.State = SegmentActive
+	seg.UpdatedAt = m.clock.GetUTCNow()
+	m.LastSegment = name
+	return m.save()
+}
+
+// Seal mark segment as sealed with its meta
+func (m *Manifest) Seal(name string, meta *SegmentMeta) error {
+	m.Lock()
+	defer m.Unlock()
+
+	seg := m.get(name)
+	if seg == nil {
+		return fmt.Errorf("segment `%s` not exists in manifest", name)
+	}
+
+	seg.State = SegmentSealed
+	seg.Meta = meta
+	seg.UpdatedAt = m.clock.GetUTCNow()
+	return m.save()
+}
+
+// Transit change state of segments
+func (m *Manifest) Transit(state SegmentState, names ...string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.clock.GetUTCNow()
+	for _, name := range names {
+		seg := m.get(name)
+		if seg == nil {
+			return fmt.Errorf("segment `%s` not exists in manifest", name)
+		}
+
+		seg.State = state
+		seg.UpdatedAt = now
+	}
+
+	return m.save()
+}
+
+// Files return data & ids file paths of segments in states, sorted by sequence
+func (m *Manifest) Files(states ...SegmentState) (dataFpaths, idsFpaths []string) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, seg := range m.Segments {
+		for _, state := range states {
+			if seg.State != state {
+				continue
+			}
+
+			if seg.DataFile != "" {
+				dataFpaths = append(dataFpaths, filepath.Join(m.dir, seg.DataFile))
+			}
+			if seg.IdsFile != "" {
+				idsFpaths = append(idsFpaths, filepath.Join(m.dir, seg.IdsFile))
+			}
+		}
+	}
+
+	return
+}
+
+// GetSegments return copy of all segments
+func (m *Manifest) GetSegments() (segs []ManifestSegment) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, seg := range m.Segments {
+		segs = append(segs, *seg)
+	}
+
+	return segs
+}
+
+// GetSegment return copy of segment, return nil if not exists
+func (m *Manifest) GetSegment(name string) *ManifestSegment {
+	m.RLock()
+	defer m.RUnlock()
+
+	seg := m.get(name)
+	if seg == nil {
+		return nil
+	}
+
+	cp := *seg
+	return &cp
+}
+
+// GetLastSegment return name of the latest active segment
+func (m *Manifest) GetLastSegment() string {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.LastSegment
+}
+
+// segmentNames return distinct segment names of files
+func segmentNames(fpaths []string) (names []string) {
+	existed := map[string]bool{}
+	for _, fpath := range fpaths {
+		name := SegmentName(fpath)
+		if !existed[name] {
+			existed[name] = true
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
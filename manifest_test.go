@@ -0,0 +1,176 @@
+package journal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-manifest")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	for _, fname := range []string{
+		"20060102_00000001.buf", "20060102_00000001.ids",
+		"20060102_00000002.buf", "20060102_00000002.ids",
+		"20060102_00000003.buf", "20060102_00000003.ids",
+	} {
+		if err = ioutil.WriteFile(filepath.Join(dir, fname), nil, FileMode); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	// new manifest adopt all existing files
+	m, err := OpenManifest(Logger, dir, nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if dataFnames, idsFnames := m.Files(SegmentSealed); len(dataFnames) != 3 || len(idsFnames) != 3 {
+		t.Fatalf("should adopt 3 segments, got %v, %v", dataFnames, idsFnames)
+	}
+
+	if err = m.Transit(SegmentConsumed, "20060102_00000001"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = m.Transit(SegmentActive, "20060102_00000002"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = m.Transit(SegmentQuarantined, "20060102_00000003"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// reopen after crash
+	if m, err = OpenManifest(Logger, dir, nil); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if seg := m.GetSegment("20060102_00000001"); seg == nil || seg.State != SegmentConsumed {
+		t.Fatalf("consumed segment should be kept until removed, got %+v", seg)
+	}
+	if err = m.RemoveConsumed(Logger); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	segs := m.GetSegments()
+	if len(segs) != 2 {
+		t.Fatalf("consumed segment should be removed, got %+v", segs)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "20060102_00000001.buf")); !os.IsNotExist(err) {
+		t.Fatalf("consumed file should be removed, got %+v", err)
+	}
+	if segs[0].State != SegmentSealed {
+		t.Fatalf("active segment should be reset to sealed, got %v", segs[0].State)
+	}
+	if segs[1].State != SegmentQuarantined {
+		t.Fatalf("quarantined segment should be kept, got %v", segs[1].State)
+	}
+}
+
+func TestManifestRemoveConsumedWithoutIds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-manifest")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+	bufDir := filepath.Join(dir, "buf")
+	if err = PrepareDir(bufDir); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(bufDir, "20060102_00000001.buf"), []byte("data"), FileMode); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	sink, err := NewDirArchiveSink(filepath.Join(dir, "archive"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	m, err := OpenManifest(Logger, bufDir, sink)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = m.Transit(SegmentConsumed, "20060102_00000001"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = m.RemoveConsumed(Logger); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if segs := m.GetSegments(); len(segs) != 0 {
+		t.Fatalf("segment without ids file should be removed, got %+v", segs)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "archive", "20060102_00000001.buf")); err != nil {
+		t.Fatalf("data file should be archived: %+v", err)
+	}
+}
+
+func TestJournalManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-manifest")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := NewJournal(WithBufDirPath(dir))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Start(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer j.Close(ctx)
+
+	for i := 0; i < 3; i++ {
+		if err = j.WriteData(&Data{ID: int64(i)}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = j.Rotate(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	m, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	segs := m.GetSegments()
+	if len(segs) != 4 {
+		t.Fatalf("expect 4 segments, got %+v", segs)
+	}
+	for i, seg := range segs {
+		expect := SegmentReplaying
+		if i == len(segs)-1 {
+			expect = SegmentActive
+		}
+		if seg.State != expect {
+			t.Fatalf("segment `%s` expect %v, got %v", seg.Name, expect, seg.State)
+		}
+	}
+
+	if !j.LockLegacy() {
+		t.Fatal("can not lock legacy")
+	}
+	data := &Data{}
+	for {
+		if err = j.LoadLegacyBuf(data); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	removeConsumed(t, j)
+
+	if m, err = LoadManifest(dir); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if segs = m.GetSegments(); len(segs) != 2 {
+		t.Fatalf("consumed segments should be removed, got %+v", segs)
+	}
+}
@@ -0,0 +1,226 @@
+package journal
+
+// merge.go
+// replay legacy segments in order of id by k-way merge.
+
+import (
+	"container/heap"
+	"context"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultReplayReorderWindow = 1000
+)
+
+// mergeSource uncommitted records of one segment
+type mergeSource struct {
+	name, fpath string
+	fp          *os.File
+	dec         *DataDecoder
+	// minID min id in segment recorded by meta, `math.MinInt64` if unknown
+	minID int64
+	head  *Data
+}
+
+// sourceHeap min heap of sources by id of their head record
+type sourceHeap []*mergeSource
+
+func (h sourceHeap) Len() int            { return len(h) }
+func (h sourceHeap) Less(i, j int) bool  { return h[i].head.ID < h[j].head.ID }
+func (h sourceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sourceHeap) Push(x interface{}) { *h = append(*h, x.(*mergeSource)) }
+func (h *sourceHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// recordHeap min heap of records by id
+type recordHeap []*replayRecord
+
+func (h recordHeap) Len() int            { return len(h) }
+func (h recordHeap) Less(i, j int) bool  { return h[i].data.ID < h[j].data.ID }
+func (h recordHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *recordHeap) Push(x interface{}) { *h = append(*h, x.(*replayRecord)) }
+func (h *recordHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// merger k-way merge segments by id.
+//
+// segments are opened lazily by min id in meta,
+// so only segments with overlapped ids are decoding at the same time.
+type merger struct {
+	*replayer
+	pending []*mergeSource
+	sources sourceHeap
+}
+
+func newMerger(r *replayer, dataFNames []string) *merger {
+	m := &merger{replayer: r}
+	for _, fpath := range dataFNames {
+		src := &mergeSource{
+			name:  SegmentName(fpath),
+			fpath: fpath,
+			minID: math.MinInt64,
+		}
+		if meta, err := LoadSegmentMeta(fpath); err == nil {
+			if meta.Records == 0 {
+				r.finishSegment()
+				continue
+			}
+			src.minID = meta.MinID
+		}
+
+		m.pending = append(m.pending, src)
+	}
+	sort.SliceStable(m.pending, func(i, j int) bool {
+		return m.pending[i].minID < m.pending[j].minID
+	})
+
+	return m
+}
+
+// open open pending source and read its first record
+func (m *merger) open(src *mergeSource) {
+	fpath := src.fpath
+	fp, err := os.Open(fpath)
+	if err != nil {
+		m.report.addError(src.name, -1, errors.Wrapf(err, "open file `%s`", fpath))
+		m.finishSegment()
+		return
+	}
+	if src.dec, err = m.legacy.newDataDecoder(fp); err != nil {
+		fp.Close()
+		m.legacy.metrics.AddCounter(metricCorruptedRecords, 1)
+		m.legacy.emitCorruption(fpath, err)
+		m.report.addError(src.name, -1, errors.Wrapf(err, "decode data file `%s`", fpath))
+		m.finishSegment()
+		return
+	}
+
+	src.fp = fp
+	if m.advance(src) {
+		heap.Push(&m.sources, src)
+	}
+}
+
+// advance read next uncommitted record into head of source,
+// close source and return false if finished.
+func (m *merger) advance(src *mergeSource) bool {
+	for {
+		data := new(Data)
+		err := src.dec.Read(data)
+		if err == nil {
+			if m.skip(data) {
+				continue
+			}
+
+			src.head = data
+			return true
+		}
+
+		if err != io.EOF {
+			m.legacy.metrics.AddCounter(metricCorruptedRecords, 1)
+			m.legacy.emitCorruption(src.fpath, err)
+			m.report.addError(src.name, -1, errors.Wrapf(err, "decode data file `%s`", src.fpath))
+		}
+		m.close(src)
+		return false
+	}
+}
+
+func (m *merger) close(src *mergeSource) {
+	src.dec.Close()
+	src.fp.Close()
+	src.head = nil
+	m.finishSegment()
+}
+
+// next return record with min id in all sources, return io.EOF if all finished
+func (m *merger) next() (*replayRecord, error) {
+	// sources not opened only contain bigger ids
+	for len(m.pending) != 0 &&
+		(len(m.sources) == 0 || m.pending[0].minID <= m.sources[0].head.ID) {
+		src := m.pending[0]
+		m.pending = m.pending[1:]
+		m.open(src)
+	}
+	if len(m.sources) == 0 {
+		return nil, io.EOF
+	}
+
+	src := m.sources[0]
+	rec := &replayRecord{segment: src.name, data: src.head}
+	if m.advance(src) {
+		heap.Fix(&m.sources, 0)
+	} else {
+		heap.Pop(&m.sources)
+	}
+
+	return rec, nil
+}
+
+// closeAll close all opened sources
+func (m *merger) closeAll() {
+	for _, src := range m.sources {
+		m.close(src)
+	}
+	m.sources = nil
+}
+
+// runMerge deliver records in order of id,
+// records are reordered in window of `reorderWindow` records.
+// stop at the first failure.
+func (r *replayer) runMerge(ctx context.Context, dataFNames []string) {
+	m := newMerger(r, dataFNames)
+	defer m.closeAll()
+
+	var (
+		window  recordHeap
+		isEOF   bool
+		lastID  = int64(math.MinInt64)
+		lastSeg string
+	)
+	for ctx.Err() == nil {
+		for !isEOF && len(window) < r.reorderWindow {
+			rec, err := m.next()
+			if err == io.EOF {
+				isEOF = true
+				break
+			}
+			heap.Push(&window, rec)
+		}
+		if len(window) == 0 {
+			return
+		}
+
+		rec := heap.Pop(&window).(*replayRecord)
+		if rec.data.ID < lastID {
+			r.report.addOutOfOrder()
+			r.legacy.logger.Warn("record out of reorder window",
+				zap.Int64("id", rec.data.ID),
+				zap.String("segment", rec.segment),
+				zap.Int64("last_id", lastID),
+				zap.String("last_segment", lastSeg))
+		} else {
+			lastID, lastSeg = rec.data.ID, rec.segment
+		}
+
+		if err := r.deliver(ctx, rec); err != nil {
+			r.report.addError(rec.segment, rec.data.ID, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package journal
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestJournalReplayIDOrdered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, c := range []struct {
+		window     int
+		expect     []int64
+		outOfOrder int64
+	}{
+		{2, []int64{0, 1, 2, 3, 5, 6, 7, 8, 9, 10, 11, 12, 20, 21}, 0},
+		{1, []int64{0, 1, 2, 3, 5, 6, 7, 8, 9, 10, 11, 20, 12, 21}, 1},
+	} {
+		j, dir := newTestJournal(t, ctx)
+		defer os.RemoveAll(dir)
+		defer j.Close(ctx)
+		var err error
+
+		// the latest segment will be skipped by legacy loader
+		for _, ids := range [][]int64{
+			{0, 2, 4, 6, 8, 10},
+			{1, 3, 5, 7, 9, 11},
+			{20, 12, 21},
+			{30},
+		} {
+			for _, id := range ids {
+				if err = j.WriteData(&Data{ID: id}); err != nil {
+					t.Fatalf("%+v", err)
+				}
+			}
+			if err = j.Rotate(ctx); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		if err = j.WriteId(4); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		var got []int64
+		report, err := j.Replay(ctx, func(data *Data) error {
+			got = append(got, data.ID)
+			return nil
+		},
+			WithReplayOrder(ReplayIDOrdered),
+			WithReplayReorderWindow(c.window),
+		)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Fatalf("window %d: expect %v, got %v", c.window, c.expect, got)
+		}
+		if report.Segments != 3 || report.Committed != 1 || report.OutOfOrder != c.outOfOrder {
+			t.Fatalf("window %d: got wrong report %+v", c.window, report)
+		}
+	}
+}
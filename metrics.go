@@ -0,0 +1,267 @@
+package journal
+
+// metrics.go
+// journal metrics and prometheus text exporter.
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricRecordsWritten    = "journal_records_written_total"
+	metricBytesWritten      = "journal_bytes_written_total"
+	metricIdsWritten        = "journal_ids_written_total"
+	metricWriteLatency      = "journal_write_latency_seconds"
+	metricFlushLatency      = "journal_flush_latency_seconds"
+	metricRotateLatency     = "journal_rotate_latency_seconds"
+	metricRotations         = "journal_rotations_total"
+	metricSegments          = "journal_segments"
+	metricDiskBytes         = "journal_disk_bytes"
+	metricLegacySegments    = "journal_legacy_backlog_segments"
+	metricLegacyBytes       = "journal_legacy_backlog_bytes"
+	metricReplayRecords     = "journal_replay_records_total"
+	metricReplayFilesDone   = "journal_replay_files_done"
+	metricReplayFilesTotal  = "journal_replay_files_total"
+	metricCorruptedRecords  = "journal_corrupted_records_total"
+	metricDeadLetters       = "journal_dead_letters_total"
+	metricIdsSetSize        = "journal_ids_set_size"
+	metricSubscribers       = "journal_subscribers"
+	metricSubscriberDropped = "journal_subscriber_dropped_total"
+)
+
+var (
+	// defaultLatencyBuckets histogram buckets in seconds
+	defaultLatencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+)
+
+// MetricsCollector receive metrics from journal.
+// all methods should be threadsafe.
+type MetricsCollector interface {
+	// AddCounter increase counter by delta
+	AddCounter(name string, delta float64)
+	// SetGauge set gauge to value
+	SetGauge(name string, value float64)
+	// ObserveHistogram add observation into histogram
+	ObserveHistogram(name string, value float64)
+}
+
+// MetricsExporter collector that could export metrics in prometheus text format
+type MetricsExporter interface {
+	WritePrometheus(w io.Writer) error
+}
+
+// NewPrometheusHandler create http handler serve metrics in prometheus text format
+func NewPrometheusHandler(exporter MetricsExporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := exporter.WritePrometheus(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += v
+	h.count++
+}
+
+// MemoryMetrics threadsafe in-memory metrics collector
+type MemoryMetrics struct {
+	sync.Mutex
+	labels string
+
+	counters, gauges map[string]float64
+	histograms       map[string]*histogram
+}
+
+// NewMemoryMetrics create new MemoryMetrics,
+// `constLabels` will be attached to all exported metrics.
+func NewMemoryMetrics(constLabels map[string]string) *MemoryMetrics {
+	var labels []string
+	for k, v := range constLabels {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, k, escapeLabelValue(v)))
+	}
+	sort.Strings(labels)
+
+	return &MemoryMetrics{
+		labels:     strings.Join(labels, ","),
+		counters:   map[string]float64{},
+		gauges:     map[string]float64{},
+		histograms: map[string]*histogram{},
+	}
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// AddCounter increase counter by delta
+func (m *MemoryMetrics) AddCounter(name string, delta float64) {
+	m.Lock()
+	m.counters[name] += delta
+	m.Unlock()
+}
+
+// SetGauge set gauge to value
+func (m *MemoryMetrics) SetGauge(name string, value float64) {
+	m.Lock()
+	m.gauges[name] = value
+	m.Unlock()
+}
+
+// ObserveHistogram add observation into histogram
+func (m *MemoryMetrics) ObserveHistogram(name string, value float64) {
+	m.Lock()
+	h, ok := m.histograms[name]
+	if !ok {
+		h = &histogram{
+			buckets: defaultLatencyBuckets,
+			counts:  make([]uint64, len(defaultLatencyBuckets)),
+		}
+		m.histograms[name] = h
+	}
+	h.observe(value)
+	m.Unlock()
+}
+
+// GetValues return current value of counters & gauges,
+// histograms will be represented by `<name>_count` & `<name>_sum`.
+func (m *MemoryMetrics) GetValues() map[string]float64 {
+	m.Lock()
+	defer m.Unlock()
+
+	r := make(map[string]float64, len(m.counters)+len(m.gauges)+2*len(m.histograms))
+	for name, v := range m.counters {
+		r[name] = v
+	}
+	for name, v := range m.gauges {
+		r[name] = v
+	}
+	for name, h := range m.histograms {
+		r[name+"_count"] = float64(h.count)
+		r[name+"_sum"] = h.sum
+	}
+
+	return r
+}
+
+// WritePrometheus write all metrics in prometheus text format
+func (m *MemoryMetrics) WritePrometheus(w io.Writer) (err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, name := range sortedKeys(m.counters) {
+		if err = m.writeSample(w, name, "counter", "", m.counters[name]); err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedKeys(m.gauges) {
+		if err = m.writeSample(w, name, "gauge", "", m.gauges[name]); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(m.histograms))
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h := m.histograms[name]
+		if _, err = fmt.Fprintf(w, "# TYPE %s histogram\n", name); err != nil {
+			return err
+		}
+		for i, le := range h.buckets {
+			if err = m.writeLine(w, name+"_bucket", fmt.Sprintf(`le="%v"`, le), float64(h.counts[i])); err != nil {
+				return err
+			}
+		}
+		if err = m.writeLine(w, name+"_bucket", `le="+Inf"`, float64(h.count)); err != nil {
+			return err
+		}
+		if err = m.writeLine(w, name+"_sum", "", h.sum); err != nil {
+			return err
+		}
+		if err = m.writeLine(w, name+"_count", "", float64(h.count)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryMetrics) writeSample(w io.Writer, name, typ, labels string, v float64) (err error) {
+	if _, err = fmt.Fprintf(w, "# TYPE %s %s\n", name, typ); err != nil {
+		return err
+	}
+
+	return m.writeLine(w, name, labels, v)
+}
+
+func (m *MemoryMetrics) writeLine(w io.Writer, name, labels string, v float64) (err error) {
+	switch {
+	case m.labels != "" && labels != "":
+		labels = "{" + m.labels + "," + labels + "}"
+	case m.labels != "":
+		labels = "{" + m.labels + "}"
+	case labels != "":
+		labels = "{" + labels + "}"
+	}
+
+	_, err = fmt.Fprintf(w, "%s%s %s\n", name, labels, formatMetricValue(v))
+	return err
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return fmt.Sprintf("%v", v)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// noopMetrics discard all metrics
+type noopMetrics struct{}
+
+func (noopMetrics) AddCounter(string, float64)       {}
+func (noopMetrics) SetGauge(string, float64)         {}
+func (noopMetrics) ObserveHistogram(string, float64) {}
+
+// observeLatency record seconds since `start` into histogram
+func observeLatency(m MetricsCollector, name string, start time.Time) {
+	m.ObserveHistogram(name, time.Since(start).Seconds())
+}
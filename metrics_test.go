@@ -0,0 +1,102 @@
+package journal
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMemoryMetrics(t *testing.T) {
+	m := NewMemoryMetrics(map[string]string{"journal": "test"})
+	m.AddCounter("c_total", 1)
+	m.AddCounter("c_total", 2)
+	m.SetGauge("g", 5)
+	m.ObserveHistogram("h_seconds", 0.003)
+	m.ObserveHistogram("h_seconds", 10)
+
+	buf := &bytes.Buffer{}
+	if err := m.WritePrometheus(buf); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	got := buf.String()
+	t.Logf("got:\n%s", got)
+	for _, expect := range []string{
+		"# TYPE c_total counter\nc_total{journal=\"test\"} 3\n",
+		"# TYPE g gauge\ng{journal=\"test\"} 5\n",
+		"# TYPE h_seconds histogram\n",
+		"h_seconds_bucket{journal=\"test\",le=\"0.001\"} 0\n",
+		"h_seconds_bucket{journal=\"test\",le=\"0.005\"} 1\n",
+		"h_seconds_bucket{journal=\"test\",le=\"+Inf\"} 2\n",
+		"h_seconds_count{journal=\"test\"} 2\n",
+	} {
+		if !strings.Contains(got, expect) {
+			t.Errorf("should contains %q", expect)
+		}
+	}
+
+	if v := m.GetValues()["h_seconds_count"]; v != 2 {
+		t.Fatalf("expect 2, got %v", v)
+	}
+}
+
+func TestJournalMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-metrics")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := NewJournal(WithBufDirPath(dir))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// should not panic before start
+	if v := j.GetMetric()["idsSetLen"]; v != 0 {
+		t.Fatalf("expect 0, got %v", v)
+	}
+
+	if err = j.Start(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer j.Close(ctx)
+
+	for i := 0; i < 10; i++ {
+		if err = j.WriteData(&Data{ID: int64(i)}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err = j.WriteId(1); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Rotate(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	m := j.GetMetric()
+	if v := m[metricRecordsWritten]; v != float64(10) {
+		t.Fatalf("expect 10 records, got %v", v)
+	}
+	if v := m[metricBytesWritten]; v.(float64) <= 0 {
+		t.Fatalf("expect bytes written, got %v", v)
+	}
+	if v := m[metricSegments]; v != float64(2) {
+		t.Fatalf("expect 2 segments, got %v", v)
+	}
+	if v := m[metricRotations]; v != float64(2) {
+		t.Fatalf("expect 2 rotations, got %v", v)
+	}
+
+	rec := httptest.NewRecorder()
+	NewPrometheusHandler(j).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), metricWriteLatency+"_count") {
+		t.Fatalf("should export write latency, got %s", rec.Body.String())
+	}
+}
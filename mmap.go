@@ -0,0 +1,86 @@
+package journal
+
+// mmap.go
+// decode uncompressed data file from memory mapped region,
+// avoid copying every byte through bufio.
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// mmapFile map whole file as read only, return nil if file is empty
+func mmapFile(fp *os.File) (b []byte, err error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "stat file `%s`", fp.Name())
+	}
+	if fi.Size() == 0 {
+		return nil, nil
+	}
+	if int64(int(fi.Size())) != fi.Size() {
+		return nil, errors.Errorf("file `%s` too large to mmap", fp.Name())
+	}
+
+	if b, err = syscall.Mmap(int(fp.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED); err != nil {
+		return nil, errors.Wrapf(err, "mmap file `%s`", fp.Name())
+	}
+
+	return b, nil
+}
+
+// NewMmapDataDecoder create new DataDecoder read uncompressed data file by mmap.
+//
+// records are decoded by `UnmarshalMsg` straight from the mapped region,
+// all fields are copied out, so records are still valid after `Close`.
+// file should not be truncated before `Close`.
+func NewMmapDataDecoder(fp *os.File, opts ...ComponentOptionFunc) (decoder *DataDecoder, err error) {
+	decoder = &DataDecoder{
+		BaseSerializer: BaseSerializer{
+			componentOption: newComponentOption(opts...),
+		},
+	}
+	if decoder.mmap, err = mmapFile(fp); err != nil {
+		return nil, err
+	}
+
+	// only read records, padding of direct io is skipped
+	n, err := dataLogicalLen(fp)
+	if err != nil {
+		decoder.Close()
+		return nil, err
+	}
+	decoder.rest = decoder.mmap
+	if n < int64(len(decoder.rest)) {
+		decoder.rest = decoder.rest[:n]
+	}
+	return decoder, nil
+}
+
+// readMmap deserialize data from mapped region
+func (dec *DataDecoder) readMmap(data *Data) (err error) {
+	if len(dec.rest) == 0 {
+		return io.EOF
+	}
+
+	data.resetOmitted()
+	if dec.rest, err = data.UnmarshalMsg(dec.rest); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Close release mapped region, decoder could not be used after closed
+func (dec *DataDecoder) Close() (err error) {
+	if dec.mmap == nil {
+		return nil
+	}
+
+	err = syscall.Munmap(dec.mmap)
+	dec.mmap, dec.rest = nil, nil
+	return errors.Wrap(err, "munmap data file")
+}
@@ -0,0 +1,182 @@
+package journal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// prepareDataFile write `n` records into temp file
+func prepareDataFile(tb testing.TB, n int) *os.File {
+	fp, err := ioutil.TempFile("", "journal-test-mmap")
+	if err != nil {
+		tb.Fatalf("%+v", err)
+	}
+	enc, err := NewDataEncoder(fp, false)
+	if err != nil {
+		tb.Fatalf("%+v", err)
+	}
+	for id := 0; id < n; id++ {
+		if err = enc.Write(&Data{
+			ID:   int64(id),
+			Data: map[string]interface{}{"tag": "tag", "message": "jr32oirj23r2ifj32ofjfwefefwfwfwefwefwef 234rt34t 34t 34t43t 34t o2jfo2fjof2"},
+		}); err != nil {
+			tb.Fatalf("%+v", err)
+		}
+	}
+	if err = enc.Close(); err != nil {
+		tb.Fatalf("%+v", err)
+	}
+
+	return fp
+}
+
+func TestMmapDataDecoder(t *testing.T) {
+	fp := prepareDataFile(t, 100)
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+	// padding of direct io
+	fi, err := fp.Stat()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	padding := make([]byte, alignUp(int(fi.Size())+dataTrailerSize)-int(fi.Size()))
+	fillPadding(padding, fi.Size())
+	if _, err = fp.Write(padding); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	dec, err := NewMmapDataDecoder(fp)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var datas []*Data
+	for {
+		data := new(Data)
+		if err = dec.Read(data); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		datas = append(datas, data)
+	}
+	if err = dec.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = dec.Read(new(Data)); err != io.EOF {
+		t.Fatalf("closed decoder should return EOF, got %+v", err)
+	}
+
+	if len(datas) != 100 {
+		t.Fatalf("expect 100 records, got %d", len(datas))
+	}
+	// records still valid after unmapped
+	for i, data := range datas {
+		if data.ID != int64(i) || data.Data["tag"] != "tag" {
+			t.Fatalf("got wrong record %+v", data)
+		}
+	}
+
+	// empty file
+	empty, err := ioutil.TempFile("", "journal-test-mmap")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.Remove(empty.Name())
+	defer empty.Close()
+	if dec, err = NewMmapDataDecoder(empty); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = dec.Read(new(Data)); err != io.EOF {
+		t.Fatalf("empty file should return EOF, got %+v", err)
+	}
+}
+
+func TestJournalMmapReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := newTestJournal(t, ctx, WithMmapReplay(true))
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+	var err error
+
+	for id := int64(0); id < 10; id++ {
+		if err = j.WriteData(&Data{ID: id}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if id%2 == 0 {
+			if err = j.WriteId(id); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+	}
+	// legacy loader always skip the latest sealed segment
+	for i := 0; i < 2; i++ {
+		if err = j.Rotate(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	if !j.LockLegacy() {
+		t.Fatal("should acquire legacy lock")
+	}
+	defer j.UnLockLegacy()
+	n := 0
+	for {
+		data := new(Data)
+		if err = j.LoadLegacyBuf(data); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if data.ID%2 == 0 {
+			t.Fatalf("committed id %d should be skipped", data.ID)
+		}
+		n++
+	}
+	if n != 5 {
+		t.Fatalf("expect 5 records, got %d", n)
+	}
+}
+
+// BenchmarkMmapDataDecoder compare with `BenchmarkDecodeData`,
+// decode records from file by buffered reader & mmap.
+func BenchmarkMmapDataDecoder(b *testing.B) {
+	fp := prepareDataFile(b, 100000)
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		b.Fatalf("%+v", err)
+	}
+
+	for name, newDecoder := range map[string]func(*os.File) (*DataDecoder, error){
+		"reader": func(fp *os.File) (*DataDecoder, error) { return NewDataDecoder(fp, false) },
+		"mmap":   func(fp *os.File) (*DataDecoder, error) { return NewMmapDataDecoder(fp) },
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(fi.Size())
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := fp.Seek(0, io.SeekStart); err != nil {
+					b.Fatalf("%+v", err)
+				}
+				dec, err := newDecoder(fp)
+				if err != nil {
+					b.Fatalf("%+v", err)
+				}
+				data := new(Data)
+				for {
+					if err = dec.Read(data); err == io.EOF {
+						break
+					} else if err != nil {
+						b.Fatalf("%+v", err)
+					}
+				}
+				dec.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package journal
+
+// naming.go
+// segment name generation & parsing.
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSegmentSeqWidth = 8
+	// globalSeqMark mark sequence of segment name as global
+	globalSeqMark = "g"
+	// segmentNamePattern `[prefix_]yyyymmdd[±hhmm]_[g]nnnnnnnn`
+	segmentNamePattern = `(?:([A-Za-z0-9-]+)_)?(\d{8})([+-]\d{4})?_(` + globalSeqMark + `?)(\d+)`
+)
+
+var (
+	segmentNameReg       = regexp.MustCompile(`^` + segmentNamePattern + `$`)
+	segmentNamePrefixReg = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+)
+
+// SegmentNameInfo fields parsed from segment name
+type SegmentNameInfo struct {
+	Prefix string
+	// Date date of segment created, in location of name
+	Date time.Time
+	Seq  int64
+	// IsGlobalSeq sequence is monotonic across days,
+	// otherwise sequence is reset every day.
+	IsGlobalSeq bool
+}
+
+// ParseSegmentName parse segment name (or file name of segment)
+func ParseSegmentName(name string) (info *SegmentNameInfo, err error) {
+	matched := segmentNameReg.FindStringSubmatch(SegmentName(name))
+	if matched == nil {
+		return nil, fmt.Errorf("unknown segment name `%s`", name)
+	}
+
+	info = &SegmentNameInfo{
+		Prefix:      matched[1],
+		IsGlobalSeq: matched[4] == globalSeqMark,
+	}
+	if matched[3] == "" {
+		info.Date, err = time.Parse(defaultFileNameTimeLayout, matched[2])
+	} else {
+		info.Date, err = time.Parse(defaultFileNameTimeLayoutWithTZ, matched[2]+matched[3])
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse date of segment `%s`", name)
+	}
+	if info.Seq, err = strconv.ParseInt(matched[5], 10, 64); err != nil {
+		return nil, errors.Wrapf(err, "parse sequence of segment `%s`", name)
+	}
+
+	return info, nil
+}
+
+// segmentNameLess order segments by prefix, then by sequence.
+//
+// daily sequences are ordered by date first,
+// and always come before global sequences.
+func segmentNameLess(a, b string) bool {
+	ia, err := ParseSegmentName(a)
+	if err != nil {
+		return a < b
+	}
+	ib, err := ParseSegmentName(b)
+	if err != nil {
+		return a < b
+	}
+
+	switch {
+	case ia.Prefix != ib.Prefix:
+		return ia.Prefix < ib.Prefix
+	case ia.IsGlobalSeq != ib.IsGlobalSeq:
+		return ib.IsGlobalSeq
+	case ia.IsGlobalSeq:
+		return ia.Seq < ib.Seq
+	case !ia.Date.Equal(ib.Date):
+		return ia.Date.Before(ib.Date)
+	default:
+		return ia.Seq < ib.Seq
+	}
+}
+
+// SegmentNaming strategy to generate segment names like `[prefix_]yyyymmdd[±hhmm]_gnnnnnnnn`.
+//
+// the sequence is monotonic across days, segments are ordered by it
+// instead of the date, so clock jumps will not reorder segments.
+type SegmentNaming struct {
+	// Prefix distinguish journals sharing same directory (like journal's name),
+	// only letters, digits and `-` are allowed.
+	Prefix string
+	// Location timezone of date in name, default to UTC.
+	// utc offset will be appended to date if set.
+	Location *time.Location
+	// SeqWidth zero-padded width of sequence, default to 8
+	SeqWidth int
+
+	// last latest generated segment name,
+	// keep sequence monotonic even if all segments files are removed.
+	last string
+}
+
+func (n *SegmentNaming) validate() error {
+	if n.Prefix != "" && !segmentNamePrefixReg.MatchString(n.Prefix) {
+		return fmt.Errorf("segment name prefix should match `%s`, but got `%s`", segmentNamePrefixReg, n.Prefix)
+	}
+	if n.SeqWidth < 0 {
+		return fmt.Errorf("segment sequence width should not be negative, but got `%d`", n.SeqWidth)
+	}
+
+	return nil
+}
+
+// prefixOf return prefix of segment names generated by naming,
+// nil naming means legacy names without prefix.
+func (n *SegmentNaming) prefixOf() string {
+	if n == nil {
+		return ""
+	}
+
+	return n.Prefix
+}
+
+// isOwned check whether segment belongs to journal use this naming
+func (n *SegmentNaming) isOwned(name string) bool {
+	info, err := ParseSegmentName(name)
+	if err != nil {
+		return false
+	}
+
+	return info.Prefix == n.prefixOf()
+}
+
+// Name generate segment name with sequence, without extension
+func (n *SegmentNaming) Name(now time.Time, seq int64) string {
+	width := n.SeqWidth
+	if width == 0 {
+		width = defaultSegmentSeqWidth
+	}
+
+	var date string
+	if n.Location == nil {
+		date = now.UTC().Format(defaultFileNameTimeLayout)
+	} else {
+		date = now.In(n.Location).Format(defaultFileNameTimeLayoutWithTZ)
+	}
+
+	name := fmt.Sprintf("%s_%s%0*d", date, globalSeqMark, width, seq)
+	if n.Prefix != "" {
+		name = n.Prefix + "_" + name
+	}
+
+	return name
+}
+
+// nextName generate name of segment after `lastNames` and last generated name,
+// sequence begin from 1 if there is no global sequence.
+func (n *SegmentNaming) nextName(now time.Time, lastNames ...string) string {
+	var seq int64
+	for _, name := range append(lastNames, n.last) {
+		if info, err := ParseSegmentName(name); err == nil &&
+			info.IsGlobalSeq &&
+			info.Prefix == n.Prefix &&
+			info.Seq > seq {
+			seq = info.Seq
+		}
+	}
+
+	n.last = n.Name(now, seq+1)
+	return n.last
+}
@@ -0,0 +1,191 @@
+package journal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSegmentName(t *testing.T) {
+	for name, expect := range map[string]*SegmentNameInfo{
+		"20200102_00000003.buf": {
+			Date: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+			Seq:  3,
+		},
+		"/tmp/journal_20200102+0800_g0012.ids.gz": {
+			Prefix:      "journal",
+			Date:        time.Date(2020, 1, 2, 0, 0, 0, 0, time.FixedZone("", 8*3600)),
+			Seq:         12,
+			IsGlobalSeq: true,
+		},
+		"a-1_20200102_g00000005": {
+			Prefix:      "a-1",
+			Date:        time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+			Seq:         5,
+			IsGlobalSeq: true,
+		},
+	} {
+		info, err := ParseSegmentName(name)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if info.Prefix != expect.Prefix ||
+			!info.Date.Equal(expect.Date) ||
+			info.Seq != expect.Seq ||
+			info.IsGlobalSeq != expect.IsGlobalSeq {
+			t.Fatalf("%s: expect %+v, got %+v", name, expect, info)
+		}
+	}
+
+	for _, name := range []string{"MANIFEST", "journal.idmark", "2020010_00000001.buf", "a_b_20200102_g1"} {
+		if _, err := ParseSegmentName(name); err == nil {
+			t.Fatalf("should not parse `%s`", name)
+		}
+	}
+}
+
+func TestSegmentNaming(t *testing.T) {
+	now := time.Date(2020, 1, 2, 20, 0, 0, 0, time.UTC)
+	loc := time.FixedZone("CST", 8*3600)
+	for _, c := range []struct {
+		naming SegmentNaming
+		expect string
+	}{
+		{SegmentNaming{}, "20200102_g00000007"},
+		{SegmentNaming{Prefix: "journal", SeqWidth: 4}, "journal_20200102_g0007"},
+		{SegmentNaming{Location: loc}, "20200103+0800_g00000007"},
+	} {
+		if name := c.naming.Name(now, 7); name != c.expect {
+			t.Fatalf("expect %s, got %s", c.expect, name)
+		}
+	}
+
+	if err := (&SegmentNaming{Prefix: "a_b"}).validate(); err == nil {
+		t.Fatal("should not accept prefix contains `_`")
+	}
+
+	// clock jumps backward
+	naming := &SegmentNaming{Prefix: "a"}
+	n1 := naming.nextName(now, "a_20200102_g00000009", "b_20200102_g00000100")
+	n2 := naming.nextName(now.Add(-48 * time.Hour))
+	if n1 != "a_20200102_g00000010" || n2 != "a_20191231_g00000011" {
+		t.Fatalf("got %s, %s", n1, n2)
+	}
+
+	names := []string{n2, "a_20200101_00000002", n1, "20200103_00000001", "20200102_00000002"}
+	sort.Slice(names, func(i, k int) bool {
+		return segmentNameLess(names[i], names[k])
+	})
+	expect := []string{"20200102_00000002", "20200103_00000001", "a_20200101_00000002", n1, n2}
+	for i := range names {
+		if names[i] != expect[i] {
+			t.Fatalf("expect %v, got %v", expect, names)
+		}
+	}
+}
+
+func TestJournalsShareDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-naming")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// journals with default name are distinguished by prefix
+	newJournal := func(prefix string) *Journal {
+		j, err := NewJournal(
+			WithBufDirPath(dir),
+			WithLogger(newTestLogger(t)),
+			WithSegmentNaming(SegmentNaming{Prefix: prefix}),
+		)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = j.Start(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		return j
+	}
+
+	ja, jb := newJournal("a"), newJournal("b")
+	defer ja.Close(ctx)
+	defer jb.Close(ctx)
+	for id := int64(0); id < 10; id++ {
+		j := ja
+		if id%2 == 1 {
+			j = jb
+		}
+		if err = j.WriteData(&Data{ID: id}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	// legacy loader always skip the latest sealed segment
+	for _, j := range []*Journal{ja, jb, ja, jb} {
+		if err = j.Rotate(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	for _, j := range []*Journal{ja, jb} {
+		if _, err = j.NextID(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	for _, pattern := range []string{
+		"MANIFEST-a", "MANIFEST-b",
+		"journal-a.idmark", "journal-b.idmark",
+		"a_*_g00000003.buf", "b_*_g00000003.ids",
+	} {
+		if fs, err := filepath.Glob(filepath.Join(dir, pattern)); err != nil {
+			t.Fatalf("%+v", err)
+		} else if len(fs) != 1 {
+			t.Fatalf("file `%s` not exists", pattern)
+		}
+	}
+
+	m, err := LoadManifest(dir, WithComponentSegmentNaming(&SegmentNaming{Prefix: "b"}))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, seg := range m.GetSegments() {
+		if !strings.HasPrefix(seg.Name, "b_") {
+			t.Fatalf("should load manifest of prefix `b`, got segment %s", seg.Name)
+		}
+	}
+	if len(m.GetSegments()) == 0 {
+		t.Fatal("should load segments of prefix `b`")
+	}
+
+	for i, j := range []*Journal{ja, jb} {
+		if !j.LockLegacy() {
+			t.Fatal("should acquire legacy lock")
+		}
+		n := 0
+		for {
+			data := new(Data)
+			if err = j.LoadLegacyBuf(data); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if int(data.ID%2) != i {
+				t.Fatalf("journal %d should not load %d", i, data.ID)
+			}
+			n++
+		}
+		if n != 5 {
+			t.Fatalf("journal %d expect 5 records, got %d", i, n)
+		}
+	}
+}
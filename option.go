@@ -20,17 +20,28 @@ const (
 	defaultBufSizeBytes        = 1024 * 1024 * 200
 	defaultCommittedIDTTL      = 5 * time.Minute
 	defaultName                = "journal"
+	defaultIDBlockSize         = 10000
 )
 
+// Clock time source, `utils.Clock` satisfied it
+type Clock interface {
+	GetUTCNow() time.Time
+}
+
 // option configuration of Journal
 type option struct {
 	logger       *utils.LoggerType
+	clock        Clock
 	bufDirPath   string
 	bufSizeBytes int64
 	// isAggresiveGC force gc when reset legacy loader
 	isAggresiveGC,
 	// isCompress [beta] enable gc when writing journal
-	isCompress bool
+	isCompress,
+	// isDirectIO write data files with O_DIRECT
+	isDirectIO,
+	// isMmapReplay decode uncompressed legacy data files by mmap
+	isMmapReplay bool
 	// interval to flush serializer
 	flushInterval,
 	rotateDuration time.Duration
@@ -38,11 +49,27 @@ type option struct {
 	// committedIDTTL remain ids in memory until ttl, to reduce duplicate msg
 	committedIDTTL time.Duration
 	name           string
+	// idBlockSize number of ids reserved by id allocator at once
+	idBlockSize int64
+	// metrics collector, default to `MemoryMetrics`
+	metrics MetricsCollector
+	// eventHooks receive lifecycle events
+	eventHooks []EventHook
+	// archive persist segments before removal
+	archive ArchiveSink
+	// rotatePolicy default to rotate by `bufSizeBytes` or `rotateDuration`
+	rotatePolicy RotatePolicy
+	// naming default to legacy daily sequence names
+	naming *SegmentNaming
+	// deadLetterMaxAttempts attempts of replay handler before record moved into dead letters,
+	// 0 means dead letters are disabled.
+	deadLetterMaxAttempts int
 }
 
 func newOption() *option {
 	return &option{
 		logger:              Logger,
+		clock:               utils.Clock,
 		bufDirPath:          defaultBufDir,
 		rotateDuration:      defaultRotateDuration,
 		bufSizeBytes:        defaultBufSizeBytes,
@@ -52,6 +79,7 @@ func newOption() *option {
 		committedIDTTL:      defaultCommittedIDTTL,
 		name:                defaultName,
 		rotateCheckInterval: defaultRotateCheckInterval,
+		idBlockSize:         defaultIDBlockSize,
 	}
 }
 
@@ -68,6 +96,19 @@ func WithLogger(logger *utils.LoggerType) OptionFunc {
 	}
 }
 
+// WithClock set time source of journal and all its components,
+// default to `utils.Clock`.
+func WithClock(clock Clock) OptionFunc {
+	return func(o *option) error {
+		if clock == nil {
+			return fmt.Errorf("clock cannot be nil")
+		}
+
+		o.clock = clock
+		return nil
+	}
+}
+
 func WithRotateDuration(d time.Duration) OptionFunc {
 	return func(o *option) error {
 		if d == 0 {
@@ -188,3 +229,188 @@ func WithIsCompress(is bool) OptionFunc {
 		return nil
 	}
 }
+
+// WithDirectIO write data files with O_DIRECT to bypass page cache,
+// could not be used with `WithIsCompress`.
+//
+// records are buffered in memory until flush, and the last partial block
+// is padded until the segment is sealed, padding ends with length of records.
+func WithDirectIO(is bool) OptionFunc {
+	return func(o *option) (err error) {
+		o.isDirectIO = is
+		return nil
+	}
+}
+
+// WithMmapReplay decode uncompressed legacy data files by mmap,
+// instead of reading through buffer.
+// data files should not be truncated (like `Verify` with repair) during replay.
+func WithMmapReplay(is bool) OptionFunc {
+	return func(o *option) (err error) {
+		o.isMmapReplay = is
+		return nil
+	}
+}
+
+// WithIDBlockSize set how many ids will be reserved by `NextID` at once.
+// bigger block means less disk writes, but more ids skipped after restart.
+func WithIDBlockSize(size int64) OptionFunc {
+	return func(o *option) (err error) {
+		if size == 0 {
+			Logger.Info("rewrite to default config", zap.Int64("idBlockSize", defaultIDBlockSize))
+			return nil
+		}
+		if size < 0 {
+			return fmt.Errorf("idBlockSize should bigger than 0, but got `%d`", size)
+		}
+
+		o.idBlockSize = size
+		return nil
+	}
+}
+
+// WithMetrics set metrics collector
+func WithMetrics(collector MetricsCollector) OptionFunc {
+	return func(o *option) (err error) {
+		if collector == nil {
+			return fmt.Errorf("metrics collector cannot be nil")
+		}
+
+		o.metrics = collector
+		return nil
+	}
+}
+
+// WithEventHook add hook to receive lifecycle events,
+// could be set multiple times.
+func WithEventHook(hook EventHook) OptionFunc {
+	return func(o *option) (err error) {
+		if hook == nil {
+			return fmt.Errorf("event hook cannot be nil")
+		}
+
+		o.eventHooks = append(o.eventHooks, hook)
+		return nil
+	}
+}
+
+// WithArchiveSink archive segment files before they are removed,
+// files will be kept until archive succeed.
+func WithArchiveSink(sink ArchiveSink) OptionFunc {
+	return func(o *option) (err error) {
+		if sink == nil {
+			return fmt.Errorf("archive sink cannot be nil")
+		}
+
+		o.archive = sink
+		return nil
+	}
+}
+
+// WithRotatePolicy set policy to decide when to rotate,
+// `WithBufSizeByte` & `WithRotateDuration` will not trigger rotate if set.
+func WithRotatePolicy(policy RotatePolicy) OptionFunc {
+	return func(o *option) (err error) {
+		if policy == nil {
+			return fmt.Errorf("rotate policy cannot be nil")
+		}
+		if err = checkRotatePolicy(policy); err != nil {
+			return err
+		}
+
+		o.rotatePolicy = policy
+		return nil
+	}
+}
+
+// WithSegmentNaming name segments with prefix, timezone & global sequence,
+// instead of legacy `GenerateNewBufFName`.
+// journals with different prefix could share same directory.
+func WithSegmentNaming(naming SegmentNaming) OptionFunc {
+	return func(o *option) (err error) {
+		if err = naming.validate(); err != nil {
+			return err
+		}
+
+		o.naming = &naming
+		return nil
+	}
+}
+
+// WithDeadLetter retry replay handler up to `maxAttempts` times for each record,
+// then move the record into dead-letter journal in sub directory `deadletter`,
+// with the failure reason attached in headers.
+// dead letters could be listed by `ListDeadLetters`, and re-injected by `ReinjectDeadLetters`.
+func WithDeadLetter(maxAttempts int) OptionFunc {
+	return func(o *option) (err error) {
+		if maxAttempts <= 0 {
+			return fmt.Errorf("dead letter max attempts should bigger than 0, but got `%d`", maxAttempts)
+		}
+
+		o.deadLetterMaxAttempts = maxAttempts
+		return nil
+	}
+}
+
+// componentOption logger & clock of journal components
+type componentOption struct {
+	logger *utils.LoggerType
+	clock  Clock
+	// naming only used by `PrepareNewBufFile` & `LoadManifest`
+	naming *SegmentNaming
+}
+
+// ComponentOptionFunc option of journal components,
+// like encoders, decoders, ids set and buf files helpers.
+type ComponentOptionFunc func(*componentOption)
+
+// WithComponentLogger set logger of component, default to `Logger`.
+// nil is ignored.
+func WithComponentLogger(logger *utils.LoggerType) ComponentOptionFunc {
+	return func(o *componentOption) {
+		if logger != nil {
+			o.logger = logger
+		}
+	}
+}
+
+// WithComponentClock set time source of component, default to `utils.Clock`.
+// nil is ignored.
+func WithComponentClock(clock Clock) ComponentOptionFunc {
+	return func(o *componentOption) {
+		if clock != nil {
+			o.clock = clock
+		}
+	}
+}
+
+// WithComponentSegmentNaming set naming of new buf files created by `PrepareNewBufFile`,
+// default to `GenerateNewBufFName`, `LoadManifest` loads manifest of naming's prefix. nil is ignored.
+// naming is updated by generated names, so should not be shared by journals.
+func WithComponentSegmentNaming(naming *SegmentNaming) ComponentOptionFunc {
+	return func(o *componentOption) {
+		if naming != nil {
+			o.naming = naming
+		}
+	}
+}
+
+func newComponentOption(opts ...ComponentOptionFunc) *componentOption {
+	o := &componentOption{
+		logger: Logger,
+		clock:  utils.Clock,
+	}
+	for _, optf := range opts {
+		optf(o)
+	}
+
+	return o
+}
+
+// componentOpts return options to pass logger & clock of journal to components
+func (o *option) componentOpts() []ComponentOptionFunc {
+	return []ComponentOptionFunc{
+		WithComponentLogger(o.logger),
+		WithComponentClock(o.clock),
+	}
+}
@@ -0,0 +1,544 @@
+package journal
+
+// replay.go
+// replay legacy segments by multiple workers.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultReplayBufSize = 1000
+	// maxReplayErrors max errors kept in report, the rest are only counted
+	maxReplayErrors = 100
+	// defaultReplayRetryBackoff wait before the first retry of handler, doubled after each retry
+	defaultReplayRetryBackoff = 100 * time.Millisecond
+	maxReplayRetryBackoff     = time.Minute
+)
+
+// ReplayHandler process record loaded from legacy files
+type ReplayHandler func(data *Data) error
+
+// ReplayOrder how records are delivered to handler
+type ReplayOrder int
+
+const (
+	// ReplayUnordered records of all segments are delivered by workers in any order
+	ReplayUnordered ReplayOrder = iota
+	// ReplaySegmentOrdered records are delivered in file order within segment,
+	// different segments are still replayed concurrently.
+	ReplaySegmentOrdered
+	// ReplayIDOrdered records of all segments are merged and delivered in order of id
+	// by one goroutine, see `WithReplayReorderWindow`.
+	ReplayIDOrdered
+)
+
+func (o ReplayOrder) String() string {
+	switch o {
+	case ReplayUnordered:
+		return "unordered"
+	case ReplaySegmentOrdered:
+		return "segment_ordered"
+	case ReplayIDOrdered:
+		return "id_ordered"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(o))
+	}
+}
+
+// ReplayError failure of replaying segment
+type ReplayError struct {
+	Segment string `json:"segment"`
+	// ID id of failed record, -1 if failed to decode segment
+	ID  int64 `json:"id"`
+	Err error `json:"-"`
+}
+
+func (e *ReplayError) Error() string {
+	if e.ID < 0 {
+		return fmt.Sprintf("segment `%s`: %v", e.Segment, e.Err)
+	}
+
+	return fmt.Sprintf("segment `%s` record %d: %v", e.Segment, e.ID, e.Err)
+}
+
+// ReplayReport result of `Replay`
+type ReplayReport struct {
+	sync.Mutex
+	Segments int `json:"segments"`
+	// SkippedSegments number of segments skipped by filters without decoding
+	SkippedSegments int `json:"skipped_segments"`
+	// Records number of records delivered to handler
+	Records int64 `json:"records"`
+	// Committed number of records skipped since already committed
+	Committed int64 `json:"committed"`
+	// Filtered number of records skipped by filters
+	Filtered int64 `json:"filtered"`
+	// OutOfOrder number of records delivered after bigger id by `ReplayIDOrdered`,
+	// since they are out of reorder window.
+	OutOfOrder int64 `json:"out_of_order"`
+	// Retried number of failed attempts retried, see `WithDeadLetter`
+	Retried int64 `json:"retried"`
+	// DeadLetters number of records moved into dead-letter journal after all attempts failed
+	DeadLetters int64 `json:"dead_letters"`
+	// Failed number of errors, only the first `maxReplayErrors` are kept in `Errors`
+	Failed int64          `json:"failed"`
+	Errors []*ReplayError `json:"errors"`
+}
+
+// OK return true if all segments replayed without error
+func (r *ReplayReport) OK() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.Failed == 0
+}
+
+// Err aggregate errors into one, return nil if OK
+func (r *ReplayReport) Err() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.Failed == 0 {
+		return nil
+	}
+
+	msgs := make([]string, 0, len(r.Errors))
+	for _, e := range r.Errors {
+		msgs = append(msgs, e.Error())
+	}
+	return fmt.Errorf("replay failed with %d errors: %s", r.Failed, strings.Join(msgs, "; "))
+}
+
+func (r *ReplayReport) addError(segment string, id int64, err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.Failed++
+	if len(r.Errors) < maxReplayErrors {
+		r.Errors = append(r.Errors, &ReplayError{
+			Segment: segment,
+			ID:      id,
+			Err:     err,
+		})
+	}
+}
+
+func (r *ReplayReport) addOutOfOrder() {
+	r.Lock()
+	defer r.Unlock()
+	r.OutOfOrder++
+}
+
+func (r *ReplayReport) addRecord() {
+	r.Lock()
+	defer r.Unlock()
+	r.Records++
+}
+
+type replayOption struct {
+	*replayFilter
+	workers int
+	order   ReplayOrder
+	// bufSize max records decoded but not delivered
+	bufSize int
+	// reorderWindow max records buffered to reorder by id
+	reorderWindow int
+	// retryBackoff wait before the first retry of handler
+	retryBackoff time.Duration
+}
+
+func newReplayOption() *replayOption {
+	return &replayOption{
+		replayFilter:  newReplayFilter(),
+		workers:       runtime.NumCPU(),
+		order:         ReplayUnordered,
+		bufSize:       defaultReplayBufSize,
+		reorderWindow: defaultReplayReorderWindow,
+		retryBackoff:  defaultReplayRetryBackoff,
+	}
+}
+
+// ReplayOptionFunc option of `Replay`
+type ReplayOptionFunc func(*replayOption) error
+
+// WithReplayWorkers set number of segments decoded at once, default to number of CPU
+func WithReplayWorkers(n int) ReplayOptionFunc {
+	return func(o *replayOption) error {
+		if n <= 0 {
+			return fmt.Errorf("replay workers should bigger than 0, but got `%d`", n)
+		}
+
+		o.workers = n
+		return nil
+	}
+}
+
+// WithReplayOrder set how records are delivered, default to `ReplayUnordered`
+func WithReplayOrder(order ReplayOrder) ReplayOptionFunc {
+	return func(o *replayOption) error {
+		switch order {
+		case ReplayUnordered, ReplaySegmentOrdered, ReplayIDOrdered:
+		default:
+			return fmt.Errorf("unknown replay order `%s`", order)
+		}
+
+		o.order = order
+		return nil
+	}
+}
+
+// WithReplayBufSize set max records decoded but not delivered,
+// only used by `ReplayUnordered`.
+func WithReplayBufSize(size int) ReplayOptionFunc {
+	return func(o *replayOption) error {
+		if size <= 0 {
+			return fmt.Errorf("replay buf size should bigger than 0, but got `%d`", size)
+		}
+
+		o.bufSize = size
+		return nil
+	}
+}
+
+// WithReplayReorderWindow set max records buffered to reorder by id,
+// only used by `ReplayIDOrdered`.
+// records out of window are still delivered, and counted in `ReplayReport.OutOfOrder`.
+func WithReplayReorderWindow(size int) ReplayOptionFunc {
+	return func(o *replayOption) error {
+		if size <= 0 {
+			return fmt.Errorf("replay reorder window should bigger than 0, but got `%d`", size)
+		}
+
+		o.reorderWindow = size
+		return nil
+	}
+}
+
+// WithReplayRetryBackoff set wait before the first retry of handler, default to 100ms.
+// wait is doubled after each retry, up to 1 minute.
+// handler is retried only if `WithDeadLetter` is set.
+func WithReplayRetryBackoff(d time.Duration) ReplayOptionFunc {
+	return func(o *replayOption) error {
+		if d < 0 {
+			return fmt.Errorf("replay retry backoff should not be negative, but got `%s`", d)
+		}
+
+		o.retryBackoff = d
+		return nil
+	}
+}
+
+// replayRecord record waiting to be delivered
+type replayRecord struct {
+	segment string
+	data    *Data
+}
+
+// replayer replay legacy segments by multiple workers
+type replayer struct {
+	*replayOption
+	legacy  *LegacyLoader
+	handler ReplayHandler
+	report  *ReplayReport
+	// maxAttempts attempts of handler for each record
+	maxAttempts int
+	// deadLetters journal to save records failed all attempts, nil if not enabled
+	deadLetters *Journal
+	// attempts failed attempts of records across replays, nil if dead letters not enabled
+	attempts *replayAttempts
+	// done number of finished segments
+	done int64
+}
+
+// Replay deliver all uncommitted records in legacy segments to handler by multiple workers,
+// handler should be concurrency safe.
+// segments are cleaned if all records are delivered without error,
+// except filters are set by options like `WithReplayFromID`.
+// records failed all attempts are moved into dead letters if `WithDeadLetter` is set.
+//
+// could not run with `LoadLegacyBuf` at the same time,
+// return report and aggregated error of all failures.
+func (j *Journal) Replay(ctx context.Context, handler ReplayHandler, opts ...ReplayOptionFunc) (report *ReplayReport, err error) {
+	opt := newReplayOption()
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return nil, err
+		}
+	}
+	if err = j.checkWritable(); err != nil {
+		return nil, err
+	}
+	if !j.LockLegacy() {
+		return nil, ErrLegacyRunning
+	}
+	defer j.UnLockLegacy()
+
+	report = new(ReplayReport)
+	legacy := j.getLegacy()
+	if legacy == nil {
+		return report, nil
+	}
+
+	dataFNames, err := legacy.replayFiles()
+	if err != nil {
+		j.logger.Error("load all ids", zap.Error(err))
+	}
+	r := &replayer{
+		replayOption: opt,
+		legacy:       legacy,
+		handler:      handler,
+		report:       report,
+		maxAttempts:  1,
+	}
+	if j.deadLetters != nil {
+		r.maxAttempts = j.deadLetterMaxAttempts
+		r.deadLetters = j.deadLetters
+		if r.attempts, err = loadReplayAttempts(
+			filepath.Join(j.deadLetters.bufDirPath, replayAttemptsFileName)); err != nil {
+			return report, errors.Wrap(err, "load replay attempts")
+		}
+	}
+	if opt.isFiltered() {
+		var matched []string
+		for _, fpath := range dataFNames {
+			if opt.matchSegment(fpath) {
+				matched = append(matched, fpath)
+			}
+		}
+		report.SkippedSegments = len(dataFNames) - len(matched)
+		dataFNames = matched
+	}
+	j.logger.Info("replay legacy segments",
+		zap.Int("segments", len(dataFNames)),
+		zap.Int("skipped_segments", report.SkippedSegments),
+		zap.Int("workers", opt.workers),
+		zap.String("order", opt.order.String()))
+	report.Segments = len(dataFNames)
+	legacy.metrics.SetGauge(metricReplayFilesTotal, float64(len(dataFNames)))
+	legacy.metrics.SetGauge(metricReplayFilesDone, 0)
+	if opt.order == ReplayIDOrdered {
+		r.runMerge(ctx, dataFNames)
+	} else {
+		r.run(ctx, dataFNames)
+	}
+
+	// dead letters are flushed whatever replay succeeded,
+	// otherwise failed records would be moved into dead letters again by next replay
+	flushErr := r.flushDeadLetters()
+	switch {
+	case ctx.Err() != nil:
+		err = errors.Wrap(ctx.Err(), "replay")
+	case report.Err() != nil:
+		err = report.Err()
+	default:
+		err = flushErr
+	}
+	if err != nil {
+		if flushErr != nil && flushErr != err {
+			j.logger.Error("flush dead letters", zap.Error(flushErr))
+		}
+		return report, err
+	}
+	// records not matched by filters are not replayed
+	if opt.isFiltered() {
+		return report, nil
+	}
+
+	// only mark segments consumed, files are archived & removed in background
+	j.RLock()
+	err = j.cleanLegacy()
+	j.RUnlock()
+	if err != nil {
+		j.logger.Error("clean legacy", zap.Error(err))
+		return report, nil
+	}
+	if err = r.attempts.release(segmentNames(dataFNames)...); err != nil {
+		j.logger.Error("release replay attempts", zap.Error(err))
+	}
+	return report, nil
+}
+
+// run replay all data files, block until finished
+func (r *replayer) run(ctx context.Context, dataFNames []string) {
+	fpathChan := make(chan string)
+	go func() {
+		defer close(fpathChan)
+		for _, fpath := range dataFNames {
+			select {
+			case fpathChan <- fpath:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		wg         sync.WaitGroup
+		handlerWg  sync.WaitGroup
+		recordChan chan *replayRecord
+	)
+	deliver := r.deliver
+	if r.order == ReplayUnordered {
+		recordChan = make(chan *replayRecord, r.bufSize)
+		deliver = func(ctx context.Context, rec *replayRecord) error {
+			select {
+			case recordChan <- rec:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		for i := 0; i < r.workers; i++ {
+			handlerWg.Add(1)
+			go func() {
+				defer handlerWg.Done()
+				for rec := range recordChan {
+					if err := r.deliver(ctx, rec); err != nil {
+						r.report.addError(rec.segment, rec.data.ID, err)
+					}
+				}
+			}()
+		}
+	}
+
+	for i := 0; i < r.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fpath := range fpathChan {
+				r.replaySegment(ctx, fpath, deliver)
+			}
+		}()
+	}
+
+	wg.Wait()
+	if recordChan != nil {
+		close(recordChan)
+		handlerWg.Wait()
+	}
+}
+
+// deliver send record to handler, retry with backoff until `maxAttempts`,
+// then move record into dead letters if enabled.
+func (r *replayer) deliver(ctx context.Context, rec *replayRecord) (err error) {
+	last := r.attempts.get(rec)
+	if last.IsDeadLetter {
+		// moved into dead letters by previous replay
+		return nil
+	}
+
+	backoff := r.retryBackoff
+	for attempts := last.Attempts + 1; ; attempts++ {
+		if err = r.handler(rec.data); err == nil {
+			r.attempts.done(rec)
+			break
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if attempts >= r.maxAttempts {
+			if r.deadLetters == nil {
+				return err
+			}
+			return r.deadLetter(ctx, rec, attempts, err)
+		}
+		r.attempts.fail(rec, attempts)
+
+		r.report.Lock()
+		r.report.Retried++
+		r.report.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		if backoff *= 2; backoff > maxReplayRetryBackoff {
+			backoff = maxReplayRetryBackoff
+		}
+	}
+
+	r.report.addRecord()
+	r.legacy.metrics.AddCounter(metricReplayRecords, 1)
+	return nil
+}
+
+// replaySegment decode data file and deliver uncommitted records,
+// stop segment if failed to deliver.
+func (r *replayer) replaySegment(ctx context.Context, fpath string,
+	deliver func(context.Context, *replayRecord) error) {
+	name := SegmentName(fpath)
+	defer r.finishSegment()
+
+	fp, err := os.Open(fpath)
+	if err != nil {
+		r.report.addError(name, -1, errors.Wrapf(err, "open file `%s`", fpath))
+		return
+	}
+	defer fp.Close()
+	dec, err := r.legacy.newDataDecoder(fp)
+	if err != nil {
+		r.legacy.metrics.AddCounter(metricCorruptedRecords, 1)
+		r.legacy.emitCorruption(fpath, err)
+		r.report.addError(name, -1, errors.Wrapf(err, "decode data file `%s`", fpath))
+		return
+	}
+	defer dec.Close()
+
+	for ctx.Err() == nil {
+		data := new(Data)
+		if err = dec.Read(data); err == io.EOF {
+			return
+		} else if err != nil {
+			r.legacy.metrics.AddCounter(metricCorruptedRecords, 1)
+			r.legacy.emitCorruption(fpath, err)
+			r.report.addError(name, -1, errors.Wrapf(err, "decode data file `%s`", fpath))
+			return
+		}
+
+		if r.skip(data) {
+			continue
+		}
+		if err = deliver(ctx, &replayRecord{segment: name, data: data}); err != nil {
+			if ctx.Err() == nil {
+				r.report.addError(name, data.ID, err)
+			}
+			return
+		}
+	}
+}
+
+// skip check whether record is filtered or committed
+func (r *replayer) skip(data *Data) bool {
+	var counter *int64
+	switch {
+	case !r.matchRecord(data):
+		counter = &r.report.Filtered
+	case r.legacy.CheckAndRemove(data.ID):
+		counter = &r.report.Committed
+	default:
+		return false
+	}
+
+	r.report.Lock()
+	*counter++
+	r.report.Unlock()
+	return true
+}
+
+// finishSegment count finished segments
+func (r *replayer) finishSegment() {
+	r.report.Lock()
+	defer r.report.Unlock()
+	r.done++
+	r.legacy.metrics.SetGauge(metricReplayFilesDone, float64(r.done))
+}
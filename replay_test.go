@@ -0,0 +1,172 @@
+package journal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// prepareReplayJournal write `nSegs` sealed segments with 10 records for each,
+// records with id divisible by 3 are committed.
+func prepareReplayJournal(t *testing.T, ctx context.Context, nSegs int) (j *Journal, dir string) {
+	var err error
+	j, dir = newTestJournal(t, ctx)
+
+	// legacy loader always skip the latest sealed segment
+	for seg := 0; seg <= nSegs; seg++ {
+		for id := int64(seg * 10); id < int64(seg*10+10); id++ {
+			if err = j.WriteData(&Data{ID: id}); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if id%3 == 0 {
+				if err = j.WriteId(id); err != nil {
+					t.Fatalf("%+v", err)
+				}
+			}
+		}
+		if err = j.Rotate(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	return j, dir
+}
+
+func TestJournalReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, order := range []ReplayOrder{ReplayUnordered, ReplaySegmentOrdered} {
+		t.Run(order.String(), func(t *testing.T) {
+			j, dir := prepareReplayJournal(t, ctx, 5)
+			defer os.RemoveAll(dir)
+			defer j.Close(ctx)
+
+			var (
+				mu   sync.Mutex
+				got  = map[int64]int{}
+				last = map[int64]int64{}
+			)
+			report, err := j.Replay(ctx, func(data *Data) error {
+				mu.Lock()
+				defer mu.Unlock()
+				got[data.ID]++
+				if order == ReplaySegmentOrdered {
+					seg := data.ID / 10
+					if prev, ok := last[seg]; ok && prev > data.ID {
+						return fmt.Errorf("got %d after %d", data.ID, prev)
+					}
+					last[seg] = data.ID
+				}
+				return nil
+			},
+				WithReplayWorkers(3),
+				WithReplayOrder(order),
+				WithReplayBufSize(2),
+			)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if report.Segments != 5 || report.Records != 33 || report.Committed != 17 {
+				t.Fatalf("got wrong report %+v", report)
+			}
+			for id := int64(0); id < 50; id++ {
+				if n := got[id]; (id%3 == 0 && n != 0) || (id%3 != 0 && n != 1) {
+					t.Fatalf("record %d delivered %d times", id, n)
+				}
+			}
+
+			// segments are cleaned after replayed
+			if report, err = j.Replay(ctx, func(*Data) error { return nil }); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if report.Segments != 0 {
+				t.Fatalf("segments should be cleaned, got %+v", report)
+			}
+		})
+	}
+}
+
+func TestJournalReplayError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := prepareReplayJournal(t, ctx, 3)
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+
+	if !j.LockLegacy() {
+		t.Fatal("should acquire legacy lock")
+	}
+	if _, err := j.Replay(ctx, func(*Data) error { return nil }); err != ErrLegacyRunning {
+		t.Fatalf("expect ErrLegacyRunning, got %+v", err)
+	}
+	j.UnLockLegacy()
+
+	report, err := j.Replay(ctx, func(data *Data) error {
+		if data.ID == 11 {
+			return fmt.Errorf("poison")
+		}
+		return nil
+	}, WithReplayOrder(ReplaySegmentOrdered))
+	if err == nil {
+		t.Fatal("should return error")
+	}
+	if report.Failed != 1 || report.Errors[0].ID != 11 {
+		t.Fatalf("got wrong report %+v", report)
+	}
+	// the rest of failed segment is skipped
+	if report.Records != 20-6 {
+		t.Fatalf("expect 14 records, got %d", report.Records)
+	}
+
+	// segments are kept to replay again
+	if report, err = j.Replay(ctx, func(*Data) error { return nil }); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if report.Segments != 3 {
+		t.Fatalf("expect 3 segments, got %+v", report)
+	}
+}
+
+func TestJournalReplayRetryBackoff(t *testing.T) {
+	if err := WithReplayRetryBackoff(-time.Second)(newReplayOption()); err == nil {
+		t.Fatal("should not accept negative backoff")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := newTestJournal(t, ctx, WithDeadLetter(3))
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+
+	err := j.WriteData(&Data{ID: 1})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	// legacy loader always skip the latest sealed segment
+	for i := 0; i < 2; i++ {
+		if err = j.Rotate(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	var attempts []time.Time
+	if _, err = j.Replay(ctx, func(*Data) error {
+		attempts = append(attempts, time.Now())
+		return fmt.Errorf("temporary")
+	}, WithReplayRetryBackoff(50*time.Millisecond)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(attempts) != 3 {
+		t.Fatalf("expect 3 attempts, got %d", len(attempts))
+	}
+	if d := attempts[1].Sub(attempts[0]); d < 50*time.Millisecond {
+		t.Fatalf("first retry should wait backoff, got %s", d)
+	}
+	if d := attempts[2].Sub(attempts[1]); d < 100*time.Millisecond {
+		t.Fatalf("backoff should be doubled, got %s", d)
+	}
+}
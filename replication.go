@@ -0,0 +1,734 @@
+package journal
+
+// replication.go
+// ship segments from leader journal to follower over TCP.
+//
+// frame: | type 1B | header len 4B | header json | payload len 4B | payload |
+//
+//	follower -> leader: hello (files & sizes already received), ack
+//	leader -> follower: chunk, seal, remove
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	replMsgHello byte = iota + 1
+	replMsgChunk
+	replMsgAck
+	replMsgSeal
+	replMsgRemove
+)
+
+const (
+	defaultReplicationInterval  = 1 * time.Second
+	defaultReplicationChunkSize = 1024 * 1024
+	// replMaxFrameSize max bytes of header or payload
+	replMaxFrameSize = 64 * 1024 * 1024
+)
+
+// replMessage header of replication frame
+type replMessage struct {
+	Segment  string       `json:"segment,omitempty"`
+	DataFile string       `json:"data_file,omitempty"`
+	IdsFile  string       `json:"ids_file,omitempty"`
+	File     string       `json:"file,omitempty"`
+	Offset   int64        `json:"offset"`
+	Meta     *SegmentMeta `json:"meta,omitempty"`
+	// Files files' size on follower, sent by hello
+	Files map[string]int64 `json:"files,omitempty"`
+	// Sealed sealed segments on follower, sent by hello
+	Sealed []string `json:"sealed,omitempty"`
+
+	payload []byte
+}
+
+func writeReplMessage(w *bufio.Writer, typ byte, msg *replMessage) (err error) {
+	header, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "marshal header")
+	}
+
+	if err = w.WriteByte(typ); err != nil {
+		return err
+	}
+	for _, cnt := range [][]byte{header, msg.payload} {
+		if err = writeUint32(w, uint32(len(cnt))); err != nil {
+			return err
+		}
+		if _, err = w.Write(cnt); err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+func readReplMessage(r *bufio.Reader) (typ byte, msg *replMessage, err error) {
+	if typ, err = r.ReadByte(); err != nil {
+		return 0, nil, err
+	}
+
+	var cnts [2][]byte
+	for i := range cnts {
+		var l uint32
+		if err = readUint32(r, &l); err != nil {
+			return 0, nil, err
+		}
+		if l > replMaxFrameSize {
+			return 0, nil, fmt.Errorf("frame too large: %d", l)
+		}
+		cnts[i] = make([]byte, l)
+		if _, err = io.ReadFull(r, cnts[i]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	msg = &replMessage{}
+	if err = json.Unmarshal(cnts[0], msg); err != nil {
+		return 0, nil, errors.Wrap(err, "unmarshal header")
+	}
+	msg.payload = cnts[1]
+	return typ, msg, nil
+}
+
+func writeUint32(w io.Writer, v uint32) error {
+	b := make([]byte, 4)
+	bitOrder.PutUint32(b, v)
+	_, err := w.Write(b)
+	return err
+}
+
+func readUint32(r io.Reader, v *uint32) error {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+
+	*v = bitOrder.Uint32(b)
+	return nil
+}
+
+type replicationOption struct {
+	logger       *utils.LoggerType
+	interval     time.Duration
+	chunkSize    int
+	isShipActive bool
+}
+
+func newReplicationOption() *replicationOption {
+	return &replicationOption{
+		logger:    Logger,
+		interval:  defaultReplicationInterval,
+		chunkSize: defaultReplicationChunkSize,
+	}
+}
+
+// ReplicationOptionFunc option of replication leader & follower
+type ReplicationOptionFunc func(*replicationOption) error
+
+// WithReplicationLogger set logger of follower,
+// leader always use logger of journal.
+func WithReplicationLogger(logger *utils.LoggerType) ReplicationOptionFunc {
+	return func(o *replicationOption) error {
+		if logger == nil {
+			return fmt.Errorf("logger cannot be nil")
+		}
+
+		o.logger = logger
+		return nil
+	}
+}
+
+// WithReplicationInterval interval to check new data for leader,
+// and interval to reconnect for follower.
+func WithReplicationInterval(interval time.Duration) ReplicationOptionFunc {
+	return func(o *replicationOption) error {
+		if interval <= 0 {
+			return fmt.Errorf("interval should greater than 0")
+		}
+
+		o.interval = interval
+		return nil
+	}
+}
+
+// WithReplicationChunkSize max bytes of each chunk sent by leader
+func WithReplicationChunkSize(size int) ReplicationOptionFunc {
+	return func(o *replicationOption) error {
+		if size <= 0 || size > replMaxFrameSize {
+			return fmt.Errorf("chunk size should in (0, %d]", replMaxFrameSize)
+		}
+
+		o.chunkSize = size
+		return nil
+	}
+}
+
+// WithReplicationShipActive also ship the live tail of active segment,
+// otherwise only sealed segments are shipped.
+// active data file written by `WithDirectIO` is only shipped up to flushed records,
+// its padding is never shipped.
+func WithReplicationShipActive(isShipActive bool) ReplicationOptionFunc {
+	return func(o *replicationOption) error {
+		o.isShipActive = isShipActive
+		return nil
+	}
+}
+
+// FollowerStat replication status of follower
+type FollowerStat struct {
+	Addr        string           `json:"addr"`
+	ConnectedAt time.Time        `json:"connected_at"`
+	Acked       map[string]int64 `json:"acked"`
+}
+
+type followerState struct {
+	sync.Mutex
+	addr        string
+	connectedAt time.Time
+	// acked bytes of each file persisted by follower
+	acked map[string]int64
+	// sent bytes of each file sent to follower
+	sent   map[string]int64
+	sealed map[string]bool
+}
+
+// ReplicationLeader ship segments in journal's buf directory to followers
+type ReplicationLeader struct {
+	*replicationOption
+	sync.Mutex
+	j         *Journal
+	followers map[*followerState]struct{}
+}
+
+// NewReplicationLeader create new ReplicationLeader, journal should be started
+func NewReplicationLeader(j *Journal, opts ...ReplicationOptionFunc) (l *ReplicationLeader, err error) {
+	if j == nil {
+		return nil, fmt.Errorf("journal cannot be nil")
+	}
+
+	l = &ReplicationLeader{
+		replicationOption: newReplicationOption(),
+		j:                 j,
+		followers:         map[*followerState]struct{}{},
+	}
+	for _, optf := range opts {
+		if err = optf(l.replicationOption); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// Serve accept followers from listener until ctx done
+func (l *ReplicationLeader) Serve(ctx context.Context, ln net.Listener) error {
+	l.j.logger.Info("replication leader listening", zap.String("addr", ln.Addr().String()))
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "accept follower")
+		}
+
+		go func() {
+			if err := l.serveFollower(ctx, conn); err != nil && ctx.Err() == nil {
+				l.j.logger.Error("serve follower", zap.Error(err), zap.String("follower", conn.RemoteAddr().String()))
+			}
+		}()
+	}
+}
+
+// Followers return status of all connected followers
+func (l *ReplicationLeader) Followers() (stats []*FollowerStat) {
+	l.Lock()
+	defer l.Unlock()
+
+	for f := range l.followers {
+		f.Lock()
+		stat := &FollowerStat{
+			Addr:        f.addr,
+			ConnectedAt: f.connectedAt,
+			Acked:       map[string]int64{},
+		}
+		for fname, n := range f.acked {
+			stat.Acked[fname] = n
+		}
+		f.Unlock()
+		stats = append(stats, stat)
+	}
+
+	sort.Slice(stats, func(i, k int) bool {
+		return stats[i].ConnectedAt.Before(stats[k].ConnectedAt)
+	})
+	return stats
+}
+
+func (l *ReplicationLeader) serveFollower(ctx context.Context, conn net.Conn) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	logger := l.j.logger.With(zap.String("follower", conn.RemoteAddr().String()))
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	typ, hello, err := readReplMessage(r)
+	if err != nil {
+		return errors.Wrap(err, "read hello")
+	} else if typ != replMsgHello {
+		return fmt.Errorf("expect hello, got %d", typ)
+	}
+
+	f := &followerState{
+		addr:        conn.RemoteAddr().String(),
+		connectedAt: time.Now(),
+		acked:       map[string]int64{},
+		sent:        map[string]int64{},
+		sealed:      map[string]bool{},
+	}
+	for fname, n := range hello.Files {
+		f.acked[fname] = n
+		f.sent[fname] = n
+	}
+	for _, name := range hello.Sealed {
+		f.sealed[name] = true
+	}
+
+	l.Lock()
+	l.followers[f] = struct{}{}
+	l.Unlock()
+	defer func() {
+		l.Lock()
+		delete(l.followers, f)
+		l.Unlock()
+	}()
+	logger.Info("follower connected", zap.Int("files", len(hello.Files)))
+
+	// receive acks
+	go func() {
+		defer cancel()
+		for {
+			typ, msg, err := readReplMessage(r)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Warn("read from follower", zap.Error(err))
+				}
+				return
+			}
+			if typ != replMsgAck {
+				logger.Warn("unknown message from follower", zap.Uint8("type", typ))
+				continue
+			}
+
+			f.Lock()
+			f.acked[msg.File] = msg.Offset
+			f.Unlock()
+		}
+	}()
+
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		if err = l.ship(f, w); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "ship segments")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// ship send new content of all segments to follower
+func (l *ReplicationLeader) ship(f *followerState, w *bufio.Writer) (err error) {
+	exists := map[string]bool{}
+	segs := l.j.manifest.GetSegments()
+	sort.Slice(segs, func(i, k int) bool {
+		return segmentNameLess(segs[i].Name, segs[k].Name)
+	})
+	for _, seg := range segs {
+		if seg.State == SegmentConsumed ||
+			(seg.State == SegmentActive && !l.isShipActive) {
+			continue
+		}
+
+		isGone := false
+		for _, fname := range []string{seg.DataFile, seg.IdsFile} {
+			if err = l.shipFile(f, w, &seg, fname); err != nil {
+				if os.IsNotExist(err) {
+					// consumed & removed after listed, follower will be notified to remove it
+					isGone = true
+					break
+				}
+				return errors.Wrapf(err, "ship file `%s`", fname)
+			}
+		}
+		if isGone {
+			continue
+		}
+		exists[seg.DataFile] = true
+		exists[seg.IdsFile] = true
+
+		if seg.State != SegmentActive && !f.sealed[seg.Name] {
+			if err = writeReplMessage(w, replMsgSeal, &replMessage{
+				Segment: seg.Name,
+				Meta:    seg.Meta,
+			}); err != nil {
+				return errors.Wrapf(err, "send seal `%s`", seg.Name)
+			}
+			f.sealed[seg.Name] = true
+		}
+	}
+
+	// segments removed by leader
+	var removed []string
+	for fname := range f.sent {
+		if !exists[fname] {
+			removed = append(removed, fname)
+		}
+	}
+	for _, name := range segmentNames(removed) {
+		if err = writeReplMessage(w, replMsgRemove, &replMessage{Segment: name}); err != nil {
+			return errors.Wrapf(err, "send remove `%s`", name)
+		}
+		delete(f.sealed, name)
+	}
+	for _, fname := range removed {
+		delete(f.sent, fname)
+		f.Lock()
+		delete(f.acked, fname)
+		f.Unlock()
+	}
+
+	return nil
+}
+
+// shipFile send bytes of file not yet sent
+func (l *ReplicationLeader) shipFile(f *followerState, w *bufio.Writer, seg *ManifestSegment, fname string) (err error) {
+	// must be checked before stat, padding is truncated when sealing
+	flushed, isDirect := l.j.directFlushedLen(fname)
+	fp, err := os.Open(filepath.Join(l.j.bufDirPath, fname))
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if isDirect && flushed < size {
+		size = flushed
+	}
+
+	offset, isSent := f.sent[fname]
+	if offset > size {
+		return fmt.Errorf("follower has %d bytes, but leader only has %d bytes", offset, size)
+	}
+
+	buf := make([]byte, l.chunkSize)
+	for !isSent || offset < size {
+		isSent = true
+		n, err := fp.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if int64(n) > size-offset {
+			n = int(size - offset)
+		}
+
+		if err = writeReplMessage(w, replMsgChunk, &replMessage{
+			Segment:  seg.Name,
+			DataFile: seg.DataFile,
+			IdsFile:  seg.IdsFile,
+			File:     fname,
+			Offset:   offset,
+			payload:  buf[:n],
+		}); err != nil {
+			return err
+		}
+
+		offset += int64(n)
+		f.sent[fname] = offset
+	}
+
+	return nil
+}
+
+// ReplicationFollower receive segments from leader into its own buf directory.
+//
+// to promote follower, stop it, then start a journal on its directory,
+// the received segments will be replayed as legacy.
+type ReplicationFollower struct {
+	*replicationOption
+	sync.Mutex
+	dir      string
+	manifest *Manifest
+	acked    map[string]int64
+}
+
+// NewReplicationFollower create new ReplicationFollower write into `dir`
+func NewReplicationFollower(dir string, opts ...ReplicationOptionFunc) (f *ReplicationFollower, err error) {
+	f = &ReplicationFollower{
+		replicationOption: newReplicationOption(),
+		dir:               dir,
+		acked:             map[string]int64{},
+	}
+	for _, optf := range opts {
+		if err = optf(f.replicationOption); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = PrepareDir(dir, WithComponentLogger(f.logger)); err != nil {
+		return nil, errors.Wrapf(err, "prepare dir `%s`", dir)
+	}
+	if f.manifest, err = OpenManifest(f.logger, dir, nil); err != nil {
+		return nil, errors.Wrapf(err, "open manifest in `%s`", dir)
+	}
+
+	return f, nil
+}
+
+// Acked return bytes of each file persisted by follower
+func (f *ReplicationFollower) Acked() map[string]int64 {
+	f.Lock()
+	defer f.Unlock()
+
+	acked := make(map[string]int64, len(f.acked))
+	for fname, n := range f.acked {
+		acked[fname] = n
+	}
+	return acked
+}
+
+// Run connect to leader and receive segments until ctx done,
+// reconnect if connection broken.
+func (f *ReplicationFollower) Run(ctx context.Context, leaderAddr string) error {
+	logger := f.logger.With(zap.String("leader", leaderAddr), zap.String("dir", f.dir))
+	for {
+		if err := f.runOnce(ctx, leaderAddr); err != nil && ctx.Err() == nil {
+			logger.Warn("replicate from leader, reconnect later", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(f.interval):
+		}
+	}
+}
+
+func (f *ReplicationFollower) runOnce(ctx context.Context, leaderAddr string) (err error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", leaderAddr)
+	if err != nil {
+		return errors.Wrapf(err, "connect to `%s`", leaderAddr)
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	hello, err := f.hello()
+	if err != nil {
+		return err
+	}
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	if err = writeReplMessage(w, replMsgHello, hello); err != nil {
+		return errors.Wrap(err, "send hello")
+	}
+	f.logger.Info("connected to leader", zap.String("leader", leaderAddr), zap.Int("files", len(hello.Files)))
+
+	for {
+		typ, msg, err := readReplMessage(r)
+		if err != nil {
+			return errors.Wrap(err, "read from leader")
+		}
+
+		switch typ {
+		case replMsgChunk:
+			var n int64
+			if n, err = f.writeChunk(msg); err != nil {
+				return errors.Wrapf(err, "write chunk of `%s`", msg.File)
+			}
+			if err = writeReplMessage(w, replMsgAck, &replMessage{File: msg.File, Offset: n}); err != nil {
+				return errors.Wrap(err, "send ack")
+			}
+		case replMsgSeal:
+			if err = checkReplSegment(msg); err != nil {
+				return err
+			}
+			if msg.Meta != nil {
+				if err = SaveSegmentMeta(f.dir, msg.Meta); err != nil {
+					return errors.Wrapf(err, "save meta of `%s`", msg.Segment)
+				}
+			}
+			if err = f.manifest.Seal(msg.Segment, msg.Meta); err != nil {
+				return errors.Wrapf(err, "seal `%s`", msg.Segment)
+			}
+		case replMsgRemove:
+			if err = f.remove(msg.Segment); err != nil {
+				return errors.Wrapf(err, "remove `%s`", msg.Segment)
+			}
+		default:
+			return fmt.Errorf("unknown message type %d", typ)
+		}
+	}
+}
+
+// hello collect files already received
+func (f *ReplicationFollower) hello() (msg *replMessage, err error) {
+	segs, err := ScanSegments(f.dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "scan segments in `%s`", f.dir)
+	}
+
+	msg = &replMessage{Files: map[string]int64{}}
+	for _, seg := range segs {
+		for _, fpath := range []string{seg.DataFile, seg.IdsFile} {
+			if fpath == "" {
+				continue
+			}
+
+			fi, err := os.Stat(fpath)
+			if err != nil {
+				return nil, errors.Wrapf(err, "stat file `%s`", fpath)
+			}
+			msg.Files[filepath.Base(fpath)] = fi.Size()
+		}
+	}
+	for _, seg := range f.manifest.GetSegments() {
+		if seg.State == SegmentSealed && seg.Meta != nil {
+			msg.Sealed = append(msg.Sealed, seg.Name)
+		}
+	}
+
+	f.Lock()
+	f.acked = msg.Files
+	f.Unlock()
+	return msg, nil
+}
+
+// checkReplSegment make sure segment name & meta sent by leader could not escape buf directory
+func checkReplSegment(msg *replMessage) error {
+	if filepath.Base(msg.Segment) != msg.Segment {
+		return fmt.Errorf("invalid segment name `%s`", msg.Segment)
+	}
+	if _, err := ParseSegmentName(msg.Segment); err != nil {
+		return errors.Wrapf(err, "invalid segment name `%s`", msg.Segment)
+	}
+	if msg.Meta != nil && msg.Meta.Name != msg.Segment {
+		return fmt.Errorf("meta `%s` not belong to segment `%s`", msg.Meta.Name, msg.Segment)
+	}
+
+	return nil
+}
+
+// writeChunk write payload at offset, return file size after written
+func (f *ReplicationFollower) writeChunk(msg *replMessage) (n int64, err error) {
+	if err = checkReplSegment(msg); err != nil {
+		return 0, err
+	}
+	for _, fname := range []string{msg.File, msg.DataFile, msg.IdsFile} {
+		if filepath.Base(fname) != fname || !(IsDataFile(fname) || IsIdsFile(fname)) ||
+			SegmentName(fname) != msg.Segment {
+			return 0, fmt.Errorf("invalid file name `%s`", fname)
+		}
+	}
+
+	if f.manifest.GetSegment(msg.Segment) == nil {
+		if err = f.manifest.AddActive(
+			filepath.Join(f.dir, msg.DataFile),
+			filepath.Join(f.dir, msg.IdsFile),
+		); err != nil {
+			return 0, errors.Wrap(err, "add segment into manifest")
+		}
+	}
+
+	fpath := filepath.Join(f.dir, msg.File)
+	fp, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE, FileMode)
+	if err != nil {
+		return 0, errors.Wrapf(err, "open file `%s`", fpath)
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return 0, errors.Wrapf(err, "stat file `%s`", fpath)
+	}
+	if fi.Size() < msg.Offset {
+		return 0, fmt.Errorf("expect offset %d, but only got %d bytes", msg.Offset, fi.Size())
+	} else if fi.Size() > msg.Offset {
+		// leader resent
+		if err = fp.Truncate(msg.Offset); err != nil {
+			return 0, errors.Wrapf(err, "truncate file `%s`", fpath)
+		}
+	}
+
+	if _, err = fp.WriteAt(msg.payload, msg.Offset); err != nil {
+		return 0, errors.Wrapf(err, "write file `%s`", fpath)
+	}
+	if err = fp.Sync(); err != nil {
+		return 0, errors.Wrapf(err, "sync file `%s`", fpath)
+	}
+
+	n = msg.Offset + int64(len(msg.payload))
+	f.Lock()
+	f.acked[msg.File] = n
+	f.Unlock()
+	return n, nil
+}
+
+// remove delete segment consumed by leader
+func (f *ReplicationFollower) remove(name string) (err error) {
+	seg := f.manifest.GetSegment(name)
+	if seg == nil {
+		return nil
+	}
+
+	if err = f.manifest.Transit(SegmentConsumed, name); err != nil {
+		return err
+	}
+	if err = f.manifest.RemoveConsumed(f.logger); err != nil {
+		return err
+	}
+
+	f.Lock()
+	delete(f.acked, seg.DataFile)
+	delete(f.acked, seg.IdsFile)
+	f.Unlock()
+	return nil
+}
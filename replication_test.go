@@ -0,0 +1,324 @@
+package journal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// waitReplicated wait until follower acked all files in leader's directory
+func waitReplicated(t *testing.T, leader *ReplicationLeader, follower *ReplicationFollower, dir string) {
+	for i := 0; ; i++ {
+		if i > 300 {
+			t.Fatalf("timeout waiting for replication, leader %+v, follower %+v",
+				leader.Followers(), follower.Acked())
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		segs, err := ScanSegments(dir)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		followers := leader.Followers()
+		if len(followers) != 1 {
+			continue
+		}
+
+		acked, isDone := follower.Acked(), true
+		for _, seg := range segs {
+			for _, fpath := range []string{seg.DataFile, seg.IdsFile} {
+				fi, err := os.Stat(fpath)
+				if err != nil {
+					t.Fatalf("%+v", err)
+				}
+
+				fname := filepath.Base(fpath)
+				if n, ok := acked[fname]; !ok || n != fi.Size() {
+					isDone = false
+				}
+				if n, ok := followers[0].Acked[fname]; !ok || n != fi.Size() {
+					isDone = false
+				}
+			}
+		}
+		if isDone {
+			return
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	leaderDir, err := ioutil.TempDir("", "journal-test-replication-leader")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(leaderDir)
+	followerDir, err := ioutil.TempDir("", "journal-test-replication-follower")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(followerDir)
+	t.Logf("create directory: %v, %v", leaderDir, followerDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := NewJournal(WithBufDirPath(leaderDir), WithLogger(newTestLogger(t)))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Start(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for id := int64(1); id <= 15; id++ {
+		if err = j.WriteData(&Data{ID: id, Data: map[string]interface{}{"id": id}}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if id%2 == 0 {
+			if err = j.WriteId(id); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		if id == 10 {
+			if err = j.Rotate(ctx); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+	}
+	j.Lock()
+	if err = j.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	j.Unlock()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	leader, err := NewReplicationLeader(j,
+		WithReplicationInterval(10*time.Millisecond),
+		WithReplicationChunkSize(64),
+		WithReplicationShipActive(true),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	go leader.Serve(ctx, ln)
+
+	followerCtx, followerCancel := context.WithCancel(ctx)
+	follower, err := NewReplicationFollower(followerDir, WithReplicationInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	followerDone := make(chan struct{})
+	go func() {
+		follower.Run(followerCtx, ln.Addr().String())
+		close(followerDone)
+	}()
+
+	waitReplicated(t, leader, follower, leaderDir)
+	segs, err := ScanSegments(leaderDir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, seg := range segs {
+		for _, fpath := range []string{seg.DataFile, seg.IdsFile} {
+			expect, err := ioutil.ReadFile(fpath)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(followerDir, filepath.Base(fpath)))
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if string(expect) != string(got) {
+				t.Fatalf("content of `%s` mismatch", fpath)
+			}
+		}
+	}
+	if meta, err := LoadSegmentMeta(filepath.Join(followerDir, filepath.Base(segs[0].DataFile))); err != nil {
+		t.Fatalf("sealed segment should have meta: %+v", err)
+	} else if meta.Records != 10 {
+		t.Fatalf("got wrong meta: %+v", meta)
+	}
+
+	// leader consumed the first segment
+	if err = j.manifest.Transit(SegmentConsumed, segs[0].Name); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.manifest.RemoveConsumed(j.logger); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for i := 0; ; i++ {
+		if i > 300 {
+			t.Fatal("follower should remove consumed segment")
+		}
+		if _, err = os.Stat(filepath.Join(followerDir, filepath.Base(segs[0].DataFile))); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// promote follower
+	followerCancel()
+	<-followerDone
+	j.Close(ctx)
+
+	j2, err := NewJournal(WithBufDirPath(followerDir), WithLogger(newTestLogger(t)))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j2.Start(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer j2.Close(ctx)
+	if err = j2.Rotate(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if !j2.LockLegacy() {
+		t.Fatal("should acquire legacy lock")
+	}
+	var ids []int
+	for {
+		data := new(Data)
+		if err = j2.LoadLegacyBuf(data); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		ids = append(ids, int(data.ID))
+	}
+	sort.Ints(ids)
+	if len(ids) != 3 || ids[0] != 11 || ids[1] != 13 || ids[2] != 15 {
+		t.Fatalf("expect replay uncommitted [11 13 15], got %v", ids)
+	}
+}
+
+func TestReplicationFollowerRejectInvalidSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-replication-invalid")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	follower, err := NewReplicationFollower(dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for _, msg := range []*replMessage{
+		{Segment: "../20200102_00000001", Meta: &SegmentMeta{Name: "../20200102_00000001"}},
+		{Segment: "20200102_00000001", Meta: &SegmentMeta{Name: "../../escaped"}},
+		{Segment: "MANIFEST"},
+	} {
+		if err = checkReplSegment(msg); err == nil {
+			t.Fatalf("should reject segment `%s` with meta %+v", msg.Segment, msg.Meta)
+		}
+	}
+
+	if _, err = follower.writeChunk(&replMessage{
+		Segment:  "20200102_00000001",
+		DataFile: "20200102_00000002.buf",
+		IdsFile:  "20200102_00000001.ids",
+		File:     "20200102_00000002.buf",
+	}); err == nil {
+		t.Fatal("should reject file not belong to segment")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "20200102_00000002.buf")); !os.IsNotExist(err) {
+		t.Fatalf("should not write rejected file, got %+v", err)
+	}
+}
+
+func TestReplicationDirectIOShipActive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, leaderDir := newTestJournal(t, ctx, WithDirectIO(true))
+	defer os.RemoveAll(leaderDir)
+	defer j.Close(ctx)
+	openDirectTestFile(t, leaderDir).Close()
+	os.Remove(filepath.Join(leaderDir, "direct.test"))
+
+	followerDir, err := ioutil.TempDir("", "journal-test-replication-follower")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer os.RemoveAll(followerDir)
+
+	for id := int64(1); id <= 5; id++ {
+		if err = j.WriteData(&Data{ID: id}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	j.Lock()
+	if err = j.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	j.Unlock()
+	activeFname := filepath.Base(j.dataFp.Name())
+	flushed, ok := j.directFlushedLen(activeFname)
+	if !ok || flushed == 0 {
+		t.Fatalf("should get flushed length of active data file, got %d", flushed)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	leader, err := NewReplicationLeader(j,
+		WithReplicationInterval(10*time.Millisecond),
+		WithReplicationShipActive(true),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	go leader.Serve(ctx, ln)
+	follower, err := NewReplicationFollower(followerDir,
+		WithReplicationInterval(10*time.Millisecond),
+		WithReplicationLogger(newTestLogger(t)),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	go follower.Run(ctx, ln.Addr().String())
+
+	for i := 0; follower.Acked()[activeFname] != flushed; i++ {
+		if i > 300 {
+			t.Fatalf("follower should ack %d bytes of active data file, got %+v", flushed, follower.Acked())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// padding is truncated after sealed, follower should keep replicating
+	if err = j.WriteData(&Data{ID: 6}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Rotate(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	j.Lock()
+	if err = j.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	j.Unlock()
+	waitReplicated(t, leader, follower, leaderDir)
+
+	expect, err := ioutil.ReadFile(filepath.Join(leaderDir, activeFname))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(followerDir, activeFname))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(expect, got) {
+		t.Fatalf("content of `%s` mismatch, expect %d bytes, got %d", activeFname, len(expect), len(got))
+	}
+}
@@ -0,0 +1,135 @@
+package journal
+
+// rotate_policy.go
+// decide when to rotate active segment.
+
+import (
+	"fmt"
+	"time"
+)
+
+// RotateStat statistics of active segment
+type RotateStat struct {
+	DataBytes, IdsBytes int64
+	// Records number of records written into data file
+	Records int64
+	// CreatedAt time of last rotate
+	CreatedAt time.Time
+	Now       time.Time
+}
+
+// RotatePolicy decide whether to rotate active segment,
+// checked every `rotateCheckInterval`.
+type RotatePolicy interface {
+	ShouldRotate(stat *RotateStat) bool
+}
+
+// SizeRotatePolicy rotate if data or ids file bigger than limit.
+// zero limit is ignored.
+type SizeRotatePolicy struct {
+	MaxDataBytes, MaxIdsBytes int64
+}
+
+// ShouldRotate implement `RotatePolicy`
+func (p *SizeRotatePolicy) ShouldRotate(stat *RotateStat) bool {
+	return (p.MaxDataBytes > 0 && stat.DataBytes > p.MaxDataBytes) ||
+		(p.MaxIdsBytes > 0 && stat.IdsBytes > p.MaxIdsBytes)
+}
+
+// AgeRotatePolicy rotate if segment existed longer than `MaxAge`,
+// `MaxAge` should be positive.
+type AgeRotatePolicy struct {
+	MaxAge time.Duration
+}
+
+// ShouldRotate implement `RotatePolicy`
+func (p *AgeRotatePolicy) ShouldRotate(stat *RotateStat) bool {
+	return stat.Now.Sub(stat.CreatedAt) > p.MaxAge
+}
+
+// RecordsRotatePolicy rotate if segment contains more than `MaxRecords` records
+type RecordsRotatePolicy struct {
+	MaxRecords int64
+}
+
+// ShouldRotate implement `RotatePolicy`
+func (p *RecordsRotatePolicy) ShouldRotate(stat *RotateStat) bool {
+	return stat.Records > p.MaxRecords
+}
+
+// AlignedRotatePolicy rotate if wall clock crossed boundary of `Interval`,
+// like `time.Hour` rotates at the top of every hour.
+// boundaries are aligned to UTC. `Interval` should be positive.
+type AlignedRotatePolicy struct {
+	Interval time.Duration
+}
+
+// ShouldRotate implement `RotatePolicy`
+func (p *AlignedRotatePolicy) ShouldRotate(stat *RotateStat) bool {
+	return stat.Now.Truncate(p.Interval).After(stat.CreatedAt)
+}
+
+// AnyRotatePolicy rotate if any policy satisfied
+type AnyRotatePolicy []RotatePolicy
+
+// ShouldRotate implement `RotatePolicy`
+func (ps AnyRotatePolicy) ShouldRotate(stat *RotateStat) bool {
+	for _, p := range ps {
+		if p.ShouldRotate(stat) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllRotatePolicy rotate if all policies satisfied
+type AllRotatePolicy []RotatePolicy
+
+// ShouldRotate implement `RotatePolicy`
+func (ps AllRotatePolicy) ShouldRotate(stat *RotateStat) bool {
+	for _, p := range ps {
+		if !p.ShouldRotate(stat) {
+			return false
+		}
+	}
+
+	return len(ps) != 0
+}
+
+// checkRotatePolicy reject policies that rotate on every check
+func checkRotatePolicy(policy RotatePolicy) error {
+	switch p := policy.(type) {
+	case *AgeRotatePolicy:
+		if p.MaxAge <= 0 {
+			return fmt.Errorf("MaxAge of AgeRotatePolicy should be positive, got %s", p.MaxAge)
+		}
+	case *AlignedRotatePolicy:
+		if p.Interval <= 0 {
+			return fmt.Errorf("Interval of AlignedRotatePolicy should be positive, got %s", p.Interval)
+		}
+	case AnyRotatePolicy:
+		for _, sub := range p {
+			if err := checkRotatePolicy(sub); err != nil {
+				return err
+			}
+		}
+	case AllRotatePolicy:
+		for _, sub := range p {
+			if err := checkRotatePolicy(sub); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// defaultRotatePolicy rotate if data file bigger than `bufSizeBytes`
+// or segment older than `rotateDuration`
+func defaultRotatePolicy(bufSizeBytes int64, rotateDuration time.Duration) RotatePolicy {
+	return AnyRotatePolicy{
+		&SizeRotatePolicy{MaxDataBytes: bufSizeBytes},
+		&AgeRotatePolicy{MaxAge: rotateDuration},
+	}
+}
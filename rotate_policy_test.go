@@ -0,0 +1,109 @@
+package journal
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRotatePolicy(t *testing.T) {
+	created := time.Date(2020, 1, 1, 10, 59, 0, 0, time.UTC)
+	stat := &RotateStat{
+		DataBytes: 100,
+		IdsBytes:  10,
+		Records:   5,
+		CreatedAt: created,
+		Now:       created.Add(30 * time.Second),
+	}
+
+	for name, c := range map[string]struct {
+		policy RotatePolicy
+		expect bool
+	}{
+		"data size":          {&SizeRotatePolicy{MaxDataBytes: 99}, true},
+		"data size not":      {&SizeRotatePolicy{MaxDataBytes: 100}, false},
+		"ids size":           {&SizeRotatePolicy{MaxIdsBytes: 9}, true},
+		"size disabled":      {&SizeRotatePolicy{}, false},
+		"age":                {&AgeRotatePolicy{MaxAge: 10 * time.Second}, true},
+		"age not":            {&AgeRotatePolicy{MaxAge: time.Minute}, false},
+		"records":            {&RecordsRotatePolicy{MaxRecords: 4}, true},
+		"records not":        {&RecordsRotatePolicy{MaxRecords: 5}, false},
+		"aligned not":        {&AlignedRotatePolicy{Interval: time.Hour}, false},
+		"aligned minute":     {&AlignedRotatePolicy{Interval: time.Minute}, false},
+		"aligned 10 seconds": {&AlignedRotatePolicy{Interval: 10 * time.Second}, true},
+		"any": {AnyRotatePolicy{
+			&RecordsRotatePolicy{MaxRecords: 100},
+			&AgeRotatePolicy{MaxAge: 10 * time.Second},
+		}, true},
+		"any not": {AnyRotatePolicy{}, false},
+		"all": {AllRotatePolicy{
+			&RecordsRotatePolicy{MaxRecords: 4},
+			&AgeRotatePolicy{MaxAge: 10 * time.Second},
+		}, true},
+		"all not": {AllRotatePolicy{
+			&RecordsRotatePolicy{MaxRecords: 100},
+			&AgeRotatePolicy{MaxAge: 10 * time.Second},
+		}, false},
+		"all empty": {AllRotatePolicy{}, false},
+	} {
+		if got := c.policy.ShouldRotate(stat); got != c.expect {
+			t.Errorf("%s: expect %v, got %v", name, c.expect, got)
+		}
+	}
+
+	stat.Now = created.Add(time.Minute)
+	if !(&AlignedRotatePolicy{Interval: time.Hour}).ShouldRotate(stat) {
+		t.Error("should rotate at the top of hour")
+	}
+}
+
+func TestCheckRotatePolicy(t *testing.T) {
+	for name, policy := range map[string]RotatePolicy{
+		"zero age":          &AgeRotatePolicy{},
+		"negative age":      &AgeRotatePolicy{MaxAge: -time.Second},
+		"zero interval":     &AlignedRotatePolicy{},
+		"nested in any":     AnyRotatePolicy{&SizeRotatePolicy{MaxDataBytes: 1}, &AgeRotatePolicy{}},
+		"nested in all":     AllRotatePolicy{AnyRotatePolicy{&AlignedRotatePolicy{}}},
+		"negative interval": &AlignedRotatePolicy{Interval: -time.Hour},
+	} {
+		if _, err := NewJournal(WithRotatePolicy(policy)); err == nil {
+			t.Errorf("%s: should reject policy", name)
+		}
+	}
+
+	if err := checkRotatePolicy(AnyRotatePolicy{
+		&AgeRotatePolicy{MaxAge: time.Hour},
+		&AlignedRotatePolicy{Interval: time.Hour},
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+func TestJournalRotatePolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := newTestJournal(t, ctx,
+		WithRotateCheckInterval(10*time.Millisecond),
+		WithRotatePolicy(&RecordsRotatePolicy{MaxRecords: 2}),
+	)
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+	var err error
+
+	for id := int64(0); id < 3; id++ {
+		if err = j.WriteData(&Data{ID: id}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	for i := 0; ; i++ {
+		if i > 100 {
+			t.Fatal("should rotate by records")
+		}
+		if len(j.manifest.GetSegments()) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
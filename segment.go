@@ -0,0 +1,240 @@
+package journal
+
+// segment.go
+// statistics of sealed data & ids files pair.
+
+import (
+	"encoding/json"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	segmentMetaFileSuffix = ".meta"
+)
+
+var (
+	// metaFileNameReg segment meta sidecar file name pattern
+	metaFileNameReg = regexp.MustCompile(`^` + segmentNamePattern + `\.meta(\.tmp)?$`)
+	crc32Table      = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// recordStat statistics of records written into one file
+type recordStat struct {
+	MinID, MaxID, Count int64
+	FirstAt, LastAt     time.Time
+	// MinTimestamp, MaxTimestamp range of records' `Timestamp`, only for data file
+	MinTimestamp, MaxTimestamp time.Time
+}
+
+func (s *recordStat) add(id int64, now time.Time) {
+	if s.Count == 0 {
+		s.MinID, s.MaxID = id, id
+		s.FirstAt = now
+	} else {
+		if id < s.MinID {
+			s.MinID = id
+		}
+		if id > s.MaxID {
+			s.MaxID = id
+		}
+	}
+
+	s.LastAt = now
+	s.Count++
+}
+
+func (s *recordStat) addTimestamp(ts time.Time) {
+	if s.MinTimestamp.IsZero() || ts.Before(s.MinTimestamp) {
+		s.MinTimestamp = ts
+	}
+	if ts.After(s.MaxTimestamp) {
+		s.MaxTimestamp = ts
+	}
+}
+
+// checksumWriter calculate crc32 and length of all bytes written into file
+type checksumWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+	n   int64
+}
+
+func newChecksumWriter(w io.Writer) *checksumWriter {
+	return &checksumWriter{
+		w:   w,
+		crc: crc32.New(crc32Table),
+	}
+}
+
+func (c *checksumWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.crc.Write(p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+// Checksum return crc32 of bytes written
+func (c *checksumWriter) Checksum() uint32 {
+	return c.crc.Sum32()
+}
+
+// Len return length of bytes written
+func (c *checksumWriter) Len() int64 {
+	return c.n
+}
+
+// SegmentMeta statistics of sealed data & ids files pair,
+// persisted as sidecar file `<yyyymmdd_nnnnnnnn>.meta` when rotating.
+type SegmentMeta struct {
+	// Name segment name without extension, like `20060102_00000001`
+	Name     string `json:"name"`
+	DataFile string `json:"data_file"`
+	IdsFile  string `json:"ids_file"`
+
+	// MinID, MaxID range of data ids
+	MinID   int64 `json:"min_id"`
+	MaxID   int64 `json:"max_id"`
+	Records int64 `json:"records"`
+	// MinCommittedID, MaxCommittedID range of ids in ids file
+	MinCommittedID int64 `json:"min_committed_id"`
+	MaxCommittedID int64 `json:"max_committed_id"`
+	CommittedIDs   int64 `json:"committed_ids"`
+
+	DataBytes int64 `json:"data_bytes"`
+	IdsBytes  int64 `json:"ids_bytes"`
+	// DataChecksum, IdsChecksum crc32(castagnoli) of whole file
+	DataChecksum uint32 `json:"data_checksum"`
+	IdsChecksum  uint32 `json:"ids_checksum"`
+
+	FirstWriteAt time.Time `json:"first_write_at"`
+	LastWriteAt  time.Time `json:"last_write_at"`
+	SealedAt     time.Time `json:"sealed_at"`
+	// MinTimestamp, MaxTimestamp range of records' `Timestamp`,
+	// may differ from write time if `Timestamp` set by caller.
+	// zero if sealed by older versions.
+	MinTimestamp time.Time `json:"min_timestamp"`
+	MaxTimestamp time.Time `json:"max_timestamp"`
+}
+
+// ContainsID check whether data id in segment's range
+func (m *SegmentMeta) ContainsID(id int64) bool {
+	return m.Records != 0 && m.MinID <= id && id <= m.MaxID
+}
+
+// SegmentName return segment name of data/ids/meta file path,
+// `/dir/20060102_00000001.buf.gz` -> `20060102_00000001`
+func SegmentName(fpath string) string {
+	fname := filepath.Base(fpath)
+	if idx := strings.Index(fname, "."); idx != -1 {
+		return fname[:idx]
+	}
+
+	return fname
+}
+
+// segmentMetaFpath return sidecar meta file path of data/ids file
+func segmentMetaFpath(fpath string) string {
+	return filepath.Join(filepath.Dir(fpath), SegmentName(fpath)+segmentMetaFileSuffix)
+}
+
+// newSegmentMeta build meta by encoders' statistics
+func newSegmentMeta(dataFpath, idsFpath string, dataEnc *DataEncoder, idsEnc *IdsEncoder, now time.Time) *SegmentMeta {
+	m := &SegmentMeta{
+		Name:     SegmentName(dataFpath),
+		DataFile: filepath.Base(dataFpath),
+		IdsFile:  filepath.Base(idsFpath),
+		SealedAt: now,
+	}
+	if dataEnc != nil {
+		m.MinID = dataEnc.stat.MinID
+		m.MaxID = dataEnc.stat.MaxID
+		m.Records = dataEnc.stat.Count
+		m.FirstWriteAt = dataEnc.stat.FirstAt
+		m.LastWriteAt = dataEnc.stat.LastAt
+		m.MinTimestamp = dataEnc.stat.MinTimestamp
+		m.MaxTimestamp = dataEnc.stat.MaxTimestamp
+		m.DataBytes = dataEnc.checksum.Len()
+		m.DataChecksum = dataEnc.checksum.Checksum()
+	}
+	if idsEnc != nil {
+		m.MinCommittedID = idsEnc.stat.MinID
+		m.MaxCommittedID = idsEnc.stat.MaxID
+		m.CommittedIDs = idsEnc.stat.Count
+		m.IdsBytes = idsEnc.checksum.Len()
+		m.IdsChecksum = idsEnc.checksum.Checksum()
+	}
+
+	return m
+}
+
+// SaveSegmentMeta write meta into sidecar file in `dir`
+func SaveSegmentMeta(dir string, m *SegmentMeta) (err error) {
+	cnt, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "marshal segment meta")
+	}
+
+	return writeFileAtomic(filepath.Join(dir, m.Name+segmentMetaFileSuffix), cnt)
+}
+
+// LoadSegmentMeta load sidecar meta of data/ids file.
+// return error satisfied `os.IsNotExist` if segment not sealed.
+func LoadSegmentMeta(fpath string) (m *SegmentMeta, err error) {
+	cnt, err := ioutil.ReadFile(segmentMetaFpath(fpath))
+	if err != nil {
+		return nil, err
+	}
+
+	m = new(SegmentMeta)
+	if err = json.Unmarshal(cnt, m); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal segment meta `%s`", segmentMetaFpath(fpath))
+	}
+
+	return m, nil
+}
+
+// LoadSegmentMetas load all sealed segments' meta in directory, sorted by name
+func LoadSegmentMetas(dir string) (metas []*SegmentMeta, err error) {
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read dir `%s`", dir)
+	}
+
+	var m *SegmentMeta
+	for _, f := range fs {
+		if !metaFileNameReg.MatchString(f.Name()) ||
+			strings.HasSuffix(f.Name(), ".tmp") {
+			continue
+		}
+
+		if m, err = LoadSegmentMeta(filepath.Join(dir, f.Name())); err != nil {
+			return nil, err
+		}
+		metas = append(metas, m)
+	}
+
+	sort.Slice(metas, func(i, k int) bool {
+		return segmentNameLess(metas[i].Name, metas[k].Name)
+	})
+	return metas, nil
+}
+
+// removeSegmentMeta delete sidecar meta of data/ids file if exists
+func removeSegmentMeta(fpath string) error {
+	if err := os.Remove(segmentMetaFpath(fpath)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "remove segment meta of `%s`", fpath)
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package journal
+
+import (
+	"context"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegmentName(t *testing.T) {
+	for fpath, expect := range map[string]string{
+		"/a/b/20060102_00000001.buf.gz": "20060102_00000001",
+		"20060102_00000001.ids":         "20060102_00000001",
+		"20060102_00000001.meta":        "20060102_00000001",
+		"20060102_00000001":             "20060102_00000001",
+	} {
+		if got := SegmentName(fpath); got != expect {
+			t.Errorf("expect %v, got %v", expect, got)
+		}
+	}
+}
+
+func TestSegmentMeta(t *testing.T) {
+	for _, isCompress := range [...]bool{false, true} {
+		dir, err := ioutil.TempDir("", "journal-test-segment")
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		t.Logf("create directory: %v", dir)
+		defer os.RemoveAll(dir)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		j, err := NewJournal(
+			WithBufDirPath(dir),
+			WithIsCompress(isCompress),
+		)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = j.Start(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		dataFname := j.dataFp.Name()
+		for id := int64(10); id < 20; id++ {
+			if err = j.WriteData(&Data{ID: id, Data: map[string]interface{}{"id": id}}); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if id%2 == 0 {
+				if err = j.WriteId(id); err != nil {
+					t.Fatalf("%+v", err)
+				}
+			}
+		}
+		if err = j.Rotate(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		meta, err := LoadSegmentMeta(dataFname)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		t.Logf("got meta: %+v", meta)
+		if meta.MinID != 10 || meta.MaxID != 19 || meta.Records != 10 {
+			t.Fatalf("got wrong data stat: %+v", meta)
+		}
+		if meta.MinCommittedID != 10 || meta.MaxCommittedID != 18 || meta.CommittedIDs != 5 {
+			t.Fatalf("got wrong ids stat: %+v", meta)
+		}
+
+		cnt, err := ioutil.ReadFile(dataFname)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if int64(len(cnt)) != meta.DataBytes {
+			t.Fatalf("expect %v bytes, got %v", len(cnt), meta.DataBytes)
+		}
+		if crc32.Checksum(cnt, crc32Table) != meta.DataChecksum {
+			t.Fatal("data checksum mismatch")
+		}
+
+		metas, err := j.FindSegmentsByID(15)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if len(metas) != 1 || metas[0].DataFile != filepath.Base(dataFname) {
+			t.Fatalf("should find segment `%s`, got %+v", dataFname, metas)
+		}
+		if metas, err = j.FindSegmentsByID(100); err != nil {
+			t.Fatalf("%+v", err)
+		} else if len(metas) != 0 {
+			t.Fatalf("should not find any segment, got %+v", metas)
+		}
+
+		if err = j.Rotate(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		maxID, err := j.LoadMaxId()
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if maxID != 18 {
+			t.Fatalf("expect max id 18, got %v", maxID)
+		}
+		j.Close(ctx)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"io"
 	"os"
 	"sync"
+	"time"
 
 	utils "github.com/Laisky/go-utils"
 	"github.com/Laisky/zap"
@@ -33,15 +34,33 @@ const (
 // BaseSerializer base serializer
 type BaseSerializer struct {
 	sync.Mutex
+	*componentOption
 	isCompress bool
 }
 
+// countWriter count bytes written
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
 // DataEncoder data serializer
 type DataEncoder struct {
 	BaseSerializer
 	// writeChan chan interface{}
 	writer   *msgp.Writer
 	gzWriter utils.CompressorItf
+	checksum *checksumWriter
+	counter  *countWriter
+	// direct aligned writer of file opened with O_DIRECT, nil if not direct io
+	direct *alignedWriter
+	stat   recordStat
 }
 
 // DataDecoder data deserializer
@@ -50,6 +69,8 @@ type DataDecoder struct {
 	// readChan chan interface{}
 	reader   *msgp.Reader
 	gzReader io.Reader
+	// mmap mapped region of file, reader is nil if decode by mmap
+	mmap, rest []byte
 }
 
 // IdsEncoder ids serializer
@@ -58,6 +79,8 @@ type IdsEncoder struct {
 	baseID   int64
 	writer   *bufio.Writer
 	gzWriter utils.CompressorItf
+	checksum *checksumWriter
+	stat     recordStat
 }
 
 // IdsDecoder ids deserializer
@@ -69,39 +92,61 @@ type IdsDecoder struct {
 }
 
 // NewDataEncoder create new DataEncoder
-func NewDataEncoder(fp *os.File, isCompress bool) (enc *DataEncoder, err error) {
+func NewDataEncoder(fp *os.File, isCompress bool, opts ...ComponentOptionFunc) (enc *DataEncoder, err error) {
 	enc = &DataEncoder{
 		BaseSerializer: BaseSerializer{
-			isCompress: isCompress,
+			componentOption: newComponentOption(opts...),
+			isCompress:      isCompress,
 		},
+		checksum: newChecksumWriter(fp),
 	}
 	if isCompress {
 		if enc.gzWriter, err = utils.NewGZCompressor(
-			fp,
+			enc.checksum,
 			utils.WithCompressBufSizeByte(BufSize),
 			utils.WithCompressLevel(gzip.BestSpeed),
 			utils.WithPGzipNBlocks(defaultCompressNBlocks),
 		); err != nil {
 			return nil, err
 		}
-		enc.writer = msgp.NewWriterSize(enc.gzWriter, BufSize)
+		enc.counter = &countWriter{w: enc.gzWriter}
 	} else {
-		enc.writer = msgp.NewWriterSize(fp, BufSize)
+		enc.counter = &countWriter{w: enc.checksum}
+	}
+	enc.writer = msgp.NewWriterSize(enc.counter, BufSize)
+	return enc, nil
+}
+
+// NewDirectIODataEncoder create new DataEncoder on file opened with O_DIRECT.
+//
+// records are buffered until flush, the last partial block is padded with zeros,
+// `Close` will truncate the padding.
+func NewDirectIODataEncoder(fp *os.File, opts ...ComponentOptionFunc) (enc *DataEncoder, err error) {
+	enc = &DataEncoder{
+		BaseSerializer: BaseSerializer{
+			componentOption: newComponentOption(opts...),
+		},
+		direct: newAlignedWriter(fp),
 	}
+	enc.checksum = newChecksumWriter(enc.direct)
+	enc.counter = &countWriter{w: enc.checksum}
+	enc.writer = msgp.NewWriterSize(enc.counter, BufSize)
 	return enc, nil
 }
 
 // NewIdsEncoder create new IdsEncoder
-func NewIdsEncoder(fp *os.File, isCompress bool) (enc *IdsEncoder, err error) {
+func NewIdsEncoder(fp *os.File, isCompress bool, opts ...ComponentOptionFunc) (enc *IdsEncoder, err error) {
 	enc = &IdsEncoder{
 		BaseSerializer: BaseSerializer{
-			isCompress: isCompress,
+			componentOption: newComponentOption(opts...),
+			isCompress:      isCompress,
 		},
-		baseID: -1,
+		baseID:   -1,
+		checksum: newChecksumWriter(fp),
 	}
 	if isCompress {
 		if enc.gzWriter, err = utils.NewGZCompressor(
-			fp,
+			enc.checksum,
 			utils.WithCompressBufSizeByte(BufSize),
 			utils.WithCompressLevel(gzip.BestSpeed),
 		); err != nil {
@@ -109,16 +154,17 @@ func NewIdsEncoder(fp *os.File, isCompress bool) (enc *IdsEncoder, err error) {
 		}
 		enc.writer = bufio.NewWriterSize(enc.gzWriter, BufSize)
 	} else {
-		enc.writer = bufio.NewWriterSize(fp, BufSize)
+		enc.writer = bufio.NewWriterSize(enc.checksum, BufSize)
 	}
 	return enc, nil
 }
 
 // NewIdsDecoder create new IdsDecoder
-func NewIdsDecoder(fp *os.File, isCompress bool) (decoder *IdsDecoder, err error) {
+func NewIdsDecoder(fp *os.File, isCompress bool, opts ...ComponentOptionFunc) (decoder *IdsDecoder, err error) {
 	decoder = &IdsDecoder{
 		BaseSerializer: BaseSerializer{
-			isCompress: isCompress,
+			componentOption: newComponentOption(opts...),
+			isCompress:      isCompress,
 		},
 		baseID: -1,
 	}
@@ -136,10 +182,11 @@ func NewIdsDecoder(fp *os.File, isCompress bool) (decoder *IdsDecoder, err error
 }
 
 // NewDataDecoder create new DataDecoder
-func NewDataDecoder(fp *os.File, isCompress bool) (decoder *DataDecoder, err error) {
+func NewDataDecoder(fp *os.File, isCompress bool, opts ...ComponentOptionFunc) (decoder *DataDecoder, err error) {
 	decoder = &DataDecoder{
 		BaseSerializer: BaseSerializer{
-			isCompress: isCompress,
+			componentOption: newComponentOption(opts...),
+			isCompress:      isCompress,
 		},
 	}
 	if isCompress {
@@ -148,25 +195,62 @@ func NewDataDecoder(fp *os.File, isCompress bool) (decoder *DataDecoder, err err
 			return nil, errors.Wrap(err, "use gzip read ids fp")
 		}
 		decoder.reader = msgp.NewReaderSize(decoder.gzReader, BufSize)
-	} else {
-		decoder.reader = msgp.NewReaderSize(fp, BufSize)
+		return decoder, nil
+	}
+
+	// only read records, padding of direct io is skipped
+	n, err := dataLogicalLen(fp)
+	if err != nil {
+		return nil, err
+	}
+	pos, err := fp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get offset of file `%s`", fp.Name())
+	}
+	if n < pos {
+		n = pos
 	}
-	return decoder, err
+	decoder.reader = msgp.NewReaderSize(io.LimitReader(fp, n-pos), BufSize)
+	return decoder, nil
 }
 
-// Write serialize data info fp
+// Write serialize data info fp, record is written with write time if `msg.Timestamp` is zero
 func (enc *DataEncoder) Write(msg *Data) (err error) {
+	_, _, err = enc.writeN(msg)
+	return err
+}
+
+// writeN serialize data info fp, return number of encoded bytes and timestamp written.
+// `msg` is not modified.
+func (enc *DataEncoder) writeN(msg *Data) (n int64, ts time.Time, err error) {
 	enc.Lock()
 	defer enc.Unlock()
+	n = enc.counter.n
+	now := enc.clock.GetUTCNow()
+	if msg.Timestamp.IsZero() {
+		stamped := *msg
+		stamped.Timestamp = now
+		msg = &stamped
+	}
 	if err = msg.EncodeMsg(enc.writer); err != nil {
-		return errors.Wrap(err, "Encode journal data")
+		return 0, ts, errors.Wrap(err, "Encode journal data")
 	}
+	enc.stat.add(msg.ID, now)
+	enc.stat.addTimestamp(msg.Timestamp)
 	enc.writer.Flush()
+	n = enc.counter.n - n
 	if enc.isCompress {
 		err = enc.gzWriter.WriteFooter()
 	}
 
-	return
+	return n, msg.Timestamp, err
+}
+
+// count return number of records written
+func (enc *DataEncoder) count() int64 {
+	enc.Lock()
+	defer enc.Unlock()
+	return enc.stat.Count
 }
 
 // Flush flush buf to fp
@@ -181,9 +265,26 @@ func (enc *DataEncoder) Flush() (err error) {
 			return errors.Wrap(err, "flush data encoder gz")
 		}
 	}
+	if enc.direct != nil {
+		if err = enc.direct.Flush(); err != nil {
+			return errors.Wrap(err, "flush data encoder direct io")
+		}
+	}
 	return
 }
 
+// flushedLen return logical length of records flushed into file opened with O_DIRECT,
+// return false if not direct io.
+func (enc *DataEncoder) flushedLen() (n int64, ok bool) {
+	enc.Lock()
+	defer enc.Unlock()
+	if enc.direct == nil {
+		return 0, false
+	}
+
+	return enc.direct.Flushed(), true
+}
+
 // Close close data gzip writer
 func (enc *DataEncoder) Close() (err error) {
 	enc.Lock()
@@ -196,12 +297,21 @@ func (enc *DataEncoder) Close() (err error) {
 			return errors.Wrap(err, "close data gz encoder")
 		}
 	}
+	if enc.direct != nil {
+		if err = enc.direct.Close(); err != nil {
+			return errors.Wrap(err, "close data encoder direct io")
+		}
+	}
 	enc.writer = nil
 	return
 }
 
 // Read deserialize data from fp
 func (dec *DataDecoder) Read(data *Data) (err error) {
+	if dec.reader == nil {
+		return dec.readMmap(data)
+	}
+	data.resetOmitted()
 	if err = data.DecodeMsg(dec.reader); err == msgp.WrapError(io.EOF) {
 		return io.EOF
 	} else if err != nil {
@@ -221,7 +331,7 @@ func (enc *IdsEncoder) Write(id int64) (err error) {
 	if enc.baseID == -1 {
 		enc.baseID = id
 		offset = id // set first id as baseID
-		Logger.Debug("set write base id", zap.Int64("baseID", id))
+		enc.logger.Debug("set write base id", zap.Int64("baseID", id))
 	} else {
 		offset = id - enc.baseID // offset
 	}
@@ -231,6 +341,7 @@ func (enc *IdsEncoder) Write(id int64) (err error) {
 	if err = binary.Write(enc.writer, bitOrder, offset); err != nil {
 		return errors.Wrap(err, "write ids")
 	}
+	enc.stat.add(id, enc.clock.GetUTCNow())
 	enc.writer.Flush()
 	if enc.isCompress {
 		err = enc.gzWriter.WriteFooter()
@@ -272,6 +383,23 @@ func (enc *IdsEncoder) Close() (err error) {
 	return
 }
 
+// Read deserialize one id from fp, return io.EOF if all ids finished
+func (dec *IdsDecoder) Read() (id int64, err error) {
+	if err = binary.Read(dec.reader, bitOrder, &id); err != nil {
+		return 0, err
+	}
+
+	if dec.baseID == -1 {
+		// first id in head of file is baseID
+		dec.baseID = id
+	} else {
+		// another ids in rest file are offsets
+		id += dec.baseID
+	}
+
+	return id, nil
+}
+
 // LoadMaxId load the maxium id in all files
 func (dec *IdsDecoder) LoadMaxId() (maxId int64, err error) {
 	var id int64
@@ -283,7 +411,7 @@ func (dec *IdsDecoder) LoadMaxId() (maxId int64, err error) {
 		}
 
 		if dec.baseID == -1 {
-			Logger.Debug("set baseID", zap.Int64("id", id))
+			dec.logger.Debug("set baseID", zap.Int64("id", id))
 			dec.baseID = id
 		} else {
 			id += dec.baseID
@@ -311,7 +439,7 @@ func (dec *IdsDecoder) ReadAllToBmap() (ids *roaring.Bitmap, err error) {
 
 		if dec.baseID == -1 {
 			// first id in head of file is baseID
-			Logger.Debug("set baseID", zap.Int64("id", id))
+			dec.logger.Debug("set baseID", zap.Int64("id", id))
 			dec.baseID = id
 		} else {
 			// another ids in rest file are offsets
@@ -337,7 +465,7 @@ func (dec *IdsDecoder) ReadAllToInt64Set(ids Int64SetItf) (err error) {
 
 		if dec.baseID == -1 {
 			// first id in head of file is baseID
-			Logger.Debug("set baseID", zap.Int64("id", id))
+			dec.logger.Debug("set baseID", zap.Int64("id", id))
 			dec.baseID = id
 		} else {
 			// another ids in rest file are offsets
@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	utils "github.com/Laisky/go-utils"
 	"github.com/ugorji/go/codec"
@@ -59,6 +60,46 @@ func TestSerializer(t *testing.T) {
 	}
 }
 
+func TestSerializerNotModifyRecord(t *testing.T) {
+	fp, err := ioutil.TempFile("", "journal-test")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer fp.Close()
+	defer os.Remove(fp.Name())
+
+	now := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	encoder, err := NewDataEncoder(fp, false, WithComponentClock(&fakeClock{now: now}))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	m := &Data{ID: 1}
+	if err = encoder.Write(m); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !m.Timestamp.IsZero() {
+		t.Fatalf("record should not be stamped, got %v", m.Timestamp)
+	}
+	if err = encoder.Flush(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if _, err = fp.Seek(0, 0); err != nil {
+		t.Fatalf("seek: %+v", err)
+	}
+	decoder, err := NewDataDecoder(fp, false)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	got := new(Data)
+	if err = decoder.Read(got); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !got.Timestamp.Equal(now) {
+		t.Fatalf("expect written at %v, got %v", now, got.Timestamp)
+	}
+}
+
 func BenchmarkSerializerWithCompress(b *testing.B) {
 	fp, err := ioutil.TempFile("", "journal-test")
 	if err != nil {
@@ -7,7 +7,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/Laisky/go-utils"
 	"github.com/Laisky/zap"
 	"github.com/RoaringBitmap/roaring"
 )
@@ -116,8 +115,11 @@ func (s *Int64Set) GetLen() int {
 // Int64SetWithTTL int64 set with TTL
 type Int64SetWithTTL struct {
 	sync.RWMutex
-	chgLock  *sync.Mutex
-	stopChan chan struct{}
+	*componentOption
+	chgLock   *sync.Mutex
+	stopChan  chan struct{}
+	stopOnce  sync.Once
+	rotatorWg sync.WaitGroup
 
 	ttl      time.Duration
 	ttlSec   int64
@@ -130,22 +132,26 @@ const (
 )
 
 // NewInt64SetWithTTL create new int64 set with ttl
-func NewInt64SetWithTTL(ctx context.Context, ttl time.Duration) *Int64SetWithTTL {
-	if ttl < defaultIDSetTTL {
-		Logger.Warn("TTL too small")
-	}
-
+func NewInt64SetWithTTL(ctx context.Context, ttl time.Duration, opts ...ComponentOptionFunc) *Int64SetWithTTL {
 	s := &Int64SetWithTTL{
-		stopChan: make(chan struct{}),
-		chgLock:  &sync.Mutex{},
-		ttl:      ttl,
-		ttlSec:   int64(ttl.Seconds()),
-		ng:       &sync.Map{},
+		componentOption: newComponentOption(opts...),
+		stopChan:        make(chan struct{}),
+		chgLock:         &sync.Mutex{},
+		ttl:             ttl,
+		ttlSec:          int64(ttl.Seconds()),
+		ng:              &sync.Map{},
+	}
+	if ttl < defaultIDSetTTL {
+		s.logger.Warn("TTL too small")
 	}
-	Logger.Debug("NewInt64SetWithTTL",
+	s.logger.Debug("NewInt64SetWithTTL",
 		zap.Duration("ttl", s.ttl),
 	)
-	go s.StartRotate(ctx)
+	s.rotatorWg.Add(1)
+	go func() {
+		defer s.rotatorWg.Done()
+		s.StartRotate(ctx)
+	}()
 	return s
 }
 
@@ -156,7 +162,7 @@ func (s *Int64SetWithTTL) Add(id int) {
 
 // AddInt64 add int64
 func (s *Int64SetWithTTL) AddInt64(id int64) {
-	t := utils.Clock.GetUTCNow().Unix() + s.ttlSec
+	t := s.clock.GetUTCNow().Unix() + s.ttlSec
 	s.RLock()
 	if _, ok := s.ng.LoadOrStore(id, t); !ok {
 		atomic.AddInt64(&s.ngN, 1)
@@ -177,7 +183,7 @@ func (s *Int64SetWithTTL) CheckAndRemove(id int64) (ok bool) {
 	s.RLock()
 	defer s.RUnlock()
 	var (
-		t  = utils.Clock.GetUTCNow().Unix()
+		t  = s.clock.GetUTCNow().Unix()
 		vi interface{}
 	)
 	if _, ok = s.ng.Load(id); ok {
@@ -188,7 +194,7 @@ func (s *Int64SetWithTTL) CheckAndRemove(id int64) (ok bool) {
 	if s.og != nil {
 		if vi, ok = s.og.Load(id); ok {
 			if vi.(int64) > t {
-				Logger.Debug("found in og")
+				s.logger.Debug("found in og")
 				return true
 			}
 
@@ -209,26 +215,31 @@ func (s *Int64SetWithTTL) GetLen() (r int) {
 	return r
 }
 
-// Close close set, stop rotate
+// Close close set, wait rotator exit.
+// it is safe to call Close multiple times.
 func (s *Int64SetWithTTL) Close() {
-	s.stopChan <- struct{}{}
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+	})
+	s.rotatorWg.Wait()
 }
 
 // StartRotate start counter rotate
 func (s *Int64SetWithTTL) StartRotate(ctx context.Context) {
-	defer Logger.Info("StartRotate exit")
+	defer s.logger.Info("StartRotate exit")
+	ticker := time.NewTicker(s.ttl)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-s.stopChan:
 			return
 		case <-ctx.Done():
 			return
-		default:
+		case <-ticker.C:
 		}
 
-		time.Sleep(s.ttl)
 		s.Lock()
-		Logger.Debug("rotate Int64SetWithTTL")
+		s.logger.Debug("rotate Int64SetWithTTL")
 		s.ogN, s.ngN = s.ngN, 0
 		s.og = s.ng
 		s.ng = &sync.Map{}
@@ -333,3 +333,41 @@ func BenchmarkSet(b *testing.B) {
 		}
 	})
 }
+
+func TestInt64SetWithTTLClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewInt64SetWithTTL(ctx, time.Hour)
+
+	done := make(chan struct{})
+	go func() {
+		s.Close()
+		s.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("close should not wait ttl")
+	}
+}
+
+func TestInt64SetWithTTLClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := &fakeClock{now: time.Now()}
+	s := NewInt64SetWithTTL(ctx, 1*time.Second, WithComponentClock(clock))
+	defer s.Close()
+
+	s.AddInt64(1)
+	time.Sleep(1100 * time.Millisecond) // rotate into old generation
+	if !s.CheckAndRemove(1) {
+		t.Fatal("should not expire before clock advanced")
+	}
+
+	clock.Add(2 * time.Second)
+	if s.CheckAndRemove(1) {
+		t.Fatal("should expire after clock advanced")
+	}
+}
@@ -0,0 +1,230 @@
+package journal
+
+// snapshot.go
+// point-in-time snapshot & restore of buf directory.
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+// Snapshot write consistent point-in-time copy of journal into `dstDir`.
+//
+// writing is blocked during snapshot, active segment is sealed first,
+// then all unconsumed & unquarantined segments are hard-linked (or copied if link failed)
+// into `dstDir` together with a manifest.
+// `dstDir` should be empty or not exist.
+func (j *Journal) Snapshot(ctx context.Context, dstDir string) (err error) {
+	if err = prepareEmptyDir(dstDir); err != nil {
+		return err
+	}
+
+	for !j.rotateLock.TryLock() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	defer j.rotateLock.ForceRelease()
+	j.Lock()
+	defer j.Unlock()
+
+	if err = j.checkWritable(); err != nil {
+		return err
+	}
+	if err = j.rotate(ctx); err != nil {
+		return errors.Wrap(err, "seal active segment")
+	}
+
+	snap := &Manifest{
+		dir:    dstDir,
+		prefix: j.manifest.prefix,
+		clock:  j.clock,
+	}
+	for _, seg := range j.manifest.GetSegments() {
+		switch seg.State {
+		case SegmentActive, SegmentConsumed, SegmentQuarantined:
+			continue
+		}
+
+		for _, fname := range []string{seg.DataFile, seg.IdsFile, seg.Name + segmentMetaFileSuffix} {
+			if err = linkOrCopyFile(filepath.Join(j.bufDirPath, fname), filepath.Join(dstDir, fname)); err != nil {
+				return errors.Wrapf(err, "snapshot segment `%s`", seg.Name)
+			}
+		}
+
+		seg := seg
+		seg.State = SegmentSealed
+		snap.Segments = append(snap.Segments, &seg)
+	}
+
+	// keep id allocator continuous
+	marks, err := filepath.Glob(filepath.Join(j.bufDirPath, "*"+idMarkFileSuffix))
+	if err != nil {
+		return errors.Wrap(err, "find id mark files")
+	}
+	for _, fpath := range marks {
+		if err = copyFileAtomic(fpath, filepath.Join(dstDir, filepath.Base(fpath))); err != nil {
+			return errors.Wrapf(err, "copy id mark file `%s`", fpath)
+		}
+	}
+
+	if err = snap.save(); err != nil {
+		return errors.Wrap(err, "save snapshot manifest")
+	}
+
+	j.logger.Info("snapshot journal",
+		zap.String("dst", dstDir),
+		zap.Int("segments", len(snap.Segments)))
+	return nil
+}
+
+// Restore validate snapshot created by `Journal.Snapshot`,
+// then copy it into `bufDirPath`, so it could be loaded by `NewJournal`.
+// `bufDirPath` should not contain any segment.
+// `opts` set logger & clock, like `WithComponentLogger(logger)`.
+func Restore(snapshotDir, bufDirPath string, opts ...ComponentOptionFunc) (err error) {
+	opt := newComponentOption(opts...)
+	prefix, err := snapshotManifestPrefix(snapshotDir)
+	if err != nil {
+		return err
+	}
+	snap, err := loadManifest(opt.clock, snapshotDir, prefix)
+	if err != nil {
+		return errors.Wrapf(err, "load snapshot manifest in `%s`", snapshotDir)
+	}
+
+	var fnames []string
+	for _, seg := range snap.Segments {
+		for _, fname := range []string{seg.DataFile, seg.IdsFile} {
+			if fname == "" {
+				continue
+			}
+			if _, err = os.Stat(filepath.Join(snapshotDir, fname)); err != nil {
+				return errors.Wrapf(err, "segment `%s` lost file", seg.Name)
+			}
+			fnames = append(fnames, fname)
+		}
+
+		metaFname := seg.Name + segmentMetaFileSuffix
+		if _, err = os.Stat(filepath.Join(snapshotDir, metaFname)); err == nil {
+			fnames = append(fnames, metaFname)
+		}
+	}
+
+	report, err := Verify(snapshotDir, WithVerifyLogger(opt.logger), WithVerifyClock(opt.clock))
+	if err != nil {
+		return errors.Wrapf(err, "verify snapshot `%s`", snapshotDir)
+	}
+	if !report.OK() {
+		for _, issue := range report.Issues {
+			if issue.Type != IssueSequenceGap {
+				return fmt.Errorf("snapshot is broken, %d issues, first: %s `%s` at %d: %s",
+					len(report.Issues), issue.Type, issue.File, issue.Offset, issue.Message)
+			}
+		}
+	}
+
+	if err = PrepareDir(bufDirPath); err != nil {
+		return errors.Wrapf(err, "prepare dir `%s`", bufDirPath)
+	}
+	if segs, err := ScanSegments(bufDirPath); err != nil {
+		return errors.Wrapf(err, "scan segments in `%s`", bufDirPath)
+	} else if len(segs) != 0 {
+		return fmt.Errorf("directory `%s` already contains %d segments", bufDirPath, len(segs))
+	}
+
+	marks, err := filepath.Glob(filepath.Join(snapshotDir, "*"+idMarkFileSuffix))
+	if err != nil {
+		return errors.Wrap(err, "find id mark files")
+	}
+	for _, fpath := range marks {
+		fnames = append(fnames, filepath.Base(fpath))
+	}
+	for _, fname := range fnames {
+		if err = copyFileAtomic(filepath.Join(snapshotDir, fname), filepath.Join(bufDirPath, fname)); err != nil {
+			return errors.Wrapf(err, "copy file `%s`", fname)
+		}
+	}
+
+	// write manifest at last, directory without manifest will be rebuilt by scanning
+	snap.Lock()
+	snap.dir = bufDirPath
+	err = snap.save()
+	snap.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "save manifest")
+	}
+
+	opt.logger.Info("restore snapshot",
+		zap.String("snapshot", snapshotDir),
+		zap.String("dst", bufDirPath),
+		zap.Int("segments", len(snap.Segments)),
+		zap.Int64("records", report.Records))
+	return nil
+}
+
+// snapshotManifestPrefix find segment name prefix of the only manifest in snapshot
+func snapshotManifestPrefix(snapshotDir string) (prefix string, err error) {
+	fpaths, err := filepath.Glob(filepath.Join(snapshotDir, manifestFileName+"*"))
+	if err != nil {
+		return "", errors.Wrap(err, "find manifest files")
+	}
+
+	var prefixes []string
+	for _, fpath := range fpaths {
+		name := filepath.Base(fpath)
+		if name == manifestFileName {
+			prefixes = append(prefixes, "")
+		} else if p := strings.TrimPrefix(name, manifestFileName+"-"); p != name && segmentNamePrefixReg.MatchString(p) {
+			prefixes = append(prefixes, p)
+		}
+	}
+	if len(prefixes) != 1 {
+		return "", fmt.Errorf("expect one manifest in snapshot `%s`, got %d", snapshotDir, len(prefixes))
+	}
+
+	return prefixes[0], nil
+}
+
+// prepareEmptyDir create directory, return error if it is not empty
+func prepareEmptyDir(dir string) (err error) {
+	if err = PrepareDir(dir); err != nil {
+		return errors.Wrapf(err, "prepare dir `%s`", dir)
+	}
+
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrapf(err, "read dir `%s`", dir)
+	}
+	if len(fs) != 0 {
+		return fmt.Errorf("directory `%s` is not empty", dir)
+	}
+
+	return nil
+}
+
+// linkOrCopyFile hard link file, fallback to copy if failed.
+// skip if `src` not exists.
+func linkOrCopyFile(src, dst string) (err error) {
+	if _, err = os.Stat(src); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err = os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	return copyFileAtomic(src, dst)
+}
@@ -0,0 +1,229 @@
+package journal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestSnapshotAndRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-snapshot")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+	var (
+		bufDir     = filepath.Join(dir, "buf")
+		snapDir    = filepath.Join(dir, "snapshot")
+		restoreDir = filepath.Join(dir, "restore")
+	)
+	if err = PrepareDir(bufDir); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := NewJournal(WithBufDirPath(bufDir), WithLogger(newTestLogger(t)), WithIsCompress(true))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Start(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for id := int64(1); id <= 10; id++ {
+		if err = j.WriteData(&Data{ID: id}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if id%2 == 0 {
+			if err = j.WriteId(id); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		if id == 5 {
+			if err = j.Rotate(ctx); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+	}
+	lastID, err := j.NextID()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err = j.Snapshot(ctx, snapDir); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Snapshot(ctx, snapDir); err == nil {
+		t.Fatal("should not snapshot into non-empty directory")
+	}
+
+	// records after snapshot should not be included
+	for id := int64(11); id <= 15; id++ {
+		if err = j.WriteData(&Data{ID: id}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	j.Close(ctx)
+
+	if err = Restore(snapDir, restoreDir); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = Restore(snapDir, restoreDir); err == nil {
+		t.Fatal("should not restore into directory contains segments")
+	}
+
+	j2, err := NewJournal(WithBufDirPath(restoreDir), WithLogger(newTestLogger(t)), WithIsCompress(true))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j2.Start(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer j2.Close(ctx)
+	if id, err := j2.NextID(); err != nil {
+		t.Fatalf("%+v", err)
+	} else if id <= lastID {
+		t.Fatalf("id allocator should continue after %d, got %d", lastID, id)
+	}
+	if err = j2.Rotate(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if !j2.LockLegacy() {
+		t.Fatal("should acquire legacy lock")
+	}
+	var ids []int
+	for {
+		data := new(Data)
+		if err = j2.LoadLegacyBuf(data); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		ids = append(ids, int(data.ID))
+	}
+	sort.Ints(ids)
+	if len(ids) != 5 || ids[0] != 1 || ids[4] != 9 {
+		t.Fatalf("expect replay [1 3 5 7 9], got %v", ids)
+	}
+
+	// broken snapshot
+	segs, err := ScanSegments(snapDir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	fp, err := os.OpenFile(segs[0].DataFile, os.O_APPEND|os.O_WRONLY, FileMode)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = fp.Write([]byte("broken")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	fp.Close()
+	if err = Restore(snapDir, filepath.Join(dir, "restore-broken")); err == nil {
+		t.Fatal("should not restore broken snapshot")
+	}
+}
+
+func TestSnapshotWithPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-snapshot")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+	var (
+		bufDir     = filepath.Join(dir, "buf")
+		snapDir    = filepath.Join(dir, "snapshot")
+		restoreDir = filepath.Join(dir, "restore")
+		naming     = SegmentNaming{Prefix: "app"}
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := NewJournal(WithBufDirPath(bufDir), WithLogger(newTestLogger(t)), WithSegmentNaming(naming))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Start(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for id := int64(1); id <= 3; id++ {
+		if err = j.WriteData(&Data{ID: id}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err = j.Snapshot(ctx, snapDir); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	j.Close(ctx)
+
+	if _, err = os.Stat(manifestFpathWithPrefix(snapDir, naming.Prefix)); err != nil {
+		t.Fatalf("snapshot should save manifest of prefix: %+v", err)
+	}
+	if err = Restore(snapDir, restoreDir, WithComponentLogger(newTestLogger(t))); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	m, err := loadManifest(newComponentOption().clock, restoreDir, naming.Prefix)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(m.Segments) != 1 || m.Segments[0].State != SegmentSealed {
+		t.Fatalf("got wrong restored manifest %+v", m.Segments)
+	}
+}
+
+func TestSnapshotSkipQuarantined(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := newTestJournal(t, ctx)
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+	snapDir := filepath.Join(dir, "snapshot")
+
+	var err error
+	for id := int64(1); id <= 4; id++ {
+		if err = j.WriteData(&Data{ID: id}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if id%2 == 0 {
+			if err = j.Rotate(ctx); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+	}
+	segs := j.manifest.GetSegments()
+	quarantined := segs[0].Name
+	if err = j.manifest.Transit(SegmentQuarantined, quarantined); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err = j.Snapshot(ctx, snapDir); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	snapSegs, err := ScanSegments(snapDir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(snapSegs) != len(segs)-1 {
+		t.Fatalf("expect %d segments in snapshot, got %d", len(segs)-1, len(snapSegs))
+	}
+	for _, seg := range snapSegs {
+		if seg.Name == quarantined {
+			t.Fatalf("quarantined segment `%s` should not be snapshot", quarantined)
+		}
+	}
+	m, err := LoadManifest(snapDir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if seg := m.GetSegment(quarantined); seg != nil {
+		t.Fatalf("quarantined segment should not be in snapshot manifest, got %+v", seg)
+	}
+}
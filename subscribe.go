@@ -0,0 +1,416 @@
+package journal
+
+// subscribe.go
+// deliver records to in-process subscribers in real time.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	// subscribeCatchUpPendingSize max live records buffered
+	// while subscriber is catching up from disk
+	subscribeCatchUpPendingSize = 10000
+)
+
+var errStopIteration = fmt.Errorf("stop iteration")
+
+// Position location of record in journal.
+// `Index` is the zero-based index of record in segment's data file.
+type Position struct {
+	Segment string `json:"segment"`
+	Index   int64  `json:"index"`
+}
+
+type subscribeOption struct {
+	from *Position
+}
+
+// SubscribeOptionFunc option of `Subscribe`
+type SubscribeOptionFunc func(*subscribeOption) error
+
+// WithSubscribeFrom resume subscription from position,
+// records on disk since `pos` will be delivered before live records.
+func WithSubscribeFrom(pos Position) SubscribeOptionFunc {
+	return func(o *subscribeOption) error {
+		if pos.Segment == "" || pos.Index < 0 {
+			return fmt.Errorf("invalid position %+v", pos)
+		}
+
+		o.from = &pos
+		return nil
+	}
+}
+
+// SubscriberStat statistics of subscriber
+type SubscriberStat struct {
+	ID       int64  `json:"id"`
+	Buffered int    `json:"buffered"`
+	Dropped  uint64 `json:"dropped"`
+	IsLive   bool   `json:"is_live"`
+}
+
+type subscriber struct {
+	sync.Mutex
+	id      int64
+	ch      chan *Data
+	pending []*Data
+	// overflowChan closed if too many records written during catching up
+	overflowChan chan struct{}
+	isLive,
+	isClosed,
+	isOverflowed bool
+	dropped uint64
+	// err why subscriber is closed
+	err error
+}
+
+// Subscription records delivered to subscriber
+type Subscription struct {
+	// C receive records, closed after subscription stopped
+	C   <-chan *Data
+	sub *subscriber
+}
+
+// Err return why subscription stopped, nil if still running.
+//
+// ctx's error if ctx done, `ErrClosed` if journal closed,
+// `ErrSubscriberOverflow` if too many records written during catching up,
+// or the error of catching up, which means records since the position are not all delivered.
+func (s *Subscription) Err() error {
+	s.sub.Lock()
+	defer s.sub.Unlock()
+	return s.sub.err
+}
+
+// send deliver data without blocking, return false if data is dropped
+func (s *subscriber) send(data *Data) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case s.isClosed, s.isOverflowed:
+		return true
+	case !s.isLive:
+		if len(s.pending) < subscribeCatchUpPendingSize {
+			s.pending = append(s.pending, data)
+			return true
+		}
+
+		// could not switch to live without missing records
+		s.isOverflowed = true
+		s.pending = nil
+		close(s.overflowChan)
+	default:
+		select {
+		case s.ch <- data:
+			return true
+		default:
+		}
+	}
+
+	s.dropped++
+	return false
+}
+
+func (s *subscriber) close(err error) {
+	s.Lock()
+	s.isClosed = true
+	s.err = err
+	s.pending = nil
+	close(s.ch)
+	s.Unlock()
+}
+
+func (s *subscriber) stat() *SubscriberStat {
+	s.Lock()
+	defer s.Unlock()
+	return &SubscriberStat{
+		ID:       s.id,
+		Buffered: len(s.ch) + len(s.pending),
+		Dropped:  s.dropped,
+		IsLive:   s.isLive,
+	}
+}
+
+// subscribers all subscribers of journal
+type subscribers struct {
+	sync.RWMutex
+	seq  int64
+	subs map[int64]*subscriber
+}
+
+func newSubscribers() *subscribers {
+	return &subscribers{
+		subs: map[int64]*subscriber{},
+	}
+}
+
+func (ss *subscribers) add(s *subscriber) int {
+	ss.Lock()
+	defer ss.Unlock()
+	ss.seq++
+	s.id = ss.seq
+	ss.subs[s.id] = s
+	return len(ss.subs)
+}
+
+func (ss *subscribers) isEmpty() bool {
+	ss.RLock()
+	defer ss.RUnlock()
+	return len(ss.subs) == 0
+}
+
+func (ss *subscribers) remove(s *subscriber) int {
+	ss.Lock()
+	defer ss.Unlock()
+	delete(ss.subs, s.id)
+	return len(ss.subs)
+}
+
+// publish send data to all subscribers, return number of drops
+func (ss *subscribers) publish(data *Data) (dropped int) {
+	ss.RLock()
+	defer ss.RUnlock()
+	for _, s := range ss.subs {
+		if !s.send(data) {
+			dropped++
+		}
+	}
+
+	return dropped
+}
+
+// Subscribe deliver each record after `WriteData` persisted it.
+// records are copied from the written ones, and shared by all subscribers, should not be modified.
+//
+// subscriber will not block writing, records are dropped if
+// channel is full, drops are reported by `SubscriberStats` & metrics.
+// channel will be closed after ctx done or journal closed, reason is reported by `Subscription.Err`.
+//
+// subscription resumed by `WithSubscribeFrom` buffers live records during catching up,
+// channel will be closed if more than 10000 records are written before catching up finished,
+// or catching up failed, subscriber should subscribe again from the last received position.
+func (j *Journal) Subscribe(ctx context.Context, bufferSize int, opts ...SubscribeOptionFunc) (*Subscription, error) {
+	if bufferSize < 0 {
+		return nil, fmt.Errorf("bufferSize should not be negative")
+	}
+	opt := &subscribeOption{}
+	for _, optf := range opts {
+		if err := optf(opt); err != nil {
+			return nil, err
+		}
+	}
+
+	sub := &subscriber{
+		ch:           make(chan *Data, bufferSize),
+		overflowChan: make(chan struct{}),
+		isLive:       opt.from == nil,
+	}
+
+	// block writing, so no record is missed or duplicated
+	// between catching up and live
+	j.Lock()
+	if err := j.checkWritable(); err != nil {
+		j.Unlock()
+		return nil, err
+	}
+	var end Position
+	if opt.from != nil {
+		if err := j.Flush(); err != nil {
+			j.Unlock()
+			return nil, errors.Wrap(err, "flush journal")
+		}
+		end = j.currentPosition()
+	}
+	j.metrics.SetGauge(metricSubscribers, float64(j.subs.add(sub)))
+	j.Unlock()
+
+	j.logger.Info("new subscriber",
+		zap.Int64("id", sub.id),
+		zap.Int("buffer", bufferSize),
+		zap.Any("from", opt.from))
+	j.goBackground(func() { j.runSubscriber(ctx, sub, opt.from, end) })
+	return &Subscription{C: sub.ch, sub: sub}, nil
+}
+
+// SubscriberStats return statistics of all subscribers
+func (j *Journal) SubscriberStats() (stats []*SubscriberStat) {
+	j.subs.RLock()
+	for _, s := range j.subs.subs {
+		stats = append(stats, s.stat())
+	}
+	j.subs.RUnlock()
+
+	sort.Slice(stats, func(i, k int) bool {
+		return stats[i].ID < stats[k].ID
+	})
+	return stats
+}
+
+// CurrentPosition return position of the next record to be written
+func (j *Journal) CurrentPosition() Position {
+	j.RLock()
+	defer j.RUnlock()
+	return j.currentPosition()
+}
+
+func (j *Journal) currentPosition() Position {
+	if j.dataEnc == nil {
+		return Position{}
+	}
+
+	return Position{
+		Segment: SegmentName(j.dataFp.Name()),
+		Index:   j.dataEnc.count(),
+	}
+}
+
+// publish send copy of written record to subscribers,
+// so caller could reuse `data` after writing.
+func (j *Journal) publish(data *Data, ts time.Time) {
+	if j.subs.isEmpty() {
+		return
+	}
+
+	cp := *data
+	cp.Timestamp = ts
+	if data.Data != nil {
+		cp.Data = make(map[string]interface{}, len(data.Data))
+		for k, v := range data.Data {
+			cp.Data[k] = v
+		}
+	}
+	if data.Headers != nil {
+		cp.Headers = make(map[string]string, len(data.Headers))
+		for k, v := range data.Headers {
+			cp.Headers[k] = v
+		}
+	}
+	if dropped := j.subs.publish(&cp); dropped != 0 {
+		j.metrics.AddCounter(metricSubscriberDropped, float64(dropped))
+	}
+}
+
+func (j *Journal) runSubscriber(parentCtx context.Context, sub *subscriber, from *Position, end Position) {
+	logger := j.logger.With(zap.Int64("subscriber", sub.id))
+	var (
+		stopErr  error
+		stopLock sync.Mutex
+	)
+	setStopErr := func(err error) {
+		stopLock.Lock()
+		if stopErr == nil {
+			stopErr = err
+		}
+		stopLock.Unlock()
+	}
+	defer func() {
+		j.metrics.SetGauge(metricSubscribers, float64(j.subs.remove(sub)))
+		setStopErr(parentCtx.Err())
+		stopLock.Lock()
+		sub.close(stopErr)
+		stopLock.Unlock()
+		logger.Info("subscriber closed", zap.Error(stopErr))
+	}()
+
+	// stop subscriber when journal closing
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+	go func() {
+		select {
+		case <-j.stopChan:
+			setStopErr(ErrClosed)
+			cancel()
+		case <-sub.overflowChan:
+			logger.Error("too many records written during catching up, close subscriber",
+				zap.Int("pending", subscribeCatchUpPendingSize))
+			setStopErr(ErrSubscriberOverflow)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if from != nil {
+		if err := j.catchUp(ctx, sub, *from, end); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			// could not switch to live without missing records
+			logger.Error("catch up from disk, close subscriber", zap.Error(err))
+			setStopErr(errors.Wrap(err, "catch up from disk"))
+			return
+		}
+
+		// deliver records written during catching up, then switch to live
+		for {
+			sub.Lock()
+			pending := sub.pending
+			sub.pending = nil
+			if len(pending) == 0 {
+				sub.isLive = true
+				sub.Unlock()
+				break
+			}
+			sub.Unlock()
+
+			for _, data := range pending {
+				select {
+				case sub.ch <- data:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		logger.Debug("subscriber switch to live")
+	}
+
+	<-ctx.Done()
+}
+
+// catchUp deliver records on disk in [from, end)
+func (j *Journal) catchUp(ctx context.Context, sub *subscriber, from, end Position) (err error) {
+	segs, err := ScanSegments(j.bufDirPath)
+	if err != nil {
+		return errors.Wrapf(err, "scan segments in `%s`", j.bufDirPath)
+	}
+
+	for _, seg := range segs {
+		if seg.DataFile == "" ||
+			!j.naming.isOwned(seg.Name) ||
+			segmentNameLess(seg.Name, from.Segment) ||
+			segmentNameLess(end.Segment, seg.Name) {
+			continue
+		}
+
+		var idx int64
+		if err = ForEachDataInFile(seg.DataFile, func(data *Data) error {
+			defer func() { idx++ }()
+			switch {
+			case seg.Name == end.Segment && idx >= end.Index:
+				return errStopIteration
+			case seg.Name == from.Segment && idx < from.Index:
+				return nil
+			}
+
+			select {
+			case sub.ch <- data:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}); err != nil && err != errStopIteration {
+			return err
+		}
+	}
+
+	return nil
+}
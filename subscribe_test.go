@@ -0,0 +1,243 @@
+package journal
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeSubscribeTestData(t *testing.T, j *Journal, from, to int64) {
+	for id := from; id <= to; id++ {
+		if err := j.WriteData(&Data{ID: id, Data: map[string]interface{}{"id": id}}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+}
+
+func expectSubscribedIDs(t *testing.T, ch <-chan *Data, from, to int64) {
+	for id := from; id <= to; id++ {
+		select {
+		case data, ok := <-ch:
+			if !ok {
+				t.Fatalf("channel closed, expect %d", id)
+			}
+			if data.ID != id {
+				t.Fatalf("expect %d, got %d", id, data.ID)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout waiting for %d", id)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := newTestJournal(t, ctx)
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	sub1, err := j.Subscribe(subCtx, 100)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	sub2, err := j.Subscribe(subCtx, 100)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	slowSub, err := j.Subscribe(subCtx, 1)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	writeSubscribeTestData(t, j, 1, 10)
+	expectSubscribedIDs(t, sub1.C, 1, 10)
+	expectSubscribedIDs(t, sub2.C, 1, 10)
+
+	stats := j.SubscriberStats()
+	if len(stats) != 3 || stats[2].Dropped != 9 || stats[0].Dropped != 0 {
+		t.Fatalf("got wrong stats: %+v", stats)
+	}
+	if v := j.GetMetric()[metricSubscriberDropped]; v != float64(9) {
+		t.Fatalf("expect 9 dropped, got %v", v)
+	}
+	expectSubscribedIDs(t, slowSub.C, 1, 1)
+	if err = sub1.Err(); err != nil {
+		t.Fatalf("running subscription should not have error, got %+v", err)
+	}
+
+	subCancel()
+	for _, sub := range []*Subscription{sub1, sub2, slowSub} {
+		select {
+		case _, ok := <-sub.C:
+			if ok {
+				t.Fatal("should not receive more records")
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("channel should be closed")
+		}
+		if err = sub.Err(); err != context.Canceled {
+			t.Fatalf("expect canceled, got %+v", err)
+		}
+	}
+
+	if _, err = j.Subscribe(ctx, -1); err == nil {
+		t.Fatal("should not accept negative buffer size")
+	}
+	if _, err = j.Subscribe(ctx, 1, WithSubscribeFrom(Position{})); err == nil {
+		t.Fatal("should not accept empty position")
+	}
+}
+
+func TestSubscribeFrom(t *testing.T) {
+	for _, isCompress := range [...]bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		j, dir := newTestJournal(t, ctx, WithIsCompress(isCompress))
+		defer os.RemoveAll(dir)
+
+		start := j.CurrentPosition()
+		if start.Index != 0 || start.Segment == "" {
+			t.Fatalf("got wrong position: %+v", start)
+		}
+		writeSubscribeTestData(t, j, 1, 5)
+		if err := j.Rotate(ctx); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		writeSubscribeTestData(t, j, 6, 8)
+		if pos := j.CurrentPosition(); pos.Index != 3 || pos.Segment <= start.Segment {
+			t.Fatalf("got wrong position: %+v", pos)
+		}
+
+		sub, err := j.Subscribe(ctx, 100, WithSubscribeFrom(Position{Segment: start.Segment, Index: 2}))
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		done := make(chan struct{})
+		go func() {
+			writeSubscribeTestData(t, j, 9, 20)
+			close(done)
+		}()
+
+		expectSubscribedIDs(t, sub.C, 3, 20)
+		<-done
+		j.Close(ctx)
+		cancel()
+	}
+}
+
+func TestSubscribeCopyRecord(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := newTestJournal(t, ctx)
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+
+	sub, err := j.Subscribe(ctx, 10)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// caller reuse record after writing
+	data := &Data{ID: 1, Data: map[string]interface{}{"n": 1}, Headers: map[string]string{"h": "1"}}
+	if err = j.WriteData(data); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	data.ID = 2
+	data.Data["n"] = 2
+	data.Headers["h"] = "2"
+
+	got := <-sub.C
+	if got == data || got.ID != 1 || got.Data["n"] != 1 || got.Headers["h"] != "1" {
+		t.Fatalf("subscriber should receive copy of written record, got %+v", got)
+	}
+	if got.Timestamp.IsZero() || !data.Timestamp.IsZero() {
+		t.Fatalf("only the copy should be stamped, got %v & %v", got.Timestamp, data.Timestamp)
+	}
+}
+
+func TestSubscribeCatchUpOverflow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := newTestJournal(t, ctx)
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+
+	writeSubscribeTestData(t, j, 0, 9)
+	// catching up is blocked since channel is not consumed
+	sub, err := j.Subscribe(ctx, 0, WithSubscribeFrom(Position{
+		Segment: j.CurrentPosition().Segment,
+		Index:   0,
+	}))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	writeSubscribeTestData(t, j, 10, 10+subscribeCatchUpPendingSize)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-sub.C:
+			if !ok {
+				if err = sub.Err(); err != ErrSubscriberOverflow {
+					t.Fatalf("expect overflow, got %+v", err)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("subscriber should be closed after catch up buffer overflowed")
+		}
+	}
+}
+
+func TestSubscribeCatchUpFailed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := newTestJournal(t, ctx)
+	defer os.RemoveAll(dir)
+	defer j.Close(ctx)
+
+	start := j.CurrentPosition()
+	writeSubscribeTestData(t, j, 1, 5)
+	if err := j.Rotate(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	writeSubscribeTestData(t, j, 6, 8)
+
+	// break the last record of sealed segment
+	segs, err := ScanSegments(dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var fpath string
+	for _, seg := range segs {
+		if seg.Name == start.Segment {
+			fpath = seg.DataFile
+		}
+	}
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = os.Truncate(fpath, fi.Size()-2); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	sub, err := j.Subscribe(ctx, 100, WithSubscribeFrom(start))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expectSubscribedIDs(t, sub.C, 1, 4)
+	select {
+	case data, ok := <-sub.C:
+		if ok {
+			t.Fatalf("should not switch to live after catching up failed, got %d", data.ID)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("channel should be closed")
+	}
+	if sub.Err() == nil {
+		t.Fatal("should report error of catching up")
+	}
+}
@@ -0,0 +1,536 @@
+package journal
+
+// verify.go
+// offline check & repair buf directory.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+	"github.com/tinylib/msgp/msgp"
+)
+
+const (
+	quarantineDirName = "quarantine"
+)
+
+// VerifyIssueType type of problem found by `Verify`
+type VerifyIssueType string
+
+const (
+	// IssueUndecodableRecord record in data file cannot be decoded
+	IssueUndecodableRecord VerifyIssueType = "undecodable_record"
+	// IssueTruncatedGzip gzip member in data file is incomplete
+	IssueTruncatedGzip VerifyIssueType = "truncated_gzip"
+	// IssueTruncatedIds ids file contains incomplete id
+	IssueTruncatedIds VerifyIssueType = "truncated_ids"
+	// IssueOrphanIds ids file has no data file partner
+	IssueOrphanIds VerifyIssueType = "orphan_ids"
+	// IssueSequenceGap segments' sequence number is not continuous
+	IssueSequenceGap VerifyIssueType = "sequence_gap"
+	// IssueChecksumMismatch file content mismatch with segment meta
+	IssueChecksumMismatch VerifyIssueType = "checksum_mismatch"
+)
+
+// VerifyIssue problem found by `Verify`
+type VerifyIssue struct {
+	Type VerifyIssueType `json:"type"`
+	File string          `json:"file"`
+	// Offset bytes offset of the first broken byte in file
+	Offset  int64  `json:"offset"`
+	Message string `json:"message"`
+	// Repaired whether issue is fixed by repair
+	Repaired bool `json:"repaired"`
+}
+
+// VerifyReport result of `Verify`
+type VerifyReport struct {
+	Dir      string         `json:"dir"`
+	Segments int            `json:"segments"`
+	Records  int64          `json:"records"`
+	Ids      int64          `json:"ids"`
+	Issues   []*VerifyIssue `json:"issues"`
+}
+
+// OK return true if there is no unrepaired issue
+func (r *VerifyReport) OK() bool {
+	for _, issue := range r.Issues {
+		if !issue.Repaired && issue.Type != IssueSequenceGap {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *VerifyReport) addIssue(typ VerifyIssueType, fpath string, offset int64, msg string) *VerifyIssue {
+	issue := &VerifyIssue{
+		Type:    typ,
+		File:    fpath,
+		Offset:  offset,
+		Message: msg,
+	}
+	r.Issues = append(r.Issues, issue)
+	return issue
+}
+
+type verifyOption struct {
+	isRepair bool
+	logger   *utils.LoggerType
+	clock    Clock
+}
+
+// VerifyOptionFunc option of `Verify`
+type VerifyOptionFunc func(*verifyOption) error
+
+// WithVerifyRepair truncate broken data & ids files,
+// move broken parts into `quarantine` sub directory.
+// repaired segments are kept sealed, their valid records will still be replayed.
+func WithVerifyRepair(isRepair bool) VerifyOptionFunc {
+	return func(o *verifyOption) error {
+		o.isRepair = isRepair
+		return nil
+	}
+}
+
+// WithVerifyLogger set logger of verify, default to `Logger`
+func WithVerifyLogger(logger *utils.LoggerType) VerifyOptionFunc {
+	return func(o *verifyOption) error {
+		if logger == nil {
+			return fmt.Errorf("logger cannot be nil")
+		}
+
+		o.logger = logger
+		return nil
+	}
+}
+
+// WithVerifyClock set clock to update repaired segments in manifest, default to `utils.Clock`
+func WithVerifyClock(clock Clock) VerifyOptionFunc {
+	return func(o *verifyOption) error {
+		if clock == nil {
+			return fmt.Errorf("clock cannot be nil")
+		}
+
+		o.clock = clock
+		return nil
+	}
+}
+
+// Verify decode every record in buf directory, and cross-check ids & data files.
+// journal in directory should not be running.
+func Verify(dir string, opts ...VerifyOptionFunc) (report *VerifyReport, err error) {
+	opt := &verifyOption{
+		logger: Logger,
+		clock:  utils.Clock,
+	}
+	for _, optf := range opts {
+		if err = optf(opt); err != nil {
+			return nil, err
+		}
+	}
+
+	segs, err := ScanSegments(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "scan segments in `%s`", dir)
+	}
+
+	logger := opt.logger.With(zap.String("dir", dir), zap.Bool("repair", opt.isRepair))
+	report = &VerifyReport{
+		Dir:      dir,
+		Segments: len(segs),
+	}
+	for _, seg := range segs {
+		if seg.DataFile != "" {
+			if err = verifyDataFile(report, seg.DataFile, opt); err != nil {
+				return nil, err
+			}
+		}
+
+		if seg.IdsFile != "" {
+			if err = verifyIdsFile(report, seg.IdsFile, opt); err != nil {
+				return nil, err
+			}
+		}
+
+		if seg.IdsFile != "" && seg.DataFile == "" {
+			issue := report.addIssue(IssueOrphanIds, seg.IdsFile, 0, "ids file has no data file")
+			if opt.isRepair {
+				if err = quarantineFile(opt.logger, seg.IdsFile, 0); err != nil {
+					return nil, err
+				}
+				issue.Repaired = true
+			}
+		}
+	}
+
+	if opt.isRepair {
+		if err = markRepaired(opt.clock, dir, report); err != nil {
+			return nil, err
+		}
+	}
+
+	verifySequence(report, segs)
+	logger.Info("verify done",
+		zap.Int("segments", report.Segments),
+		zap.Int64("records", report.Records),
+		zap.Int("issues", len(report.Issues)))
+	return report, nil
+}
+
+// markRepaired keep repaired segments replayable in manifests of directory,
+// only broken parts are quarantined, valid records kept by repair should still be replayed.
+// meta of repaired segments is dropped since files changed.
+func markRepaired(clock Clock, dir string, report *VerifyReport) error {
+	var (
+		names    = map[string][]string{} // prefix -> segments
+		isMarked = map[string]bool{}
+	)
+	for _, issue := range report.Issues {
+		name := SegmentName(issue.File)
+		if !issue.Repaired || isMarked[name] {
+			continue
+		}
+		info, err := ParseSegmentName(name)
+		if err != nil {
+			continue
+		}
+
+		isMarked[name] = true
+		names[info.Prefix] = append(names[info.Prefix], name)
+	}
+
+	for prefix, segs := range names {
+		m, err := loadManifest(clock, dir, prefix)
+		if os.IsNotExist(err) {
+			// manifest will be rebuilt by scanning
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "load manifest of prefix `%s`", prefix)
+		}
+
+		for _, name := range segs {
+			seg := m.GetSegment(name)
+			if seg == nil {
+				continue
+			}
+			switch seg.State {
+			case SegmentActive, SegmentSealed, SegmentReplaying:
+				if err = m.Seal(name, nil); err != nil {
+					return errors.Wrapf(err, "seal repaired segment `%s`", name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// verifyDataFile decode all records in data file,
+// file is read by stream, so large segments are not loaded into memory.
+func verifyDataFile(report *VerifyReport, fpath string, opt *verifyOption) (err error) {
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return errors.Wrapf(err, "open file `%s`", fpath)
+	}
+	defer fp.Close()
+
+	var (
+		issue *VerifyIssue
+		// goodLen length of valid content
+		goodLen int64
+	)
+	if isFileGZ(fpath) {
+		issue, goodLen, err = verifyGzData(report, fpath, fp)
+	} else {
+		// padding of direct io is not counted as content
+		var n int64
+		if n, err = dataLogicalLen(fp); err != nil {
+			return err
+		}
+		issue, goodLen, err = verifyRawData(report, fpath, io.NewSectionReader(fp, 0, n))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "read file `%s`", fpath)
+	}
+
+	if issue == nil {
+		return verifyChecksum(report, fpath, io.NewSectionReader(fp, 0, goodLen))
+	}
+
+	if opt.isRepair {
+		if err = quarantineFile(opt.logger, fpath, goodLen); err != nil {
+			return err
+		}
+		issue.Repaired = true
+	}
+
+	return nil
+}
+
+// countReader count bytes read from underlying reader
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// errReader remember the last error of underlying reader except EOF
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (n int, err error) {
+	n, err = e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
+
+// verifyRawData decode records in uncompressed data,
+// return issue and length of valid content.
+func verifyRawData(report *VerifyReport, fpath string, r io.Reader) (*VerifyIssue, int64, error) {
+	var (
+		err    error
+		offset int64
+		b      []byte
+		cr     = &countReader{r: r}
+		mr     = msgp.NewReaderSize(cr, BufSize)
+		data   = new(Data)
+	)
+	for {
+		if b, err = mr.R.Peek(1); len(b) == 0 {
+			if err == io.EOF {
+				err = nil
+			}
+			return nil, offset, err
+		}
+		if err = data.DecodeMsg(mr); err != nil {
+			return report.addIssue(IssueUndecodableRecord, fpath, offset, err.Error()), offset, nil
+		}
+
+		report.Records++
+		offset = cr.n - int64(mr.R.Buffered())
+	}
+}
+
+// verifyGzData decode records in every gzip members,
+// return issue and length of valid content.
+func verifyGzData(report *VerifyReport, fpath string, r io.Reader) (*VerifyIssue, int64, error) {
+	var (
+		err    error
+		offset int64
+		cr     = &countReader{r: r}
+		br     = bufio.NewReaderSize(cr, BufSize)
+		gz     = new(gzip.Reader)
+		data   = new(Data)
+	)
+	for {
+		if _, err = br.Peek(1); err == io.EOF {
+			return nil, offset, nil
+		} else if err != nil {
+			return nil, offset, err
+		}
+
+		if err = gz.Reset(br); err != nil {
+			return report.addIssue(IssueTruncatedGzip, fpath, offset, err.Error()), offset, nil
+		}
+		gz.Multistream(false)
+		member := &errReader{r: gz}
+		mr := msgp.NewReaderSize(member, BufSize)
+		for {
+			if _, err = mr.R.Peek(1); err == io.EOF {
+				break
+			}
+			if err == nil {
+				err = data.DecodeMsg(mr)
+			}
+			if member.err != nil {
+				return report.addIssue(IssueTruncatedGzip, fpath, offset, member.err.Error()), offset, nil
+			} else if err != nil {
+				return report.addIssue(IssueUndecodableRecord, fpath, offset, err.Error()), offset, nil
+			}
+			report.Records++
+		}
+
+		offset = cr.n - int64(br.Buffered())
+	}
+}
+
+// verifyIdsFile decode all ids in ids file
+func verifyIdsFile(report *VerifyReport, fpath string, opt *verifyOption) (err error) {
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return errors.Wrapf(err, "open file `%s`", fpath)
+	}
+	defer fp.Close()
+
+	var (
+		issue *VerifyIssue
+		dec   *IdsDecoder
+		n     int64
+		fi    os.FileInfo
+	)
+	if fi, err = fp.Stat(); err != nil {
+		return errors.Wrapf(err, "stat file `%s`", fpath)
+	} else if fi.Size() == 0 {
+		return nil
+	}
+
+	if dec, err = NewIdsDecoder(fp, isFileGZ(fpath)); err != nil {
+		issue = report.addIssue(IssueTruncatedGzip, fpath, 0, err.Error())
+	} else {
+		for {
+			if _, err = dec.Read(); err == io.EOF {
+				break
+			} else if err != nil {
+				issue = report.addIssue(IssueTruncatedIds, fpath, n*8, err.Error())
+				break
+			}
+			n++
+		}
+	}
+
+	report.Ids += n
+	if issue == nil {
+		return verifyChecksum(report, fpath, io.NewSectionReader(fp, 0, fi.Size()))
+	}
+
+	if opt.isRepair {
+		// position in compressed ids file is unknown, quarantine whole file
+		goodLen := issue.Offset
+		if isFileGZ(fpath) {
+			goodLen = 0
+		}
+		if err = quarantineFile(opt.logger, fpath, goodLen); err != nil {
+			return err
+		}
+		issue.Repaired = true
+	}
+
+	return nil
+}
+
+// verifyChecksum compare content of file with sealed segment meta
+func verifyChecksum(report *VerifyReport, fpath string, r io.Reader) error {
+	meta, err := LoadSegmentMeta(fpath)
+	if err != nil {
+		return nil
+	}
+
+	var (
+		expectLen int64
+		expectCrc uint32
+	)
+	if IsDataFile(fpath) {
+		expectLen, expectCrc = meta.DataBytes, meta.DataChecksum
+	} else {
+		expectLen, expectCrc = meta.IdsBytes, meta.IdsChecksum
+	}
+
+	crc := crc32.New(crc32Table)
+	n, err := io.Copy(crc, r)
+	if err != nil {
+		return errors.Wrapf(err, "read file `%s`", fpath)
+	}
+	if n != expectLen {
+		report.addIssue(IssueChecksumMismatch, fpath, 0,
+			fmt.Sprintf("expect %d bytes, got %d", expectLen, n))
+	} else if sum := crc.Sum32(); sum != expectCrc {
+		report.addIssue(IssueChecksumMismatch, fpath, 0,
+			fmt.Sprintf("expect crc %d, got %d", expectCrc, sum))
+	}
+
+	return nil
+}
+
+// verifySequence check whether segments have continuous sequence number.
+// daily sequences are checked in the same day of the same prefix,
+// global sequences are checked across days of the same prefix.
+func verifySequence(report *VerifyReport, segs []*SegmentFiles) {
+	// last segment of each prefix, segments are already ordered by prefix & sequence
+	last := map[string]*SegmentNameInfo{}
+	lastName := map[string]string{}
+	for _, seg := range segs {
+		info, err := ParseSegmentName(seg.Name)
+		if err != nil {
+			continue
+		}
+
+		key := info.Prefix
+		if info.IsGlobalSeq {
+			key += globalSeqMark
+		}
+		if prev, ok := last[key]; ok &&
+			(info.IsGlobalSeq || prev.Date.Equal(info.Date)) &&
+			info.Seq != prev.Seq+1 {
+			report.addIssue(IssueSequenceGap, seg.Name, 0,
+				fmt.Sprintf("missing segments between %s and %s", lastName[key], seg.Name))
+		}
+		last[key], lastName[key] = info, seg.Name
+	}
+}
+
+// quarantineFile move bytes after `goodLen` into quarantine directory,
+// then replace file by its first `goodLen` bytes. remove file if `goodLen` is 0.
+//
+// file is replaced rather than truncated in place,
+// since it may be hard linked by snapshots.
+func quarantineFile(logger *utils.LoggerType, fpath string, goodLen int64) (err error) {
+	qdir := filepath.Join(filepath.Dir(fpath), quarantineDirName)
+	if err = PrepareDir(qdir); err != nil {
+		return errors.Wrapf(err, "prepare quarantine dir `%s`", qdir)
+	}
+
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return errors.Wrapf(err, "open file `%s`", fpath)
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "stat file `%s`", fpath)
+	}
+	if goodLen > fi.Size() {
+		goodLen = fi.Size()
+	}
+
+	qfpath := filepath.Join(qdir, fmt.Sprintf("%s.%d.bad", filepath.Base(fpath), goodLen))
+	if err = writeReaderAtomic(qfpath, io.NewSectionReader(fp, goodLen, fi.Size()-goodLen)); err != nil {
+		return errors.Wrapf(err, "write quarantine file `%s`", qfpath)
+	}
+
+	if goodLen == 0 {
+		if err = os.Remove(fpath); err != nil {
+			return errors.Wrapf(err, "remove file `%s`", fpath)
+		}
+	} else if err = writeReaderAtomic(fpath, io.NewSectionReader(fp, 0, goodLen)); err != nil {
+		return errors.Wrapf(err, "replace file `%s`", fpath)
+	}
+
+	// file changed, meta is no longer valid
+	if err = removeSegmentMeta(fpath); err != nil {
+		return err
+	}
+
+	logger.Warn("quarantine broken file",
+		zap.String("file", fpath),
+		zap.Int64("valid_bytes", goodLen),
+		zap.String("quarantine", qfpath))
+	return nil
+}
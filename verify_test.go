@@ -0,0 +1,258 @@
+package journal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func prepareVerifyDir(t *testing.T, isCompress bool) (dir string, segs []*SegmentFiles) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := newTestJournal(t, ctx, WithIsCompress(isCompress))
+	var err error
+	for id := int64(0); id < 10; id++ {
+		if err = j.WriteData(&Data{ID: id, Data: map[string]interface{}{"id": id}}); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = j.WriteId(id); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err = j.Rotate(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	j.Close(ctx)
+
+	if segs, err = ScanSegments(dir); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return dir, segs
+}
+
+func TestVerify(t *testing.T) {
+	for _, isCompress := range [...]bool{false, true} {
+		dir, segs := prepareVerifyDir(t, isCompress)
+		defer os.RemoveAll(dir)
+
+		report, err := Verify(dir)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if !report.OK() || report.Records != 10 || report.Ids != 10 {
+			t.Fatalf("got wrong report: %+v", report)
+		}
+
+		// break sealed data file
+		dataFpath := segs[0].DataFile
+		fi, err := os.Stat(dataFpath)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		goodLen := fi.Size()
+		if isCompress {
+			if err = os.Truncate(dataFpath, goodLen-3); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		} else {
+			fp, err := os.OpenFile(dataFpath, os.O_APPEND|os.O_WRONLY, FileMode)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if _, err = fp.Write([]byte{0xc1, 0x00}); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			fp.Close()
+		}
+
+		// orphan ids & sequence gap
+		orphanFpath := filepath.Join(dir, SegmentName(dataFpath)[:9]+"00000009.ids")
+		if err = ioutil.WriteFile(orphanFpath, nil, FileMode); err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		if report, err = Verify(dir); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		t.Logf("got report: %+v", report)
+		if report.OK() {
+			t.Fatal("should found issues")
+		}
+		issues := map[VerifyIssueType]*VerifyIssue{}
+		for _, issue := range report.Issues {
+			issues[issue.Type] = issue
+		}
+		brokenType := IssueUndecodableRecord
+		if isCompress {
+			brokenType = IssueTruncatedGzip
+		}
+		if issue, ok := issues[brokenType]; !ok || issue.File != dataFpath {
+			t.Fatalf("should found %v in `%s`", brokenType, dataFpath)
+		} else if !isCompress && issue.Offset != goodLen {
+			t.Fatalf("expect broken offset %d, got %d", goodLen, issue.Offset)
+		}
+		if _, ok := issues[IssueOrphanIds]; !ok {
+			t.Fatal("should found orphan ids")
+		}
+		if _, ok := issues[IssueSequenceGap]; !ok {
+			t.Fatal("should found sequence gap")
+		}
+
+		// repair
+		if report, err = Verify(dir, WithVerifyRepair(true), WithVerifyLogger(newTestLogger(t))); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("all issues should be repaired: %+v", report)
+		}
+		if _, err = os.Stat(orphanFpath); !os.IsNotExist(err) {
+			t.Fatalf("orphan ids file should be moved, got %+v", err)
+		}
+		m, err := LoadManifest(dir)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if seg := m.GetSegment(SegmentName(dataFpath)); seg == nil || seg.State != SegmentSealed {
+			t.Fatalf("repaired segment should be kept sealed in manifest, got %+v", seg)
+		}
+		qfs, err := ioutil.ReadDir(filepath.Join(dir, quarantineDirName))
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if len(qfs) != 2 {
+			t.Fatalf("expect 2 quarantined files, got %d", len(qfs))
+		}
+
+		if report, err = Verify(dir); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if !report.OK() {
+			t.Fatalf("should be fine after repair: %+v", report)
+		}
+		if !isCompress && report.Records != 10 {
+			t.Fatalf("should keep all valid records, got %d", report.Records)
+		}
+	}
+}
+
+func TestVerifyRepairThenReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, dir := prepareReplayJournal(t, ctx, 2)
+	defer os.RemoveAll(dir)
+	j.Close(ctx)
+
+	segs, err := ScanSegments(dir)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	fp, err := os.OpenFile(segs[0].DataFile, os.O_APPEND|os.O_WRONLY, FileMode)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = fp.Write([]byte{0xc1, 0x00}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	fp.Close()
+
+	report, err := Verify(dir, WithVerifyRepair(true), WithVerifyLogger(newTestLogger(t)))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("all issues should be repaired: %+v", report)
+	}
+
+	j, err = NewJournal(WithBufDirPath(dir), WithLogger(newTestLogger(t)))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = j.Start(ctx); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer j.Close(ctx)
+
+	var (
+		mu  sync.Mutex
+		got = map[int64]bool{}
+	)
+	if _, err = j.Replay(ctx, func(data *Data) error {
+		mu.Lock()
+		got[data.ID] = true
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for id := int64(0); id < 10; id++ {
+		if id%3 != 0 && !got[id] {
+			t.Fatalf("uncommitted record %d in repaired segment should be replayed, got %v", id, got)
+		}
+	}
+}
+
+func TestVerifySequence(t *testing.T) {
+	for names, gaps := range map[string][]string{
+		"20200101_00000001 20200101_00000002 20200102_00000001":       nil,
+		"20200101_00000001 20200101_00000003":                         {"20200101_00000003"},
+		"20200101_g00000001 20200102_g00000002 20200103_g00000003":    nil,
+		"20200101_g00000001 20200102_g00000003":                       {"20200102_g00000003"},
+		"a_20200101_g00000001 b_20200101_g00000005":                   nil,
+		"a_20200101_00000001 a_20200101_00000004 b_20200101_00000002": {"a_20200101_00000004"},
+	} {
+		var segs []*SegmentFiles
+		for _, name := range strings.Fields(names) {
+			segs = append(segs, &SegmentFiles{Name: name})
+		}
+		sort.Slice(segs, func(i, k int) bool {
+			return segmentNameLess(segs[i].Name, segs[k].Name)
+		})
+
+		report := &VerifyReport{}
+		verifySequence(report, segs)
+		var got []string
+		for _, issue := range report.Issues {
+			if issue.Type != IssueSequenceGap {
+				t.Fatalf("got unexpected issue %+v", issue)
+			}
+			got = append(got, issue.File)
+		}
+		if strings.Join(got, " ") != strings.Join(gaps, " ") {
+			t.Fatalf("expect gaps %v in `%s`, got %v", gaps, names, got)
+		}
+	}
+}
+
+func TestQuarantineFileKeepHardLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal-test-verify")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Logf("create directory: %v", dir)
+	defer os.RemoveAll(dir)
+
+	fpath := filepath.Join(dir, "20200102_00000001.buf")
+	if err = ioutil.WriteFile(fpath, []byte("goodbroken"), FileMode); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	// like snapshot
+	linked := filepath.Join(dir, "linked.buf")
+	if err = os.Link(fpath, linked); err != nil {
+		t.Skipf("hard link not supported: %+v", err)
+	}
+
+	if err = quarantineFile(newTestLogger(t), fpath, 4); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if cnt, err := ioutil.ReadFile(fpath); err != nil || string(cnt) != "good" {
+		t.Fatalf("expect valid bytes kept, got %q: %+v", cnt, err)
+	}
+	if cnt, err := ioutil.ReadFile(linked); err != nil || string(cnt) != "goodbroken" {
+		t.Fatalf("hard link should not be modified, got %q: %+v", cnt, err)
+	}
+}